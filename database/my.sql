@@ -7,7 +7,16 @@ CREATE TABLE IF NOT EXISTS users (
     age INTEGER,
     gender TEXT,
     first_name TEXT,
-    last_name TEXT
+    last_name TEXT,
+    avatar TEXT,
+    role TEXT NOT NULL DEFAULT 'user' -- user, moderator or admin
+);
+
+-- how far one-off data migrations and rebuilt indexes have got, so they only
+-- run again when their version changes, see migrate.go
+CREATE TABLE IF NOT EXISTS schema_versions (
+    name TEXT PRIMARY KEY,
+    version INTEGER NOT NULL
 );
 
 CREATE TABLE IF NOT EXISTS sessions (
@@ -20,44 +29,136 @@ CREATE TABLE IF NOT EXISTS sessions (
 CREATE TABLE IF NOT EXISTS posts (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     user_id INTEGER NOT NULL,
+    title TEXT NOT NULL DEFAULT '',
     content TEXT NOT NULL,
-    image_path TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    edited_at DATETIME,
+    like_count INTEGER NOT NULL DEFAULT 0, -- reactions, kept up to date by triggers, see migrate.go
+    comment_count INTEGER NOT NULL DEFAULT 0,
+    hot_score REAL NOT NULL DEFAULT 0,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS drafts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    title TEXT NOT NULL DEFAULT '',
+    content TEXT NOT NULL DEFAULT '',
+    tags TEXT NOT NULL DEFAULT '', -- comma separated tag ids
+    poll TEXT NOT NULL DEFAULT '', -- JSON, empty without a poll
+    publish_at DATETIME, -- set when scheduled
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY(user_id) REFERENCES users(id)
 );
 
+CREATE TABLE IF NOT EXISTS post_revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    post_id INTEGER NOT NULL,
+    editor_id INTEGER NOT NULL,
+    title TEXT,
+    content TEXT NOT NULL,
+    tags TEXT,
+    image_path TEXT, -- from before posts had attachments
+    attachments TEXT, -- their names, comma separated
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(post_id) REFERENCES posts(id),
+    FOREIGN KEY(editor_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS attachments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    post_id INTEGER, -- NULL while it belongs to a scheduled draft
+    draft_id INTEGER,
+    position INTEGER NOT NULL DEFAULT 0,
+    kind TEXT NOT NULL, -- image or file
+    path TEXT NOT NULL, -- for images the key their sizes are named after
+    name TEXT NOT NULL DEFAULT '', -- as uploaded, only for display
+    mime_type TEXT NOT NULL,
+    size INTEGER NOT NULL DEFAULT 0,
+    alt_text TEXT NOT NULL DEFAULT '',
+    caption TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(post_id) REFERENCES posts(id),
+    FOREIGN KEY(draft_id) REFERENCES drafts(id)
+);
+
+-- one row per stored upload that attachments or revisions refer to, kept up
+-- to date by triggers, see migrate.go. New uploads are named after the
+-- SHA-256 of the uploaded file, so the same file is only stored once.
+CREATE TABLE IF NOT EXISTS uploads (
+    path TEXT PRIMARY KEY, -- as in attachments.path
+    refs INTEGER NOT NULL DEFAULT 0
+);
+
 CREATE TABLE IF NOT EXISTS comments (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     post_id INTEGER NOT NULL,
     user_id INTEGER NOT NULL,
-    content TEXT NOT NULL,
+    parent_id INTEGER, -- the comment this replies to, NULL at the top level
+    depth INTEGER NOT NULL DEFAULT 0,
+    reply_count INTEGER NOT NULL DEFAULT 0, -- direct replies, kept up to date by triggers
+    reaction_count INTEGER NOT NULL DEFAULT 0, -- kept up to date by triggers, for the "top" sort
+    content TEXT NOT NULL, -- emptied when deleted
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    edited_at DATETIME,
+    deleted_at DATETIME, -- set on tombstones, deleted comments that have replies
+    deleted_by INTEGER,
+    delete_reason TEXT, -- given by moderators
     FOREIGN KEY(post_id) REFERENCES posts(id),
-    FOREIGN KEY(user_id) REFERENCES users(id)
+    FOREIGN KEY(user_id) REFERENCES users(id),
+    FOREIGN KEY(parent_id) REFERENCES comments(id),
+    FOREIGN KEY(deleted_by) REFERENCES users(id)
 );
 
-CREATE TABLE IF NOT EXISTS likes (
+CREATE TABLE IF NOT EXISTS comment_revisions (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
+    comment_id INTEGER NOT NULL,
+    editor_id INTEGER NOT NULL, -- or who deleted it
+    content TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(comment_id) REFERENCES comments(id),
+    FOREIGN KEY(editor_id) REFERENCES users(id)
+);
+
+-- the reactions users can pick from, seeded with the defaults
+CREATE TABLE IF NOT EXISTS reaction_types (
+    emoji TEXT PRIMARY KEY,
+    position INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- a user can leave several reactions, each emoji once
+CREATE TABLE IF NOT EXISTS post_reactions (
     post_id INTEGER NOT NULL,
     user_id INTEGER NOT NULL,
+    emoji TEXT NOT NULL,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-    UNIQUE(post_id, user_id),
+    PRIMARY KEY (post_id, user_id, emoji),
     FOREIGN KEY(post_id) REFERENCES posts(id),
     FOREIGN KEY(user_id) REFERENCES users(id)
 );
 
-CREATE TABLE IF NOT EXISTS comment_likes (
-    id INTEGER PRIMARY KEY AUTOINCREMENT,
+CREATE TABLE IF NOT EXISTS comment_reactions (
     comment_id INTEGER NOT NULL,
     user_id INTEGER NOT NULL,
+    emoji TEXT NOT NULL,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-    UNIQUE(comment_id, user_id),
+    PRIMARY KEY (comment_id, user_id, emoji),
     FOREIGN KEY(comment_id) REFERENCES comments(id),
     FOREIGN KEY(user_id) REFERENCES users(id)
 );
 
 CREATE TABLE IF NOT EXISTS tags (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
-    name TEXT NOT NULL UNIQUE
+    name TEXT NOT NULL UNIQUE,
+    slug TEXT,
+    description TEXT NOT NULL DEFAULT '',
+    color TEXT NOT NULL DEFAULT '#4a6fa5',
+    status TEXT NOT NULL DEFAULT 'approved', -- pending or approved
+    proposed_by INTEGER,
+    FOREIGN KEY(proposed_by) REFERENCES users(id)
 );
 
 CREATE TABLE IF NOT EXISTS post_tags (
@@ -68,6 +169,92 @@ CREATE TABLE IF NOT EXISTS post_tags (
     FOREIGN KEY(tag_id) REFERENCES tags(id)
 );
 
+CREATE TABLE IF NOT EXISTS polls (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    post_id INTEGER NOT NULL UNIQUE,
+    question TEXT NOT NULL,
+    multiple BOOLEAN NOT NULL DEFAULT FALSE,
+    closes_at DATETIME, -- NULL keeps the poll open
+    voters INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY(post_id) REFERENCES posts(id)
+);
+
+CREATE TABLE IF NOT EXISTS poll_options (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    poll_id INTEGER NOT NULL,
+    position INTEGER NOT NULL,
+    label TEXT NOT NULL,
+    votes INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY(poll_id) REFERENCES polls(id)
+);
+
+-- one ballot per user and poll, whatever the number of options picked
+CREATE TABLE IF NOT EXISTS poll_ballots (
+    poll_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (poll_id, user_id),
+    FOREIGN KEY(poll_id) REFERENCES polls(id),
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS poll_votes (
+    poll_id INTEGER NOT NULL,
+    option_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    PRIMARY KEY (poll_id, user_id, option_id),
+    FOREIGN KEY(poll_id) REFERENCES polls(id),
+    FOREIGN KEY(option_id) REFERENCES poll_options(id),
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS collections (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(user_id, name),
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+-- a post is saved once per user, in one collection or none
+CREATE TABLE IF NOT EXISTS bookmarks (
+    user_id INTEGER NOT NULL,
+    post_id INTEGER NOT NULL,
+    collection_id INTEGER,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, post_id),
+    FOREIGN KEY(user_id) REFERENCES users(id),
+    FOREIGN KEY(post_id) REFERENCES posts(id),
+    FOREIGN KEY(collection_id) REFERENCES collections(id)
+);
+
+-- who a post, comment or message mentions, recorded when it is written
+CREATE TABLE IF NOT EXISTS mentions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    author_id INTEGER NOT NULL,
+    kind TEXT NOT NULL, -- post, comment or message
+    source_id INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(kind, source_id, user_id),
+    FOREIGN KEY(user_id) REFERENCES users(id),
+    FOREIGN KEY(author_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS notifications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    actor_id INTEGER NOT NULL,
+    kind TEXT NOT NULL, -- mention or reply
+    link TEXT NOT NULL,
+    excerpt TEXT NOT NULL DEFAULT '',
+    is_read BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id),
+    FOREIGN KEY(actor_id) REFERENCES users(id)
+);
+
 CREATE TABLE IF NOT EXISTS messages (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     sender_id INTEGER NOT NULL,
@@ -80,4 +267,17 @@ CREATE TABLE IF NOT EXISTS messages (
 );
 
 CREATE INDEX IF NOT EXISTS idx_messages_sender ON messages(sender_id);
-CREATE INDEX IF NOT EXISTS idx_messages_recipient ON messages(recipient_id);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_messages_recipient ON messages(recipient_id);
+CREATE INDEX IF NOT EXISTS idx_comments_post ON comments(post_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_post_tags_tag ON post_tags(tag_id, post_id);
+CREATE INDEX IF NOT EXISTS idx_post_revisions_post ON post_revisions(post_id);
+CREATE INDEX IF NOT EXISTS idx_comment_revisions_comment ON comment_revisions(comment_id);
+CREATE INDEX IF NOT EXISTS idx_drafts_user ON drafts(user_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_post ON attachments(post_id, position);
+CREATE INDEX IF NOT EXISTS idx_attachments_draft ON attachments(draft_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_path ON attachments(path);
+CREATE INDEX IF NOT EXISTS idx_drafts_publish ON drafts(publish_at);
+CREATE INDEX IF NOT EXISTS idx_poll_options_poll ON poll_options(poll_id, position);
+CREATE INDEX IF NOT EXISTS idx_bookmarks_post ON bookmarks(post_id);
+CREATE INDEX IF NOT EXISTS idx_mentions_user ON mentions(user_id);
+CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications(user_id, is_read);
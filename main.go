@@ -13,7 +13,9 @@ import (
 )
 
 func init() {
-	os.MkdirAll("./uploads", os.ModePerm)
+	if err := myserver.InitUploads(); err != nil {
+		log.Fatal("Failed to set up uploads:", err)
+	}
 	db, err := sql.Open("sqlite3", "./database/my.db")
 	if err != nil {
 		log.Fatal(err)
@@ -29,31 +31,61 @@ func init() {
 		log.Fatal("Failed to create users table:", err)
 	}
 
-	defaultTags := []string{"Music", "Sports", "Technology", "Art", "Food", "Travel", "Fashion", "Health", "Education", "Gaming"}
-	for _, tagName := range defaultTags {
-		_, err = db.Exec("INSERT OR IGNORE INTO tags (name) VALUES (?)", tagName)
-		if err != nil {
-			log.Printf("Warning: Failed to insert default tag '%s': %v", tagName, err)
-		}
+	if err := myserver.Migrate(db); err != nil {
+		log.Fatal("Failed to migrate database:", err)
+	}
+	if err := myserver.InitSearch(db); err != nil {
+		log.Fatal("Failed to set up search:", err)
 	}
+
 	myserver.InitHandlers(db)
 	myserver.InitWebsocket()
+	myserver.StartScheduler()
+	if err := myserver.StartUploadGC(); err != nil {
+		log.Fatal("Failed to start upload collection:", err)
+	}
 }
 func main() {
 	staticDir := filepath.Join(".", "static")
-	uploadsDir := filepath.Join(".", "uploads")
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(staticDir))))
-	http.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir(uploadsDir))))
+	http.Handle("/uploads/", myserver.ServeUploads())
 
 	http.HandleFunc("/", myserver.SignIn)
 	http.HandleFunc("/homepage", myserver.HomePage)
 	http.HandleFunc("/signup", myserver.SignUp)
 	http.HandleFunc("/logout", myserver.Logout)
+	http.HandleFunc("/avatar", myserver.UploadAvatar)
+	http.HandleFunc("/profile", myserver.ProfilePage)
+	http.HandleFunc("/notifications", myserver.NotificationsPage)
+	http.HandleFunc("/api/notifications", myserver.NotificationsAPI)
+
+	http.HandleFunc("/post", myserver.ViewPost)
+	http.HandleFunc("/api/post", myserver.PostAPI)
+	http.HandleFunc("/api/posts", myserver.PostsAPI)
+	http.HandleFunc("/api/drafts", myserver.DraftsAPI)
+	http.HandleFunc("/post/edit", myserver.EditPost)
+	http.HandleFunc("/post/delete", myserver.DeletePost)
+	http.HandleFunc("/post/revisions", myserver.PostRevisions)
 
+	http.HandleFunc("/search", myserver.Search)
+	http.HandleFunc("/api/search", myserver.SearchAPI)
 	http.HandleFunc("/tag", myserver.FilterByTag)
-	http.HandleFunc("/like", myserver.AddLike)
+	http.HandleFunc("/tags", myserver.TagsPage)
+	http.HandleFunc("/tags/propose", myserver.ProposeTag)
+	http.HandleFunc("/tags/review", myserver.ReviewTag)
+	http.HandleFunc("/tags/update", myserver.UpdateTag)
+	http.HandleFunc("/tags/merge", myserver.MergeTags)
 	http.HandleFunc("/comment", myserver.AddComment)
-	http.HandleFunc("/like-comment", myserver.LikeComment)
+	http.HandleFunc("/comment/edit", myserver.EditComment)
+	http.HandleFunc("/comment/delete", myserver.DeleteComment)
+	http.HandleFunc("/comment/revisions", myserver.CommentRevisions)
+	http.HandleFunc("/api/comments", myserver.CommentsAPI)
+	http.HandleFunc("/api/reactions", myserver.ReactionsAPI)
+	http.HandleFunc("/api/reaction-types", myserver.ReactionTypesAPI)
+	http.HandleFunc("/poll/vote", myserver.VotePoll)
+	http.HandleFunc("/saved", myserver.SavedPage)
+	http.HandleFunc("/api/bookmarks", myserver.BookmarksAPI)
+	http.HandleFunc("/api/collections", myserver.CollectionsAPI)
 
 	http.HandleFunc("/chat", myserver.Chat)
 	http.HandleFunc("/ws", myserver.HandleWebSocket)
@@ -0,0 +1,312 @@
+package myserver
+
+import (
+	"cmp"
+	"database/sql"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxAttachments    = 10
+	maxAltTextLength  = 300
+	maxCaptionLength  = 300
+	maxFileNameLength = 100
+)
+
+// fileDir prefixes the keys of attachments that are not images
+const fileDir = "files"
+
+// attachmentsFromRequest stages the files uploaded as "attachments" with
+// the alt texts and captions sent in the same order. Nothing is kept when
+// any of them is rejected. The caller inserts the attachments, then calls
+// promoteAttachments once that committed or discardAttachments if it failed.
+func attachmentsFromRequest(r *http.Request) ([]Attachment, error) {
+	if r.MultipartForm == nil {
+		return nil, nil
+	}
+	headers := r.MultipartForm.File["attachments"]
+	if len(headers) > maxAttachments {
+		return nil, fmt.Errorf("%w: a post can have at most %d attachments", errBadUpload, maxAttachments)
+	}
+	alts, captions := r.Form["alt"], r.Form["caption"]
+
+	var attachments []Attachment
+	for i, header := range headers {
+		attachment := Attachment{Name: cleanFileName(header.Filename)}
+		if i < len(alts) {
+			attachment.AltText = strings.TrimSpace(alts[i])
+		}
+		if i < len(captions) {
+			attachment.Caption = strings.TrimSpace(captions[i])
+		}
+		err := attachmentProblem(attachment)
+		if err == nil {
+			err = saveAttachment(header, &attachment)
+		}
+		if err != nil {
+			discardAttachments(attachments)
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, nil
+}
+
+// attachmentProblem checks the text the uploader gave an attachment
+func attachmentProblem(attachment Attachment) error {
+	if utf8.RuneCountInString(attachment.AltText) > maxAltTextLength {
+		return fmt.Errorf("%w: alt text is too long", errBadUpload)
+	}
+	if utf8.RuneCountInString(attachment.Caption) > maxCaptionLength {
+		return fmt.Errorf("%w: caption is too long", errBadUpload)
+	}
+	return nil
+}
+
+// saveAttachment checks one uploaded file and stages it: images in every
+// variant size, documents as they are, both named after the file's hash. A
+// file that is already stored is reused instead.
+func saveAttachment(header *multipart.FileHeader, attachment *Attachment) error {
+	file, err := header.Open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	data, mimeType, err := readUpload(file)
+	if err != nil {
+		return err
+	}
+	attachment.MimeType = mimeType
+	attachment.Kind = "file"
+	dir := fileDir
+	if isImageType(mimeType) {
+		attachment.Kind = "image"
+		dir = imageDir
+	}
+
+	hash := uploadHash(data)
+	if attachment.Path, err = reuseUpload(dir, hash); err != nil {
+		return err
+	} else if attachment.Path != "" {
+		if attachment.Size, err = storedSize(attachment.Path); err == nil {
+			return nil
+		}
+		// the stored copy went missing: store this one in its place
+		log.Printf("Failed to reuse upload %s, storing it again: %v", attachment.Path, err)
+		discardUpload("", attachment.Path)
+	}
+	if attachment.stage, err = newStage(); err != nil {
+		return err
+	}
+	if attachment.IsImage() {
+		attachment.Path, attachment.Size, err = processImage(attachment.stage, hash, data, mimeType)
+		return err
+	}
+	attachment.Path = path.Join(fileDir, hash+uploadTypes[mimeType].ext)
+	attachment.Size = int64(len(data))
+	return stageBlob(attachment.stage, attachment.Path, data)
+}
+
+// storedSize returns the size of the file an attachment links to: the full
+// variant of processed images, the upload itself otherwise
+func storedSize(key string) (int64, error) {
+	if isProcessedImage(key) {
+		key = imageVariantKey(key, "full")
+	}
+	blob, err := blobs.Open(key)
+	if err != nil {
+		return 0, err
+	}
+	defer blob.Close()
+	return blob.Size, nil
+}
+
+// cleanFileName keeps the base name of an uploaded file for display. It is
+// never used to name anything on disk.
+func cleanFileName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "." || name == "/" {
+		return ""
+	}
+	for utf8.RuneCountInString(name) > maxFileNameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+// insertAttachments links attachments to a post or a draft, owner being
+// the column, numbering them from position first
+func insertAttachments(q querier, owner string, ownerID int64, attachments []Attachment, first int) error {
+	for i, attachment := range attachments {
+		_, err := q.Exec(`INSERT INTO attachments
+			(`+owner+`, position, kind, path, name, mime_type, size, alt_text, caption)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			ownerID, first+i, attachment.Kind, attachment.Path, attachment.Name, attachment.MimeType,
+			attachment.Size, attachment.AltText, attachment.Caption)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// editedAttachments applies the edit form to a post's attachments: the
+// remove_<id> checkboxes, and the alt_<id>, caption_<id> and position_<id>
+// fields. The kept attachments come back in their new order.
+func editedAttachments(r *http.Request, attachments []Attachment) (kept, removed []Attachment, err error) {
+	for _, attachment := range attachments {
+		field := func(name string) string { return fmt.Sprintf("%s_%d", name, attachment.ID) }
+		if r.FormValue(field("remove")) != "" {
+			removed = append(removed, attachment)
+			continue
+		}
+		if _, ok := r.Form[field("alt")]; ok {
+			attachment.AltText = strings.TrimSpace(r.FormValue(field("alt")))
+			attachment.Caption = strings.TrimSpace(r.FormValue(field("caption")))
+		}
+		if position, err := strconv.Atoi(r.FormValue(field("position"))); err == nil {
+			attachment.Position = position
+		}
+		if err := attachmentProblem(attachment); err != nil {
+			return nil, nil, err
+		}
+		kept = append(kept, attachment)
+	}
+	slices.SortStableFunc(kept, func(a, b Attachment) int { return cmp.Compare(a.Position, b.Position) })
+	return kept, removed, nil
+}
+
+// saveAttachmentChanges stores an edit of a post's attachments, numbering
+// the kept ones in order and the added ones after them
+func saveAttachmentChanges(tx *sql.Tx, postID int64, kept, removed, added []Attachment) error {
+	for _, attachment := range removed {
+		if _, err := tx.Exec("DELETE FROM attachments WHERE id = ?", attachment.ID); err != nil {
+			return err
+		}
+	}
+	for i, attachment := range kept {
+		_, err := tx.Exec("UPDATE attachments SET position = ?, alt_text = ?, caption = ? WHERE id = ?",
+			i, attachment.AltText, attachment.Caption, attachment.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return insertAttachments(tx, "post_id", postID, added, len(kept))
+}
+
+// attachmentColumns is the select list scanAttachment reads, followed by
+// any extra columns
+const attachmentColumns = "id, kind, path, name, mime_type, size, alt_text, caption, position"
+
+func scanAttachment(rows *sql.Rows, extra ...any) (Attachment, error) {
+	var attachment Attachment
+	dest := []any{&attachment.ID, &attachment.Kind, &attachment.Path, &attachment.Name, &attachment.MimeType,
+		&attachment.Size, &attachment.AltText, &attachment.Caption, &attachment.Position}
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		return Attachment{}, err
+	}
+	attachment.URL = attachmentURL(attachment)
+	return attachment, nil
+}
+
+// attachmentURL links to an image at full size or to a document
+func attachmentURL(attachment Attachment) string {
+	if attachment.IsImage() {
+		return imageURL(attachment.Path, "full")
+	}
+	return blobURL(attachment.Path)
+}
+
+// loadAttachments returns the attachments of one post or draft in order
+func loadAttachments(q querier, owner string, ownerID any) ([]Attachment, error) {
+	rows, err := q.Query("SELECT "+attachmentColumns+" FROM attachments WHERE "+owner+" = ? ORDER BY position, id",
+		ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, rows.Err()
+}
+
+// loadPostAttachments fills in the attachments of a page of posts
+func loadPostAttachments(byID map[int]*Post, ids []any) error {
+	rows, err := db.Query(`SELECT `+attachmentColumns+`, post_id FROM attachments
+		WHERE post_id IN (`+placeholders(len(ids))+`)
+		ORDER BY post_id, position, id`, ids...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID int
+		attachment, err := scanAttachment(rows, &postID)
+		if err != nil {
+			return err
+		}
+		byID[postID].Attachments = append(byID[postID].Attachments, attachment)
+	}
+	return rows.Err()
+}
+
+// attachmentNames describes a post's attachments in its revisions
+func attachmentNames(attachments []Attachment) string {
+	names := make([]string, len(attachments))
+	for i, attachment := range attachments {
+		names[i] = attachment.Name
+		if names[i] == "" {
+			names[i] = path.Base(attachment.Path)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// promoteAttachments puts new attachments in place once the database
+// references them
+func promoteAttachments(attachments []Attachment) {
+	for _, attachment := range attachments {
+		promoteUpload(attachment.stage, attachment.Path)
+	}
+}
+
+// discardAttachments drops new attachments that were never saved
+func discardAttachments(attachments []Attachment) {
+	for _, attachment := range attachments {
+		discardUpload(attachment.stage, attachment.Path)
+	}
+}
+
+// removeAttachmentFiles deletes the stored files of deleted attachments,
+// unless other attachments still use them
+func removeAttachmentFiles(attachments []Attachment) {
+	paths := make([]string, len(attachments))
+	for i, attachment := range attachments {
+		paths[i] = attachment.Path
+	}
+	removeUploads(paths)
+}
@@ -0,0 +1,72 @@
+package myserver
+
+import (
+	"bytes"
+	"mime/multipart"
+	"testing"
+)
+
+// useTestStore stores uploads in a temporary directory for one test
+func useTestStore(t *testing.T) {
+	saved := blobs
+	blobs = NewLocalStore(t.TempDir(), nil)
+	t.Cleanup(func() { blobs = saved })
+}
+
+// formFile uploads data the way a browser sends a post's attachments
+func formFile(t *testing.T, name string, data []byte) *multipart.FileHeader {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("attachments", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	w.Close()
+	form, err := multipart.NewReader(&body, w.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return form.File["attachments"][0]
+}
+
+// storeAttachment saves an upload and commits it as an attachment of the post
+func storeAttachment(t *testing.T, postID int64, data []byte) Attachment {
+	t.Helper()
+	var attachment Attachment
+	if err := saveAttachment(formFile(t, "file", data), &attachment); err != nil {
+		t.Fatal(err)
+	}
+	if err := insertAttachments(db, "post_id", postID, []Attachment{attachment}, 0); err != nil {
+		t.Fatal(err)
+	}
+	promoteUpload(attachment.stage, attachment.Path)
+	return attachment
+}
+
+func TestSaveAttachmentReplacesMissingBlob(t *testing.T) {
+	db = openTestDB(t)
+	useTestStore(t)
+	db.Exec("INSERT INTO users (id, username, email, password) VALUES (1, 'alice', 'alice@example.com', 'x')")
+	db.Exec("INSERT INTO posts (id, user_id, title, content) VALUES (1, 1, 'post', 'content')")
+	pdf := []byte("%PDF-1.4\n%%EOF\n")
+
+	first := storeAttachment(t, 1, pdf)
+	second := storeAttachment(t, 1, pdf)
+	if second.Path != first.Path || second.stage != "" {
+		t.Fatalf("the same file was stored again as %s", second.Path)
+	}
+
+	removeBlobs([]string{first.Path})
+	third := storeAttachment(t, 1, pdf)
+	if third.Path != first.Path || third.Size != int64(len(pdf)) {
+		t.Errorf("stored the missing file as %s, %d bytes", third.Path, third.Size)
+	}
+	if size, err := storedSize(first.Path); err != nil || size != int64(len(pdf)) {
+		t.Errorf("the file is back with %d bytes, %v", size, err)
+	}
+	if len(pinnedUploads) != 0 {
+		t.Errorf("uploads left pinned: %v", pinnedUploads)
+	}
+}
@@ -0,0 +1,167 @@
+package myserver
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gofrs/uuid"
+)
+
+// avatarSizes are the square sizes (px) rendered for every uploaded avatar
+var avatarSizes = []int{32, 64, 128, 256}
+
+// avatarDir prefixes the keys of avatars, which are stored like any upload
+const avatarDir = "avatars"
+
+// avatarURL returns the public URL of an avatar at the given size, or "" when
+// the user has not uploaded one and the initials should be shown instead.
+func avatarURL(key string, size int) string {
+	if key == "" {
+		return ""
+	}
+	return blobURL(avatarKey(key, size))
+}
+
+// initials builds the two letter fallback avatar from a username
+func initials(username string) string {
+	result := ""
+	for _, word := range strings.Fields(username) {
+		if len(word) > 0 {
+			result += string(word[0])
+		}
+		if len(result) >= 2 {
+			break
+		}
+	}
+	return strings.ToUpper(result)
+}
+
+// UploadAvatar crops the uploaded picture to a square, stores it in every
+// avatar size and replaces the user's previous avatar.
+func UploadAvatar(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/homepage", http.StatusSeeOther)
+		return
+	}
+
+	if err := r.ParseMultipartForm(5 << 20); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		http.Error(w, "No avatar uploaded", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, mimeType, err := readUpload(file)
+	if err != nil {
+		uploadFailed(w, err)
+		return
+	}
+	if !isImageType(mimeType) {
+		http.Error(w, "Avatars have to be images", http.StatusBadRequest)
+		return
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, "Unsupported image format", http.StatusBadRequest)
+		return
+	}
+
+	// optional crop region chosen on the client, otherwise centre crop
+	cropX, _ := strconv.Atoi(r.FormValue("crop_x"))
+	cropY, _ := strconv.Atoi(r.FormValue("crop_y"))
+	cropSize, _ := strconv.Atoi(r.FormValue("crop_size"))
+	square := cropSquare(toRGBA(img), cropX, cropY, cropSize)
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		log.Printf("Failed to generate UUID: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	key := fmt.Sprintf("%s/%d_%s", avatarDir, userID, id.String()[:8])
+	stage, err := newStage()
+	if err != nil {
+		log.Printf("Failed to stage avatar: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	for _, size := range avatarSizes {
+		if err := writeAvatar(stage, key, size, resize(square, size, size)); err != nil {
+			log.Printf("Failed to save avatar: %v", err)
+			discardBlobs(stage, avatarKeys(key))
+			http.Error(w, "Failed to upload avatar", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var oldKey sql.NullString
+	db.QueryRow("SELECT avatar FROM users WHERE id = ?", userID).Scan(&oldKey)
+
+	if _, err := db.Exec("UPDATE users SET avatar = ? WHERE id = ?", key, userID); err != nil {
+		log.Printf("Failed to update avatar: %v", err)
+		discardBlobs(stage, avatarKeys(key))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	promoteBlobs(stage, avatarKeys(key))
+	if oldKey.Valid {
+		removeAvatar(oldKey.String)
+	}
+
+	http.Redirect(w, r, "/homepage", http.StatusSeeOther)
+}
+
+// avatarKey names the blob of one size of an avatar
+func avatarKey(key string, size int) string {
+	return fmt.Sprintf("%s_%d.png", key, size)
+}
+
+// avatarOf returns the avatar a blob named by avatarKey belongs to, or ""
+func avatarOf(blobKey string) string {
+	for _, size := range avatarSizes {
+		if key, ok := strings.CutSuffix(blobKey, fmt.Sprintf("_%d.png", size)); ok {
+			return key
+		}
+	}
+	return ""
+}
+
+// avatarKeys lists the blobs of every size of an avatar
+func avatarKeys(key string) []string {
+	keys := make([]string, len(avatarSizes))
+	for i, size := range avatarSizes {
+		keys[i] = avatarKey(key, size)
+	}
+	return keys
+}
+
+func writeAvatar(stage, key string, size int, img image.Image) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	return stageBlob(stage, avatarKey(key, size), buf.Bytes())
+}
+
+func removeAvatar(key string) {
+	removeBlobs(avatarKeys(key))
+}
@@ -0,0 +1,364 @@
+package myserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// BlobStore keeps uploaded files. Keys are slash separated paths such as
+// "images/<sha256>_feed.jpg"; where the bytes end up is up to the store.
+type BlobStore interface {
+	// Put stores a new blob. Uploads are written to staging areas of their
+	// own, so Put fails with errBlobExists rather than overwrite anything.
+	Put(key string, data []byte) error
+	// Open returns a blob for reading, or errBlobNotFound
+	Open(key string) (*Blob, error)
+	// Delete removes a blob. Deleting a blob that is gone is not an error.
+	Delete(key string) error
+	// Move gives a blob a new key, replacing any blob stored under it
+	Move(from, to string) error
+	// List returns every blob whose key starts with prefix
+	List(prefix string) ([]BlobInfo, error)
+	// SignedURL returns a link to the blob that stops working after expires
+	SignedURL(key string, expires time.Duration) (string, error)
+}
+
+// Blob is an open stored file. Blobs can seek, which lets range requests
+// be answered without reading the whole file.
+type Blob struct {
+	io.ReadSeekCloser
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobInfo describes a stored blob in a listing
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+var (
+	errBlobNotFound = errors.New("blob not found")
+	errBlobExists   = errors.New("blob already exists")
+)
+
+var (
+	blobs BlobStore = NewLocalStore("uploads", nil)
+
+	// blobURLExpiry is how long links to uploads last. Zero links to the
+	// uploads handler, which serves them to signed in users allowed to see
+	// them, see canViewUpload.
+	blobURLExpiry time.Duration
+)
+
+// InitUploads picks the blob store from the environment:
+//
+//	UPLOAD_STORE          "local" (default) or "s3"
+//	UPLOAD_URL_EXPIRY     a duration such as "1h" to hand out signed links
+//	UPLOAD_SIGNING_KEY    signs local links; random, so they end with a restart, if unset
+//	S3_ENDPOINT           e.g. "https://s3.eu-west-1.amazonaws.com" or "http://localhost:9000"
+//	S3_REGION             defaults to "us-east-1"
+//	S3_BUCKET, S3_ACCESS_KEY_ID, S3_SECRET_ACCESS_KEY
+func InitUploads() error {
+	if value := os.Getenv("UPLOAD_URL_EXPIRY"); value != "" {
+		expiry, err := time.ParseDuration(value)
+		if err != nil || expiry < time.Minute {
+			return fmt.Errorf("UPLOAD_URL_EXPIRY must be a duration of a minute or more, got %q", value)
+		}
+		blobURLExpiry = expiry
+	}
+
+	switch store := os.Getenv("UPLOAD_STORE"); store {
+	case "", "local":
+		blobs = NewLocalStore("uploads", []byte(os.Getenv("UPLOAD_SIGNING_KEY")))
+	case "s3":
+		region := os.Getenv("S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		s3, err := NewS3Store(os.Getenv("S3_ENDPOINT"), region, os.Getenv("S3_BUCKET"),
+			os.Getenv("S3_ACCESS_KEY_ID"), os.Getenv("S3_SECRET_ACCESS_KEY"))
+		if err != nil {
+			return err
+		}
+		blobs = s3
+	default:
+		return fmt.Errorf("unknown UPLOAD_STORE %q", store)
+	}
+	return nil
+}
+
+// blobURL links to a stored file: through the uploads handler, or with a
+// signed link when links expire
+func blobURL(key string) string {
+	if blobURLExpiry == 0 {
+		return (&url.URL{Path: "/uploads/" + key}).EscapedPath()
+	}
+	link, err := blobs.SignedURL(key, blobURLExpiry)
+	if err != nil {
+		log.Printf("Failed to sign link to %s: %v", key, err)
+		return ""
+	}
+	return link
+}
+
+// signingTime rounds the time links are signed at down to half their
+// lifetime. Pages rendered in the meantime then link to the same URLs,
+// which browsers can cache, and every link stays valid for at least half
+// of expires.
+func signingTime(expires time.Duration) time.Time {
+	return time.Now().UTC().Truncate(expires / 2)
+}
+
+// validBlobKey rejects keys that would escape the store, such as "../x"
+func validBlobKey(key string) bool {
+	return fs.ValidPath(key) && key != "."
+}
+
+// removeBlobs deletes stored files, logging the ones that could not be
+func removeBlobs(keys []string) {
+	for _, key := range keys {
+		if err := blobs.Delete(key); err != nil {
+			log.Printf("Failed to remove upload %s: %v", key, err)
+		}
+	}
+}
+
+// stagingDir prefixes uploads that are stored but not yet referenced by
+// the database. Handlers stage files before their transaction and promote
+// them once it has committed, or discard them if it fails, so a rollback
+// never leaves a file behind under its real key. Every upload is staged in
+// an area of its own, since two requests may store the same file under the
+// same key at once.
+const stagingDir = "staging"
+
+// newStage returns a fresh staging area, "staging/<uuid>"
+func newStage() (string, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	return stagingDir + "/" + id.String(), nil
+}
+
+// stageBlob stores a new upload in a staging area under its final key
+func stageBlob(stage, key string, data []byte) error {
+	return blobs.Put(stage+"/"+key, data)
+}
+
+// promoteBlobs moves staged uploads to their keys after the database
+// committed to them. Failures are only logged: the upload collector finds
+// staged files that are referenced and promotes them later.
+func promoteBlobs(stage string, keys []string) {
+	for _, key := range keys {
+		if err := blobs.Move(stage+"/"+key, key); err != nil {
+			log.Printf("Failed to promote upload %s: %v", key, err)
+		}
+	}
+}
+
+// discardBlobs deletes staged uploads whose transaction did not commit
+func discardBlobs(stage string, keys []string) {
+	staged := make([]string, len(keys))
+	for i, key := range keys {
+		staged[i] = stage + "/" + key
+	}
+	removeBlobs(staged)
+}
+
+// LocalStore keeps blobs as files below a directory
+type LocalStore struct {
+	dir    string
+	secret []byte
+}
+
+// NewLocalStore stores blobs in dir. Signed links are signed with secret,
+// or with a random key when it is empty.
+func NewLocalStore(dir string, secret []byte) *LocalStore {
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+	return &LocalStore{dir: dir, secret: secret}
+}
+
+func (s *LocalStore) file(key string) (string, error) {
+	if !validBlobKey(key) {
+		return "", errBlobNotFound
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// Put creates the file with O_EXCL, so a name clash can never overwrite
+// another upload
+func (s *LocalStore) Put(key string, data []byte) error {
+	name, err := s.file(key)
+	if err != nil {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if os.IsExist(err) {
+		return errBlobExists
+	} else if err != nil {
+		return err
+	}
+	if _, err := dst.Write(data); err != nil {
+		dst.Close()
+		os.Remove(name)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(name)
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStore) Open(key string) (*Blob, error) {
+	name, err := s.file(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, errBlobNotFound
+	}
+	return &Blob{ReadSeekCloser: file, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *LocalStore) Delete(key string) error {
+	name, err := s.file(key)
+	if err != nil {
+		return nil
+	}
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.pruneStage(name)
+	return nil
+}
+
+func (s *LocalStore) Move(from, to string) error {
+	source, err := s.file(from)
+	if err != nil {
+		return err
+	}
+	target, err := s.file(to)
+	if err != nil {
+		return fmt.Errorf("invalid key %q", to)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(source, target); os.IsNotExist(err) {
+		return errBlobNotFound
+	} else if err != nil {
+		return err
+	}
+	s.pruneStage(source)
+	return nil
+}
+
+// pruneStage removes the directories of a staging area once the last file
+// in it was moved or deleted. Directories outside the staging area stay,
+// since another upload may be about to be written into them.
+func (s *LocalStore) pruneStage(name string) {
+	root := filepath.Join(s.dir, stagingDir)
+	for dir := filepath.Dir(name); strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+func (s *LocalStore) List(prefix string) ([]BlobInfo, error) {
+	var list []BlobInfo
+	err := filepath.WalkDir(s.dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && name == s.dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, name)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		list = append(list, BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return list, err
+}
+
+// SignedURL links to the uploads handler with an expiry time and an HMAC
+// of the key and that time, which the handler checks
+func (s *LocalStore) SignedURL(key string, expires time.Duration) (string, error) {
+	expiresAt := strconv.FormatInt(signingTime(expires).Add(expires).Unix(), 10)
+	query := url.Values{"expires": {expiresAt}, "signature": {s.signature(key, expiresAt)}}
+	link := url.URL{Path: "/uploads/" + key, RawQuery: query.Encode()}
+	return link.String(), nil
+}
+
+// validSignature checks the query of a link made by SignedURL
+func (s *LocalStore) validSignature(key string, query url.Values) bool {
+	expiresAt, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return false
+	}
+	signature, err := hex.DecodeString(query.Get("signature"))
+	if err != nil {
+		return false
+	}
+	expected, _ := hex.DecodeString(s.signature(key, query.Get("expires")))
+	return hmac.Equal(signature, expected)
+}
+
+func (s *LocalStore) signature(key, expiresAt string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(key + "\n" + expiresAt))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,393 @@
+package myserver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const maxCollectionNameLength = 50
+
+var (
+	errCollectionNotFound = errors.New("collection not found")
+	errCollectionTaken    = errors.New("collection name taken")
+)
+
+// loadBookmarks marks the posts the viewing user has saved
+func loadBookmarks(posts []Post, userID int) error {
+	if len(posts) == 0 {
+		return nil
+	}
+	byID := make(map[int]*Post, len(posts))
+	ids := make([]any, len(posts))
+	for i := range posts {
+		byID[posts[i].ID] = &posts[i]
+		ids[i] = posts[i].ID
+	}
+
+	rows, err := db.Query("SELECT post_id, collection_id FROM bookmarks WHERE user_id = ? AND post_id IN ("+
+		placeholders(len(ids))+")", append([]any{userID}, ids...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID int
+		var collectionID sql.NullInt64
+		if err := rows.Scan(&postID, &collectionID); err != nil {
+			return err
+		}
+		byID[postID].Bookmarked = true
+		byID[postID].CollectionID = int(collectionID.Int64)
+	}
+	return rows.Err()
+}
+
+// getCollections lists a user's collections by name, with how many posts
+// each holds
+func getCollections(userID int) ([]Collection, error) {
+	rows, err := db.Query(`
+		SELECT collections.id, collections.name, COUNT(bookmarks.post_id)
+		FROM collections
+		LEFT JOIN bookmarks ON bookmarks.collection_id = collections.id
+		WHERE collections.user_id = ?
+		GROUP BY collections.id
+		ORDER BY collections.name COLLATE NOCASE`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collections := []Collection{}
+	for rows.Next() {
+		var collection Collection
+		if err := rows.Scan(&collection.ID, &collection.Name, &collection.Posts); err != nil {
+			return nil, err
+		}
+		collections = append(collections, collection)
+	}
+	return collections, rows.Err()
+}
+
+// ownsCollection reports whether the collection id, as sent by a client,
+// names one of the user's collections
+func ownsCollection(userID int, collectionID string) (bool, error) {
+	var owned bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM collections WHERE id = ? AND user_id = ?)",
+		collectionID, userID).Scan(&owned)
+	return owned, err
+}
+
+// saveCollection creates a collection when it has no ID, or renames it
+func saveCollection(userID int, collection *Collection) error {
+	var taken bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM collections WHERE user_id = ? AND name = ? AND id != ?)",
+		userID, collection.Name, collection.ID).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return errCollectionTaken
+	}
+
+	if collection.ID == 0 {
+		result, err := db.Exec("INSERT INTO collections (user_id, name) VALUES (?, ?)", userID, collection.Name)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		collection.ID = int(id)
+		return err
+	}
+
+	result, err := db.Exec("UPDATE collections SET name = ? WHERE id = ? AND user_id = ?",
+		collection.Name, collection.ID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errCollectionNotFound
+	}
+	return db.QueryRow("SELECT COUNT(*) FROM bookmarks WHERE collection_id = ?", collection.ID).Scan(&collection.Posts)
+}
+
+// BookmarksAPI saves and unsaves posts for the current user. Both methods
+// are idempotent and answer with the bookmark's resulting state:
+//
+//	PUT    /api/bookmarks?post_id=1&collection_id=2  save, or move to a collection
+//	PUT    /api/bookmarks?post_id=1                  save outside any collection
+//	DELETE /api/bookmarks?post_id=1                  unsave
+//
+// GET lists every bookmark. Unlike /like, repeating a request never flips the
+// state back.
+func BookmarksAPI(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := db.Query(`SELECT post_id, collection_id FROM bookmarks WHERE user_id = ?
+			ORDER BY created_at DESC, post_id DESC`, userID)
+		if err != nil {
+			log.Println("Failed to fetch bookmarks:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		bookmarks := []Bookmark{}
+		for rows.Next() {
+			bookmark := Bookmark{Saved: true}
+			var collectionID sql.NullInt64
+			if err := rows.Scan(&bookmark.PostID, &collectionID); err != nil {
+				log.Println("Error scanning bookmark:", err)
+				continue
+			}
+			bookmark.CollectionID = int(collectionID.Int64)
+			bookmarks = append(bookmarks, bookmark)
+		}
+		writeJSON(w, http.StatusOK, bookmarks)
+
+	case http.MethodPut:
+		postID, err := strconv.Atoi(r.FormValue("post_id"))
+		if err != nil {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		bookmark := Bookmark{PostID: postID, Saved: true}
+
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM posts WHERE id = ?)", postID).Scan(&exists); err != nil {
+			log.Println("Failed to check post:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+
+		var collectionID any
+		if value := r.FormValue("collection_id"); value != "" {
+			owned, err := ownsCollection(userID, value)
+			if err != nil {
+				log.Println("Failed to check collection:", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if !owned {
+				http.Error(w, "Collection not found", http.StatusNotFound)
+				return
+			}
+			bookmark.CollectionID, _ = strconv.Atoi(value)
+			collectionID = bookmark.CollectionID
+		}
+
+		err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM bookmarks WHERE user_id = ? AND post_id = ?)",
+			userID, postID).Scan(&exists)
+		if err == nil {
+			_, err = db.Exec(`INSERT INTO bookmarks (user_id, post_id, collection_id) VALUES (?, ?, ?)
+				ON CONFLICT (user_id, post_id) DO UPDATE SET collection_id = excluded.collection_id`,
+				userID, postID, collectionID)
+		}
+		if err != nil {
+			log.Println("Failed to save bookmark:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		status := http.StatusOK
+		if !exists {
+			status = http.StatusCreated
+		}
+		writeJSON(w, status, bookmark)
+
+	case http.MethodDelete:
+		postID, err := strconv.Atoi(r.FormValue("post_id"))
+		if err != nil {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		if _, err := db.Exec("DELETE FROM bookmarks WHERE user_id = ? AND post_id = ?", userID, postID); err != nil {
+			log.Println("Failed to remove bookmark:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, Bookmark{PostID: postID})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// CollectionsAPI lists (GET), creates (POST name=), renames (PUT id=&name=)
+// and deletes (DELETE id=) the current user's collections. Deleting a
+// collection keeps its posts saved, outside any collection.
+func CollectionsAPI(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		collections, err := getCollections(userID)
+		if err != nil {
+			log.Println("Failed to fetch collections:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, collections)
+
+	case http.MethodPost, http.MethodPut:
+		collection := Collection{Name: strings.TrimSpace(r.FormValue("name"))}
+		if r.Method == http.MethodPut {
+			if collection.ID, err = strconv.Atoi(r.FormValue("id")); err != nil {
+				http.Error(w, "Collection not found", http.StatusNotFound)
+				return
+			}
+		}
+		if collection.Name == "" || len(collection.Name) > maxCollectionNameLength {
+			http.Error(w, "A collection name needs 1 to 50 characters", http.StatusBadRequest)
+			return
+		}
+
+		err := saveCollection(userID, &collection)
+		if err == errCollectionTaken {
+			http.Error(w, "You already have a collection with that name", http.StatusConflict)
+			return
+		} else if err == errCollectionNotFound {
+			http.Error(w, "Collection not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println("Failed to save collection:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		status := http.StatusOK
+		if r.Method == http.MethodPost {
+			status = http.StatusCreated
+		}
+		writeJSON(w, status, collection)
+
+	case http.MethodDelete:
+		collectionID := r.FormValue("id")
+		owned, err := ownsCollection(userID, collectionID)
+		if err != nil {
+			log.Println("Failed to check collection:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !owned {
+			http.Error(w, "Collection not found", http.StatusNotFound)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Println("Failed to begin transaction:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		_, err = tx.Exec("UPDATE bookmarks SET collection_id = NULL WHERE collection_id = ?", collectionID)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM collections WHERE id = ?", collectionID)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Println("Failed to delete collection:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SavedPage shows the current user's bookmarks, all of them or one
+// collection's
+func SavedPage(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+
+	collections, err := getCollections(userID)
+	if err != nil {
+		log.Println("Failed to fetch collections:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	query := feedQueryFromRequest(r)
+	query.Saved, query.Viewer = true, userID
+	query.Sort, query.Window = "new", ""
+
+	var active *Collection
+	for i := range collections {
+		if strconv.Itoa(collections[i].ID) == query.Collection {
+			active = &collections[i]
+		}
+	}
+	if query.Collection != "" && active == nil {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+
+	page, err := getFeed(query)
+	if err == errBadCursor {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Println("Failed to fetch saved posts:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := setViewer(page.Posts, userID); err != nil {
+		log.Println("Failed to load posts for viewer:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	nextPage := query.Params()
+	nextPage.Del("saved")
+	nextPage.Set("cursor", page.NextCursor)
+
+	data := struct {
+		Collections []Collection
+		Collection  *Collection
+		Posts       []Post
+		NextCursor  string
+		NextPage    string
+	}{
+		Collections: collections,
+		Collection:  active,
+		Posts:       page.Posts,
+		NextCursor:  page.NextCursor,
+		NextPage:    "/saved?" + nextPage.Encode(),
+	}
+
+	templates.ExecuteTemplate(w, "saved.html", data)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
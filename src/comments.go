@@ -0,0 +1,697 @@
+package myserver
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxCommentDepth is how deep replies nest: top level comments are at
+	// depth 0, so a thread holds at most maxCommentDepth levels of replies.
+	// Deeper threads get hard to follow and too narrow to read.
+	maxCommentDepth = 4
+
+	// commentEditWindow is how long after posting authors may still edit a
+	// comment. Later edits could change what the replies answered.
+	commentEditWindow = 15 * time.Minute
+
+	maxRemovalReasonLength = 200
+
+	// commentPreviewSize is how many top level comments a post shows in the
+	// feed before its thread is opened
+	commentPreviewSize     = 3
+	defaultCommentPageSize = 20
+	maxCommentPageSize     = 50
+)
+
+var (
+	errParentNotFound = errors.New("parent comment not found")
+	errThreadTooDeep  = errors.New("thread too deep")
+)
+
+// replyParent looks up the comment being replied to and returns the depth
+// of the reply and the parent's author. The parent has to belong to the same
+// post and must not be deleted.
+func replyParent(postID, parentID string) (depth int, authorID int, err error) {
+	var parentDepth int
+	var deleted bool
+	err = db.QueryRow("SELECT depth, user_id, deleted_at IS NOT NULL FROM comments WHERE id = ? AND post_id = ?",
+		parentID, postID).Scan(&parentDepth, &authorID, &deleted)
+	if errors.Is(err, sql.ErrNoRows) || deleted {
+		return 0, 0, errParentNotFound
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if parentDepth >= maxCommentDepth {
+		return 0, 0, errThreadTooDeep
+	}
+	return parentDepth + 1, authorID, nil
+}
+
+// threadComments nests comments, given in the order they were written,
+// under the comments they reply to. Replies whose parent is missing are
+// dropped along with it.
+func threadComments(comments []Comment) []Comment {
+	children := map[int][]Comment{}
+	for _, comment := range comments {
+		children[comment.ParentID] = append(children[comment.ParentID], comment)
+	}
+
+	var build func(parentID int) []Comment
+	build = func(parentID int) []Comment {
+		replies := children[parentID]
+		for i := range replies {
+			replies[i].CanReply = replies[i].Depth < maxCommentDepth && !replies[i].Deleted
+			replies[i].Replies = build(replies[i].ID)
+		}
+		return replies
+	}
+	return build(0)
+}
+
+// walkComments calls fn for every comment of a thread, replies included
+func walkComments(comments []Comment, fn func(*Comment)) {
+	for i := range comments {
+		fn(&comments[i])
+		walkComments(comments[i].Replies, fn)
+	}
+}
+
+// commentSort describes one order of a post's top level comments. Unlike
+// feed sorts the direction varies, so each sort spells out its order and the
+// condition that selects the comments after a cursor.
+type commentSort struct {
+	label string
+	order string
+	after string // takes the cursor's key twice, then its id
+	key   func(Comment) string
+	parse func(string) (any, error)
+}
+
+var commentSorts = map[string]commentSort{
+	"oldest": {
+		label: "Oldest",
+		order: "comments.created_at ASC, comments.id ASC",
+		after: "(comments.created_at > ? OR (comments.created_at = ? AND comments.id > ?))",
+		key:   commentTimeKey,
+		parse: parseCommentTime,
+	},
+	"newest": {
+		label: "Newest",
+		order: "comments.created_at DESC, comments.id DESC",
+		after: "(comments.created_at < ? OR (comments.created_at = ? AND comments.id < ?))",
+		key:   commentTimeKey,
+		parse: parseCommentTime,
+	},
+	// ties keep the order of the feed preview, oldest first
+	"top": {
+		label: "Most liked",
+		order: "comments.reaction_count DESC, comments.id ASC",
+		after: "(comments.reaction_count < ? OR (comments.reaction_count = ? AND comments.id > ?))",
+		key:   func(c Comment) string { return strconv.Itoa(c.ReactionCount) },
+		parse: func(s string) (any, error) { return strconv.Atoi(s) },
+	},
+}
+
+// commentSortOrder lists the sorts in the order the sort menu shows them
+var commentSortOrder = []string{"oldest", "newest", "top"}
+
+func commentTimeKey(c Comment) string { return c.CreatedAt.UTC().Format(sqliteTimeLayout) }
+
+func parseCommentTime(s string) (any, error) {
+	_, err := time.Parse(sqliteTimeLayout, s)
+	return s, err
+}
+
+// commentSortLinks builds the sort bar above a post's comments. The links
+// open the post's page; on it and in the feed they are followed in place.
+func commentSortLinks(post Post) []SortLink {
+	var links []SortLink
+	for _, name := range commentSortOrder {
+		links = append(links, SortLink{
+			Label:  commentSorts[name].label,
+			URL:    fmt.Sprintf("/post?id=%d&comments=%s#comments-%d", post.ID, name, post.ID),
+			Active: validCommentSort(post.CommentSort) == name,
+		})
+	}
+	return links
+}
+
+// validCommentSort returns sort if it is known, "oldest" otherwise
+func validCommentSort(sort string) string {
+	if _, ok := commentSorts[sort]; ok {
+		return sort
+	}
+	return "oldest"
+}
+
+// CommentQuery selects one page of a post's comments
+type CommentQuery struct {
+	PostID int
+	Sort   string // a key of commentSorts, "oldest" when empty
+	Limit  int
+	Cursor string
+}
+
+// CommentPage is one page of top level comments with their whole threads
+type CommentPage struct {
+	Comments   []Comment `json:"comments"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+	Sort       string    `json:"sort"`
+	Total      int       `json:"total"` // every comment of the post, replies included
+	HTML       string    `json:"html,omitempty"`
+}
+
+// getComments pages through the top level comments of a post and loads the
+// replies under each of them, so a thread is never split across pages.
+func getComments(q CommentQuery) (CommentPage, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultCommentPageSize
+	}
+	q.Limit = min(q.Limit, maxCommentPageSize)
+	q.Sort = validCommentSort(q.Sort)
+	sort := commentSorts[q.Sort]
+
+	page := CommentPage{Sort: q.Sort}
+	err := db.QueryRow("SELECT comment_count FROM posts WHERE id = ?", q.PostID).Scan(&page.Total)
+	if err != nil {
+		return CommentPage{}, err
+	}
+
+	conditions := []string{"comments.post_id = ?", "comments.parent_id IS NULL"}
+	args := []any{q.PostID}
+	if q.Cursor != "" {
+		key, id, err := decodeCursor(q.Cursor, q.Sort, sort.parse)
+		if err != nil {
+			return CommentPage{}, err
+		}
+		conditions = append(conditions, sort.after)
+		args = append(args, key, key, id)
+	}
+
+	// one extra row tells us whether there is a next page
+	rows, err := db.Query(`
+		SELECT `+commentColumns+`
+		FROM comments
+		JOIN users ON comments.user_id = users.id
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY `+sort.order+`
+		LIMIT ?`, append(args, q.Limit+1)...)
+	if err != nil {
+		return CommentPage{}, err
+	}
+	roots, err := scanComments(rows)
+	if err != nil {
+		return CommentPage{}, err
+	}
+	if len(roots) > q.Limit {
+		roots = roots[:q.Limit]
+		last := roots[q.Limit-1]
+		page.NextCursor = encodeCursor(q.Sort, sort.key(last), last.ID)
+	}
+	if len(roots) == 0 {
+		page.Comments = []Comment{}
+		return page, nil
+	}
+
+	rootIDs := make([]any, len(roots))
+	for i, root := range roots {
+		rootIDs[i] = root.ID
+	}
+	rows, err = db.Query(`
+		WITH RECURSIVE thread(id) AS (
+			SELECT id FROM comments WHERE parent_id IN (`+placeholders(len(rootIDs))+`)
+			UNION ALL
+			SELECT comments.id FROM comments JOIN thread ON comments.parent_id = thread.id
+		)
+		SELECT `+commentColumns+`
+		FROM thread
+		JOIN comments ON comments.id = thread.id
+		JOIN users ON comments.user_id = users.id
+		ORDER BY comments.created_at ASC, comments.id ASC`, rootIDs...)
+	if err != nil {
+		return CommentPage{}, err
+	}
+	replies, err := scanComments(rows)
+	if err != nil {
+		return CommentPage{}, err
+	}
+
+	// threadComments keeps the order it is given, so the roots go first
+	page.Comments = threadComments(append(roots, replies...))
+
+	byID := map[int]*Comment{}
+	var ids []any
+	indexComments(page.Comments, byID, &ids)
+	if err := loadCommentReactions(byID, ids); err != nil {
+		return CommentPage{}, err
+	}
+	return page, nil
+}
+
+// loadFirstCommentPage replaces a post's comment preview with the first page
+// of its threads, for the post's own page
+func loadFirstCommentPage(post *Post, sort string) error {
+	page, err := getComments(CommentQuery{PostID: post.ID, Sort: sort})
+	if err != nil {
+		return err
+	}
+	post.Comments = page.Comments
+	post.CommentsPreview = false
+	post.CommentsCursor = page.NextCursor
+	post.CommentSort = page.Sort
+	return nil
+}
+
+// CommentsAPI serves pages of a post's comments as JSON, with their rendered
+// markup, for the post page and for opening threads from the feed.
+func CommentsAPI(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	postID, err := strconv.Atoi(query.Get("post_id"))
+	if err != nil {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	page, err := getComments(CommentQuery{
+		PostID: postID,
+		Sort:   query.Get("sort"),
+		Limit:  limit,
+		Cursor: query.Get("cursor"),
+	})
+	if err == errBadCursor {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	} else if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Failed to fetch comments:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := setCommentViewer(page.Comments, userID); err != nil {
+		log.Println("Failed to load comments for viewer:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	for i := range page.Comments {
+		if err := templates.ExecuteTemplate(&buf, "comment", page.Comments[i]); err != nil {
+			log.Println("Failed to render comment:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	page.HTML = buf.String()
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// setCommentViewer fills in the viewing user's reactions and permissions on
+// a page of comments
+func setCommentViewer(comments []Comment, userID int) error {
+	byID := map[int]*Comment{}
+	var ids []any
+	indexComments(comments, byID, &ids)
+	if err := loadViewerCommentReactions(byID, ids, userID); err != nil {
+		return err
+	}
+	setCommentPermissions(comments, userID, isModerator(userID))
+	return nil
+}
+
+// notifyReply tells the author of a comment that someone replied to it,
+// unless they replied to themselves
+func notifyReply(parentAuthorID, actorID int, postID string, commentID int64, content string) {
+	if parentAuthorID == actorID {
+		return
+	}
+	notify([]int{parentAuthorID}, Notification{
+		Kind:    "reply",
+		ActorID: actorID,
+		Link:    fmt.Sprintf("/post?id=%s#comment-%d", postID, commentID),
+		Excerpt: excerpt(content),
+	})
+}
+
+// setCommentPermissions fills in what the viewing user may do with each
+// comment of a thread
+func setCommentPermissions(comments []Comment, userID int, moderator bool) {
+	walkComments(comments, func(comment *Comment) {
+		if comment.Deleted {
+			comment.CanViewHistory = moderator
+			return
+		}
+		comment.Own = comment.UserID == userID
+		comment.CanEdit = comment.Own && time.Since(comment.CreatedAt) < commentEditWindow
+		comment.CanDelete = comment.Own || moderator
+		comment.CanViewHistory = moderator && !comment.EditedAt.IsZero()
+	})
+}
+
+// commentLink points at a comment on its post's page
+func commentLink(postID, commentID int) string {
+	return fmt.Sprintf("/post?id=%d#comment-%d", postID, commentID)
+}
+
+// EditComment saves an author's change to their comment while the edit
+// window is open, keeping the previous version as a revision.
+func EditComment(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	commentID, err := strconv.Atoi(r.FormValue("comment_id"))
+	if err != nil {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	content := r.FormValue("content")
+	if strings.TrimSpace(content) == "" {
+		http.Error(w, "Content is required", http.StatusBadRequest)
+		return
+	}
+
+	var postID, authorID int
+	var oldContent string
+	var createdAt time.Time
+	var deleted bool
+	err = db.QueryRow("SELECT post_id, user_id, content, created_at, deleted_at IS NOT NULL FROM comments WHERE id = ?",
+		commentID).Scan(&postID, &authorID, &oldContent, &createdAt, &deleted)
+	if errors.Is(err, sql.ErrNoRows) || deleted {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to load comment: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if authorID != userID {
+		http.Error(w, "You can only edit your own comments", http.StatusForbidden)
+		return
+	}
+	if time.Since(createdAt) >= commentEditWindow {
+		http.Error(w, "Comments can only be edited for "+commentEditWindow.String()+" after posting", http.StatusForbidden)
+		return
+	}
+	if content == oldContent {
+		http.Redirect(w, r, commentLink(postID, commentID), http.StatusSeeOther)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("Failed to begin transaction:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// like post revisions, the revision keeps the version being replaced
+	_, err = tx.Exec("INSERT INTO comment_revisions (comment_id, editor_id, content) VALUES (?, ?, ?)",
+		commentID, userID, oldContent)
+	if err == nil {
+		_, err = tx.Exec("UPDATE comments SET content = ?, edited_at = CURRENT_TIMESTAMP WHERE id = ?", content, commentID)
+	}
+	if err != nil {
+		log.Println("Failed to update comment:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	mentioned, err := saveMentions(tx, "comment", int64(commentID), userID, content)
+	if err != nil {
+		log.Println("Failed to save mentions:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Failed to commit transaction:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	notifyMentions(mentioned, userID, commentLink(postID, commentID), content)
+
+	http.Redirect(w, r, commentLink(postID, commentID), http.StatusSeeOther)
+}
+
+// DeleteComment lets authors delete their comments and moderators remove
+// anyone's, giving a reason.
+func DeleteComment(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	commentID, err := strconv.Atoi(r.FormValue("comment_id"))
+	if err != nil {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+
+	var postID, authorID int
+	var deleted bool
+	err = db.QueryRow("SELECT post_id, user_id, deleted_at IS NOT NULL FROM comments WHERE id = ?", commentID).
+		Scan(&postID, &authorID, &deleted)
+	if errors.Is(err, sql.ErrNoRows) || deleted {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to load comment: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	reason := ""
+	if authorID != userID {
+		if !isModerator(userID) {
+			http.Error(w, "You can only delete your own comments", http.StatusForbidden)
+			return
+		}
+		reason = strings.TrimSpace(r.FormValue("reason"))
+		if reason == "" {
+			http.Error(w, "A reason is required to remove someone else's comment", http.StatusBadRequest)
+			return
+		}
+		if len(reason) > maxRemovalReasonLength {
+			http.Error(w, "Reason is too long", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("Failed to begin transaction:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := deleteComment(tx, commentID, userID, reason); err != nil {
+		log.Printf("Failed to delete comment %d: %v", commentID, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Failed to commit transaction:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := refreshHotScore(postID); err != nil {
+		log.Printf("Failed to score post %d: %v", postID, err)
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/post?id=%d", postID), http.StatusSeeOther)
+}
+
+// deleteComment removes a comment. One that has replies becomes a
+// tombstone so the thread below it stays intact, and so does one a
+// moderator removed, keeping the reason and who removed it. The text of a
+// tombstone is kept as a revision for moderators. A comment its author
+// deleted without replies goes away completely.
+func deleteComment(tx *sql.Tx, commentID, deleterID int, reason string) error {
+	var replies, authorID int
+	var parentID sql.NullInt64
+	var content string
+	err := tx.QueryRow("SELECT reply_count, parent_id, content, user_id FROM comments WHERE id = ?", commentID).
+		Scan(&replies, &parentID, &content, &authorID)
+	if err != nil {
+		return err
+	}
+
+	if replies > 0 || authorID != deleterID {
+		queries := []struct {
+			query string
+			args  []any
+		}{
+			{"INSERT INTO comment_revisions (comment_id, editor_id, content) VALUES (?, ?, ?)",
+				[]any{commentID, deleterID, content}},
+			{`UPDATE comments SET content = '', deleted_at = CURRENT_TIMESTAMP, deleted_by = ?,
+				delete_reason = NULLIF(?, '') WHERE id = ?`, []any{deleterID, reason, commentID}},
+			{"DELETE FROM comment_reactions WHERE comment_id = ?", []any{commentID}},
+			{"DELETE FROM mentions WHERE kind = 'comment' AND source_id = ?", []any{commentID}},
+		}
+		for _, q := range queries {
+			if _, err := tx.Exec(q.query, q.args...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return purgeComment(tx, commentID, parentID)
+}
+
+// purgeComment deletes a comment and its history for good, and then its
+// parent if that is a tombstone its own author left and this comment was
+// its last reply. Tombstones of moderator removals stay.
+func purgeComment(tx *sql.Tx, commentID int, parentID sql.NullInt64) error {
+	cleanup := []string{
+		"DELETE FROM comment_reactions WHERE comment_id = ?",
+		"DELETE FROM mentions WHERE kind = 'comment' AND source_id = ?",
+		"DELETE FROM comment_revisions WHERE comment_id = ?",
+		"DELETE FROM comments WHERE id = ?",
+	}
+	for _, query := range cleanup {
+		if _, err := tx.Exec(query, commentID); err != nil {
+			return err
+		}
+	}
+	if !parentID.Valid {
+		return nil
+	}
+
+	var abandoned bool
+	var grandparentID sql.NullInt64
+	err := tx.QueryRow(`SELECT deleted_at IS NOT NULL AND reply_count = 0 AND deleted_by IS user_id, parent_id
+		FROM comments WHERE id = ?`, parentID.Int64).Scan(&abandoned, &grandparentID)
+	if err != nil || !abandoned {
+		return err
+	}
+	return purgeComment(tx, int(parentID.Int64), grandparentID)
+}
+
+// CommentRevisions lets moderators browse every version of a comment,
+// including the text of a deleted one
+func CommentRevisions(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+	if !isModerator(userID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	commentID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+
+	var postID int
+	var current Revision
+	var editedAt, deletedAt sql.NullTime
+	var deletedBy, reason sql.NullString
+	err = db.QueryRow(`
+		SELECT comments.post_id, users.username, comments.content, comments.edited_at, comments.deleted_at,
+		       deleter.username, comments.delete_reason
+		FROM comments
+		JOIN users ON comments.user_id = users.id
+		LEFT JOIN users deleter ON comments.deleted_by = deleter.id
+		WHERE comments.id = ?`, commentID).
+		Scan(&postID, &current.Editor, &current.Content, &editedAt, &deletedAt, &deletedBy, &reason)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to load comment: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	current.CreatedAt = editedAt.Time
+	if deletedAt.Valid {
+		current.CreatedAt = deletedAt.Time
+	}
+
+	rows, err := db.Query(`
+		SELECT comment_revisions.id, users.username, comment_revisions.content, comment_revisions.created_at
+		FROM comment_revisions JOIN users ON comment_revisions.editor_id = users.id
+		WHERE comment_revisions.comment_id = ?
+		ORDER BY comment_revisions.id ASC`, commentID)
+	if err != nil {
+		log.Printf("Failed to load revisions: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var revisions []Revision
+	for rows.Next() {
+		var rev Revision
+		if err := rows.Scan(&rev.ID, &rev.Editor, &rev.Content, &rev.CreatedAt); err != nil {
+			log.Printf("Error scanning revision: %v", err)
+			continue
+		}
+		revisions = append(revisions, rev)
+	}
+
+	for i := range revisions {
+		next := current
+		if i+1 < len(revisions) {
+			next = revisions[i+1]
+		}
+		revisions[i].Diff = diffLines(revisions[i].Content, next.Content)
+	}
+
+	data := struct {
+		CommentID int
+		Link      string
+		Current   Revision
+		Deleted   bool
+		DeletedBy string
+		Reason    string
+		Revisions []Revision
+	}{
+		CommentID: commentID,
+		Link:      commentLink(postID, commentID),
+		Current:   current,
+		Deleted:   deletedAt.Valid,
+		DeletedBy: deletedBy.String,
+		Reason:    reason.String,
+		Revisions: revisions,
+	}
+	templates.ExecuteTemplate(w, "comment_revisions.html", data)
+}
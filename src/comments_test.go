@@ -0,0 +1,91 @@
+package myserver
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestDeleteComment(t *testing.T) {
+	database := openTestDB(t)
+	setup := []string{
+		"INSERT INTO users (id, username, email, password) VALUES (1, 'alice', 'alice@example.com', 'x')",
+		"INSERT INTO users (id, username, email, password, role) VALUES (2, 'mod', 'mod@example.com', 'x', 'moderator')",
+		"INSERT INTO posts (id, user_id, title, content) VALUES (1, 1, 'post', 'content')",
+	}
+	for _, statement := range setup {
+		if _, err := database.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	comment := func(parentID any) int {
+		t.Helper()
+		result, err := database.Exec("INSERT INTO comments (post_id, user_id, content, parent_id) VALUES (1, 1, 'text', ?)", parentID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := result.LastInsertId()
+		return int(id)
+	}
+	remove := func(commentID, deleterID int, reason string) {
+		t.Helper()
+		tx, err := database.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		if err := deleteComment(tx, commentID, deleterID, reason); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// state describes what is left of a comment: "gone", "live" or the
+	// tombstone's reason, with how many revisions it kept
+	state := func(commentID int) (string, int) {
+		t.Helper()
+		var deleted bool
+		var reason sql.NullString
+		err := database.QueryRow("SELECT deleted_at IS NOT NULL, delete_reason FROM comments WHERE id = ?", commentID).
+			Scan(&deleted, &reason)
+		if err == sql.ErrNoRows {
+			return "gone", 0
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		var revisions int
+		database.QueryRow("SELECT COUNT(*) FROM comment_revisions WHERE comment_id = ?", commentID).Scan(&revisions)
+		if !deleted {
+			return "live", revisions
+		}
+		return "removed: " + reason.String, revisions
+	}
+	check := func(what string, commentID int, want string, wantRevisions int) {
+		t.Helper()
+		if got, revisions := state(commentID); got != want || revisions != wantRevisions {
+			t.Errorf("%s: comment is %q with %d revisions, want %q with %d", what, got, revisions, want, wantRevisions)
+		}
+	}
+
+	own := comment(nil)
+	remove(own, 1, "")
+	check("deleted by its author", own, "gone", 0)
+
+	moderated := comment(nil)
+	remove(moderated, 2, "spam")
+	check("removed by a moderator", moderated, "removed: spam", 1)
+
+	parent := comment(nil)
+	reply := comment(parent)
+	remove(parent, 1, "")
+	check("deleted by its author with a reply", parent, "removed: ", 1)
+	remove(reply, 1, "")
+	check("last reply deleted", reply, "gone", 0)
+	check("author's tombstone after its last reply went", parent, "gone", 0)
+
+	parent = comment(nil)
+	reply = comment(parent)
+	remove(parent, 2, "off topic")
+	remove(reply, 1, "")
+	check("moderator's tombstone after its last reply went", parent, "removed: off topic", 1)
+}
@@ -2,13 +2,13 @@ package myserver
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
-	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofrs/uuid"
@@ -36,6 +36,10 @@ func SignUp(w http.ResponseWriter, r *http.Request) {
 		errorPage(w, "Username, Email and Password are required", "signup.html")
 		return
 	}
+	if !validUsername(username) {
+		errorPage(w, "Usernames are up to 30 letters, digits, _ . and -, and cannot end in . or -", "signup.html")
+		return
+	}
 
 	// Parse age if provided
 	var age int
@@ -61,9 +65,9 @@ func SignUp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//check username
+	//check username, in any case since mentions ignore it
 	var existingUserName string
-	err = db.QueryRow("SELECT username FROM users WHERE username = ?", username).Scan(&existingUserName)
+	err = db.QueryRow("SELECT username FROM users WHERE username = ? COLLATE NOCASE", username).Scan(&existingUserName)
 	if err == nil {
 		errorPage(w, "UserName already in use", "signup.html")
 		return
@@ -213,104 +217,120 @@ func HomePage(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/signin", http.StatusSeeOther)
 		return
 	}
-	db.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username)
+	var avatar sql.NullString
+	db.QueryRow("SELECT username, avatar FROM users WHERE id = ?", userID).Scan(&username, &avatar)
 
 	// if user post
 	if r.Method == http.MethodPost {
 		//10 * 1024 * 1024
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadRequest)
 		if err := r.ParseMultipartForm(10 << 20); err != nil {
 			http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
 			return
 		}
 
+		title := strings.TrimSpace(r.FormValue("title"))
 		content := r.FormValue("content")
-		if content == "" {
+		if title == "" || content == "" {
 			http.Redirect(w, r, "/homepage", http.StatusSeeOther)
 			return
 		}
+		if len(title) > maxTitleLength {
+			http.Error(w, "Title is too long", http.StatusBadRequest)
+			return
+		}
 
-		//start a transaction
-		tx, err := db.Begin()
+		attachments, err := attachmentsFromRequest(r)
 		if err != nil {
-			log.Println("Failed to begin transaction:", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			uploadFailed(w, err)
 			return
 		}
-		defer tx.Rollback()
 
-		var imagePath string
-		file, handler, err := r.FormFile("image")
-		// fmt.Println("Filename:", handler.Filename)
-		// fmt.Println("Size:", handler.Size)
-		// fmt.Println("Header:", handler.Header)
-
-		if err == nil {
-			defer file.Close()
-			//.jpg
-			ext := filepath.Ext(handler.Filename)
-			//1_1743462605.jpeg
-			fileName := fmt.Sprintf("%d_%d%s", userID, time.Now().Unix(), ext)
-			//uploads/1_1743462749.jpg
-			imagePath = filepath.Join("uploads", fileName)
-			//../uploads/1_1743462749.jpg
-			// destPath := filepath.Join("..", imagePath)
-
-			//create dest
-			dst, err := os.Create(imagePath)
+		draft, err := draftFromRequest(r, userID)
+		if err != nil {
+			discardAttachments(attachments)
+			http.Error(w, "Invalid draft, publish or poll close time", http.StatusBadRequest)
+			return
+		}
+		if draft.ID != 0 {
+			existing, err := draftAttachmentCount(draft.ID, userID)
 			if err != nil {
-				log.Println("Failed to create file:", err)
-				http.Error(w, "Failed to upload image", http.StatusInternalServerError)
+				discardAttachments(attachments)
+				log.Println("Failed to count draft attachments:", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 				return
 			}
-			defer dst.Close()
-
-			//copy data from file to dst
-			if _, err = io.Copy(dst, file); err != nil {
-				log.Println("Failed to save file:", err)
-				http.Error(w, "Failed to upload image", http.StatusInternalServerError)
+			if existing+len(attachments) > maxAttachments {
+				discardAttachments(attachments)
+				http.Error(w, fmt.Sprintf("A post can have at most %d attachments", maxAttachments), http.StatusBadRequest)
+				return
+			}
+		}
+		if draft.Poll != nil {
+			opensAt := draft.PublishAt
+			if opensAt.IsZero() {
+				opensAt = time.Now()
+			}
+			if problem := draft.Poll.problem(opensAt); problem != "" {
+				discardAttachments(attachments)
+				http.Error(w, problem, http.StatusBadRequest)
 				return
 			}
 		}
 
-		var result sql.Result
-		if imagePath != "" {
-			result, err = tx.Exec("INSERT INTO posts (user_id, content, image_path) VALUES (?, ?, ?)",
-				userID, content, imagePath)
-		} else {
-			result, err = tx.Exec("INSERT INTO posts (user_id, content) VALUES (?, ?)",
-				userID, content)
+		// with a publish time the post is kept as a draft for the scheduler
+		if !draft.PublishAt.IsZero() {
+			if err := scheduleDraft(&draft, attachments); err != nil {
+				discardAttachments(attachments)
+				log.Println("Failed to schedule post:", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			promoteAttachments(attachments)
+			http.Redirect(w, r, "/homepage?scheduled=1", http.StatusSeeOther)
+			return
 		}
 
+		//start a transaction
+		tx, err := db.Begin()
 		if err != nil {
-			log.Println("Failed to create post:", err)
+			discardAttachments(attachments)
+			log.Println("Failed to begin transaction:", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
+		defer tx.Rollback()
 
-		postID, err := result.LastInsertId()
+		// attachments already scheduled with the draft come first
+		var first int
+		postID, err := createPost(tx, userID, title, content, r.Form["tags"])
+		if err == nil && draft.ID != 0 {
+			first, err = moveDraftAttachments(tx, draft.ID, userID, postID)
+		}
+		if err == nil {
+			err = insertAttachments(tx, "post_id", postID, attachments, first)
+		}
+		if err == nil && draft.Poll != nil {
+			err = createPoll(tx, postID, *draft.Poll)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
 		if err != nil {
-			log.Println("Failed to get last insert ID:", err)
+			discardAttachments(attachments)
+			log.Println("Failed to create post:", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
+		promoteAttachments(attachments)
 
-		tags := r.Form["tags"]
-		if len(tags) > 0 {
-			for _, tagID := range tags {
-				_, err = tx.Exec("INSERT INTO post_tags (post_id, tag_id) VALUES (?, ?)", postID, tagID)
-				if err != nil {
-					log.Printf("Failed to insert tag %s for post %d: %v", tagID, postID, err)
-					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-					return
-				}
+		// publishing a draft by hand replaces it
+		if draft.ID != 0 {
+			if err := deleteDraft(draft.ID, userID); err != nil && err != errDraftNotFound {
+				log.Printf("Failed to delete published draft %d: %v", draft.ID, err)
 			}
 		}
-
-		if err = tx.Commit(); err != nil {
-			log.Println("Failed to commit transaction:", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
+		publishedPost(postID)
 
 		http.Redirect(w, r, "/homepage", http.StatusSeeOther)
 		return
@@ -324,28 +344,103 @@ func HomePage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tagFilter := r.URL.Query().Get("tag")
+	feedQuery := feedQueryFromRequest(r)
+	feedQuery.Viewer = userID
 
-	posts, err := getPosts(tagFilter)
-	if err != nil {
+	// a bad filter is reported next to the filter box instead of an error page
+	var filterError string
+	page, err := getFeed(feedQuery)
+	if err == errBadCursor {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	} else if errors.Is(err, errBadFilter) {
+		filterError = err.Error()
+	} else if err != nil {
 		log.Println("Failed to fetch posts:", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	posts := page.Posts
+	if err := setViewer(posts, userID); err != nil {
+		log.Println("Failed to load posts for viewer:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 	contact := GetAllConn(w, userID)
 
+	drafts, err := getDrafts("user_id = ?", userID)
+	if err != nil {
+		log.Println("Failed to fetch drafts:", err)
+	}
+	// ?draft=ID loads a draft back into the post form
+	var draft *Draft
+	draftTags := map[string]bool{}
+	for i := range drafts {
+		if strconv.Itoa(drafts[i].ID) == r.URL.Query().Get("draft") {
+			draft = &drafts[i]
+			for _, tagID := range draft.Tags {
+				draftTags[tagID] = true
+			}
+		}
+	}
+
+	// the poll builder shows at least two option inputs
+	var pollOptions []string
+	if draft != nil && draft.Poll != nil {
+		pollOptions = append(pollOptions, draft.Poll.Options...)
+	}
+	for len(pollOptions) < 2 {
+		pollOptions = append(pollOptions, "")
+	}
+
+	nextPage := feedQuery.Params()
+	nextPage.Set("cursor", page.NextCursor)
+	sorts, windows := sortLinks(feedQuery)
+
 	data := struct {
-		Username  string
-		Posts     []Post
-		Tags      []Tag
-		ActiveTag string
-		Contacts  []Contact
+		Username       string
+		Avatar         string
+		Initials       string
+		Posts          []Post
+		Tags           []Tag
+		ActiveTag      string
+		Filter         string
+		FilterError    string
+		FeedParams     string
+		NextCursor     string
+		NextPage       string
+		Sorts          []SortLink
+		Windows        []SortLink
+		Contacts       []Contact
+		Drafts         []Draft
+		Draft          *Draft
+		DraftTags      map[string]bool
+		PollOptions    []string
+		Scheduled      bool
+		Unread         int
+		MaxAttachments int
 	}{
-		Username:  username,
-		Posts:     posts,
-		Tags:      tags,
-		ActiveTag: tagFilter,
-		Contacts:  contact,
+		Username:       username,
+		Avatar:         avatarURL(avatar.String, 128),
+		Initials:       initials(username),
+		Posts:          posts,
+		Tags:           tags,
+		ActiveTag:      feedQuery.Tag,
+		Filter:         feedQuery.Filter,
+		FilterError:    filterError,
+		FeedParams:     feedQuery.Params().Encode(),
+		NextCursor:     page.NextCursor,
+		NextPage:       "/homepage?" + nextPage.Encode(),
+		Sorts:          sorts,
+		Windows:        windows,
+		Contacts:       contact,
+		Drafts:         drafts,
+		Draft:          draft,
+		DraftTags:      draftTags,
+		PollOptions:    pollOptions,
+		Scheduled:      r.URL.Query().Get("scheduled") != "",
+		Unread:         unreadNotifications(userID),
+		MaxAttachments: maxAttachments,
 	}
 
 	templates.ExecuteTemplate(w, "homepage.html", data)
@@ -375,119 +470,52 @@ func AddComment(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		_, err := db.Exec("INSERT INTO comments (post_id, user_id, content) VALUES (?, ?, ?)",
-			postID, userID, content)
-		if err != nil {
-			log.Printf("Failed to add comment: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
+		// a reply sits one level below the comment it answers
+		var parentID any
+		depth, parentAuthorID := 0, 0
+		if value := r.FormValue("parent_id"); value != "" {
+			depth, parentAuthorID, err = replyParent(postID, value)
+			switch {
+			case errors.Is(err, errParentNotFound):
+				http.Error(w, "Comment not found", http.StatusNotFound)
+				return
+			case errors.Is(err, errThreadTooDeep):
+				http.Error(w, "This thread is too deep to reply to", http.StatusBadRequest)
+				return
+			case err != nil:
+				log.Printf("Failed to load parent comment: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			parentID = value
 		}
-	}
-
-	http.Redirect(w, r, "/homepage", http.StatusSeeOther)
-}
-
-func AddLike(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("session")
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	var userID int
-	err = db.QueryRow("SELECT user_id FROM sessions WHERE session_id = ?", cookie.Value).Scan(&userID)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
 
-	if r.Method == http.MethodPost {
-		r.ParseForm()
-		postID := r.FormValue("post_id")
-
-		var exists bool
-		err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM likes WHERE post_id = ? AND user_id = ?)", postID, userID).Scan(&exists)
+		result, err := db.Exec("INSERT INTO comments (post_id, user_id, parent_id, depth, content) VALUES (?, ?, ?, ?, ?)",
+			postID, userID, parentID, depth, content)
 		if err != nil {
-			log.Printf("Failed to check like existence: %v", err)
+			log.Printf("Failed to add comment: %v", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
-
-		if exists {
-			_, err = db.Exec("DELETE FROM likes WHERE post_id = ? AND user_id = ?", postID, userID)
-		} else {
-			_, err = db.Exec("INSERT INTO likes (post_id, user_id) VALUES (?, ?)", postID, userID)
+		if err := refreshHotScore(postID); err != nil {
+			log.Printf("Failed to score post %s: %v", postID, err)
 		}
 
+		commentID, _ := result.LastInsertId()
+		mentioned, err := saveMentions(db, "comment", commentID, userID, content)
 		if err != nil {
-			log.Printf("Failed to toggle like: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
+			log.Printf("Failed to save mentions: %v", err)
 		}
-
-		var likeCount int
-		err = db.QueryRow("SELECT COUNT(*) FROM likes WHERE post_id = ?", postID).Scan(&likeCount)
-		if err != nil {
-			log.Printf("Failed to get like count: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
+		if parentID != nil {
+			// the reply notification already covers a parent author who is
+			// also mentioned
+			mentioned = slices.DeleteFunc(mentioned, func(id int) bool { return id == parentAuthorID })
+			notifyReply(parentAuthorID, userID, postID, commentID, content)
 		}
-
-		w.WriteHeader(http.StatusOK)
-		w.Write(fmt.Appendf(nil, "%d", likeCount))
-	}
-}
-
-func LikeComment(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("session")
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	var userID int
-	err = db.QueryRow("SELECT user_id FROM sessions WHERE session_id = ?", cookie.Value).Scan(&userID)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+		notifyMentions(mentioned, userID, fmt.Sprintf("/post?id=%s#comment-%d", postID, commentID), content)
 	}
 
-	if r.Method == http.MethodPost {
-		r.ParseForm()
-		commentID := r.FormValue("comment_id")
-
-		var exists bool
-		err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM comment_likes WHERE comment_id = ? AND user_id = ?)",
-			commentID, userID).Scan(&exists)
-		if err != nil {
-			log.Printf("Failed to check comment like existence: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
-
-		if exists {
-			_, err = db.Exec("DELETE FROM comment_likes WHERE comment_id = ? AND user_id = ?", commentID, userID)
-		} else {
-			_, err = db.Exec("INSERT INTO comment_likes (comment_id, user_id) VALUES (?, ?)", commentID, userID)
-		}
-
-		if err != nil {
-			log.Printf("Failed to toggle comment like: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
-
-		var likeCount int
-		err = db.QueryRow("SELECT COUNT(*) FROM comment_likes WHERE comment_id = ?", commentID).Scan(&likeCount)
-		if err != nil {
-			log.Printf("Failed to get comment like count: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
-
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(fmt.Sprintf("%d", likeCount)))
-	}
+	http.Redirect(w, r, "/homepage", http.StatusSeeOther)
 }
 
 func Chat(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,55 @@
+package myserver
+
+import "strings"
+
+// DiffLine is one line of a line based diff. Op is "=", "+" or "-".
+type DiffLine struct {
+	Op   string
+	Text string
+}
+
+// diffLines compares two texts line by line using the longest common
+// subsequence, which is plenty for post sized content.
+func diffLines(before, after string) []DiffLine {
+	a := strings.Split(before, "\n")
+	b := strings.Split(after, "\n")
+
+	// lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var lines []DiffLine
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, DiffLine{"=", a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, DiffLine{"-", a[i]})
+			i++
+		default:
+			lines = append(lines, DiffLine{"+", b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, DiffLine{"-", a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, DiffLine{"+", b[j]})
+	}
+	return lines
+}
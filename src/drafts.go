@@ -0,0 +1,483 @@
+package myserver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedulerInterval is how often due drafts are looked for, so a scheduled
+// post goes out at most this late
+const schedulerInterval = 30 * time.Second
+
+var errDraftNotFound = errors.New("draft not found")
+
+// createPost inserts a post with its tags and mentions inside the caller's
+// transaction. Only approved tags are attached. Once the transaction is
+// committed the caller should call publishedPost.
+func createPost(tx *sql.Tx, userID int, title, content string, tagIDs []string) (int64, error) {
+	result, err := tx.Exec(`INSERT INTO posts (user_id, title, content, created_at, updated_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`,
+		userID, title, content)
+	if err != nil {
+		return 0, err
+	}
+	postID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, tagID := range tagIDs {
+		_, err = tx.Exec("INSERT OR IGNORE INTO post_tags (post_id, tag_id) SELECT ?, id FROM tags WHERE id = ? AND status = 'approved'", postID, tagID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if _, err := saveMentions(tx, "post", postID, userID, content); err != nil {
+		return 0, err
+	}
+	return postID, nil
+}
+
+// PostNotice tells connected clients that a post was published
+type PostNotice struct {
+	Type     string `json:"type"`
+	PostID   int64  `json:"post_id"`
+	Title    string `json:"title"`
+	Username string `json:"username"`
+}
+
+// publishedPost scores a newly committed post, announces it to every
+// connected client and notifies the users it mentions
+func publishedPost(postID int64) {
+	if err := refreshHotScore(postID); err != nil {
+		log.Printf("Failed to score post %d: %v", postID, err)
+	}
+
+	notice := PostNotice{Type: "new_post", PostID: postID}
+	var authorID int
+	var content string
+	err := db.QueryRow(`SELECT posts.title, posts.user_id, posts.content, users.username
+		FROM posts JOIN users ON users.id = posts.user_id
+		WHERE posts.id = ?`, postID).Scan(&notice.Title, &authorID, &content, &notice.Username)
+	if err != nil {
+		log.Printf("Failed to load post %d for broadcast: %v", postID, err)
+		return
+	}
+	message, _ := json.Marshal(notice)
+	manager.broadcast <- message
+
+	mentioned, _, err := mentionedUsers("post", postID)
+	if err != nil {
+		log.Printf("Failed to load mentions of post %d: %v", postID, err)
+		return
+	}
+	notifyMentions(mentioned, authorID, fmt.Sprintf("/post?id=%d", postID), content)
+}
+
+// parsePublishAt reads the schedule field. The page sends RFC 3339 in UTC;
+// a bare datetime-local value is taken as UTC too.
+func parsePublishAt(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse("2006-01-02T15:04", value)
+}
+
+// draftFromRequest reads a draft from the post form fields
+func draftFromRequest(r *http.Request, userID int) (Draft, error) {
+	draft := Draft{
+		UserID:  userID,
+		Title:   strings.TrimSpace(r.FormValue("title")),
+		Content: r.FormValue("content"),
+	}
+	if id := r.FormValue("draft_id"); id != "" {
+		var err error
+		if draft.ID, err = strconv.Atoi(id); err != nil {
+			return draft, errDraftNotFound
+		}
+	}
+	for _, tagID := range r.Form["tags"] {
+		if _, err := strconv.Atoi(tagID); err == nil {
+			draft.Tags = append(draft.Tags, tagID)
+		}
+	}
+	if value := r.FormValue("publish_at"); value != "" {
+		publishAt, err := parsePublishAt(value)
+		if err != nil {
+			return draft, err
+		}
+		draft.PublishAt = publishAt
+	}
+	poll, err := pollFromRequest(r)
+	if err != nil {
+		return draft, err
+	}
+	draft.Poll = poll
+	return draft, nil
+}
+
+// problem returns why the draft cannot be saved, or ""
+func (d Draft) problem() string {
+	if len(d.Title) > maxTitleLength {
+		return "Title is too long"
+	}
+	if !d.PublishAt.IsZero() && (d.Title == "" || strings.TrimSpace(d.Content) == "") {
+		return "A scheduled post needs a title and content"
+	}
+	// an unscheduled draft may hold a poll that is still being written
+	if !d.PublishAt.IsZero() && d.Poll != nil {
+		return d.Poll.problem(d.PublishAt)
+	}
+	return ""
+}
+
+// setPoll reads the poll column, JSON or empty
+func (d *Draft) setPoll(poll string) error {
+	if poll == "" {
+		return nil
+	}
+	d.Poll = &PollInput{}
+	return json.Unmarshal([]byte(poll), d.Poll)
+}
+
+// saveDraft inserts a new draft or updates one of the user's drafts
+func saveDraft(draft *Draft) error {
+	var publishAt any
+	if !draft.PublishAt.IsZero() {
+		publishAt = draft.PublishAt.UTC().Format(sqliteTimeLayout)
+	}
+	tags := strings.Join(draft.Tags, ",")
+	var poll []byte
+	if draft.Poll != nil {
+		poll, _ = json.Marshal(draft.Poll)
+	}
+
+	if draft.ID == 0 {
+		result, err := db.Exec(`INSERT INTO drafts (user_id, title, content, tags, poll, publish_at)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			draft.UserID, draft.Title, draft.Content, tags, string(poll), publishAt)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		draft.ID = int(id)
+		return err
+	}
+
+	result, err := db.Exec(`UPDATE drafts SET title = ?, content = ?, tags = ?, poll = ?, publish_at = ?,
+		updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND user_id = ?`,
+		draft.Title, draft.Content, tags, string(poll), publishAt, draft.ID, draft.UserID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errDraftNotFound
+	}
+	return nil
+}
+
+// remapDraftTags moves drafts from one tag to another inside the caller's
+// transaction, when the first is merged into the second. Drafts keep their
+// tags as a list of ids rather than in post_tags, so merging has to rewrite
+// them too.
+func remapDraftTags(tx *sql.Tx, from, to int) error {
+	rows, err := tx.Query("SELECT id, tags FROM drafts WHERE ',' || tags || ',' LIKE ?", "%,"+strconv.Itoa(from)+",%")
+	if err != nil {
+		return err
+	}
+	remapped := map[int]string{}
+	for rows.Next() {
+		var id int
+		var tags string
+		if err := rows.Scan(&id, &tags); err != nil {
+			rows.Close()
+			return err
+		}
+		var kept []string
+		for _, tag := range strings.Split(tags, ",") {
+			if tag == strconv.Itoa(from) {
+				tag = strconv.Itoa(to)
+			}
+			if !slices.Contains(kept, tag) {
+				kept = append(kept, tag)
+			}
+		}
+		remapped[id] = strings.Join(kept, ",")
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, tags := range remapped {
+		if _, err := tx.Exec("UPDATE drafts SET tags = ? WHERE id = ?", tags, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scheduleDraft saves a draft with a publish time together with the files
+// uploaded for it, which follow any it already has. The scheduler moves
+// them to the post.
+func scheduleDraft(draft *Draft, attachments []Attachment) error {
+	if err := saveDraft(draft); err != nil {
+		return err
+	}
+	if len(attachments) == 0 {
+		return nil
+	}
+	var next int
+	err := db.QueryRow("SELECT COALESCE(MAX(position) + 1, 0) FROM attachments WHERE draft_id = ?", draft.ID).
+		Scan(&next)
+	if err != nil {
+		return err
+	}
+	return insertAttachments(db, "draft_id", int64(draft.ID), attachments, next)
+}
+
+// draftAttachmentCount counts the attachments of one of the user's drafts,
+// which count towards the limit of the post it becomes
+func draftAttachmentCount(draftID, userID int) (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM attachments
+		WHERE draft_id = (SELECT id FROM drafts WHERE id = ? AND user_id = ?)`, draftID, userID).Scan(&count)
+	return count, err
+}
+
+// moveDraftAttachments hands the attachments of one of the user's drafts
+// over to the post it was published as and returns how many there were
+func moveDraftAttachments(tx *sql.Tx, draftID, userID int, postID int64) (int, error) {
+	result, err := tx.Exec(`UPDATE attachments SET post_id = ?, draft_id = NULL
+		WHERE draft_id = (SELECT id FROM drafts WHERE id = ? AND user_id = ?)`, postID, draftID, userID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// deleteDraft removes one of the user's drafts and its attachments
+func deleteDraft(draftID, userID int) error {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM drafts WHERE id = ? AND user_id = ?)", draftID, userID).
+		Scan(&exists)
+	if err != nil {
+		return err
+	} else if !exists {
+		return errDraftNotFound
+	}
+	attachments, err := loadAttachments(db, "draft_id", draftID)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM attachments WHERE draft_id = ?", draftID); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM drafts WHERE id = ?", draftID); err != nil {
+		return err
+	}
+	removeAttachmentFiles(attachments)
+	return nil
+}
+
+// getDrafts loads drafts matching the condition, scheduled ones first
+func getDrafts(condition string, args ...any) ([]Draft, error) {
+	rows, err := db.Query(`
+		SELECT id, user_id, title, content, tags, poll, publish_at, updated_at
+		FROM drafts WHERE `+condition+`
+		ORDER BY publish_at IS NULL, publish_at, updated_at DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var drafts []Draft
+	for rows.Next() {
+		var draft Draft
+		var tags, poll string
+		var publishAt sql.NullTime
+		if err := rows.Scan(&draft.ID, &draft.UserID, &draft.Title, &draft.Content, &tags,
+			&poll, &publishAt, &draft.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if tags != "" {
+			draft.Tags = strings.Split(tags, ",")
+		}
+		if err := draft.setPoll(poll); err != nil {
+			return nil, err
+		}
+		draft.PublishAt = publishAt.Time
+		drafts = append(drafts, draft)
+	}
+	return drafts, rows.Err()
+}
+
+// DraftsAPI lists (GET), autosaves (POST) and deletes (DELETE ?id=) the
+// user's drafts. POST takes the same fields as the post form and returns the
+// saved draft, whose id the page sends back on the next save.
+func DraftsAPI(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		drafts, err := getDrafts("user_id = ?", userID)
+		if err != nil {
+			log.Println("Failed to fetch drafts:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if drafts == nil {
+			drafts = []Draft{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(drafts)
+
+	case http.MethodPost:
+		if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		draft, err := draftFromRequest(r, userID)
+		if err == errDraftNotFound {
+			http.Error(w, "Draft not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Invalid publish or poll close time", http.StatusBadRequest)
+			return
+		}
+		if problem := draft.problem(); problem != "" {
+			http.Error(w, problem, http.StatusBadRequest)
+			return
+		}
+
+		err = saveDraft(&draft)
+		if err == errDraftNotFound {
+			http.Error(w, "Draft not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println("Failed to save draft:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		draft.UpdatedAt = time.Now().UTC()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(draft)
+
+	case http.MethodDelete:
+		draftID, _ := strconv.Atoi(r.URL.Query().Get("id"))
+		err := deleteDraft(draftID, userID)
+		if err == errDraftNotFound {
+			http.Error(w, "Draft not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println("Failed to delete draft:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// StartScheduler publishes due drafts in the background
+func StartScheduler() {
+	go func() {
+		publishDueDrafts()
+		for range time.Tick(schedulerInterval) {
+			publishDueDrafts()
+		}
+	}()
+}
+
+func publishDueDrafts() {
+	rows, err := db.Query("SELECT id FROM drafts WHERE publish_at IS NOT NULL AND publish_at <= ?",
+		time.Now().UTC().Format(sqliteTimeLayout))
+	if err != nil {
+		log.Println("Failed to fetch due drafts:", err)
+		return
+	}
+	var due []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			due = append(due, id)
+		}
+	}
+	rows.Close()
+
+	for _, draftID := range due {
+		if err := publishDraft(draftID); err != nil {
+			log.Printf("Failed to publish draft %d: %v", draftID, err)
+		}
+	}
+}
+
+// publishDraft turns a due draft into a post. The draft is read and deleted
+// in the post's transaction, so an edit or unschedule that lands first wins
+// and a draft is never published twice.
+func publishDraft(draftID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var draft Draft
+	var tags, poll string
+	err = tx.QueryRow(`SELECT user_id, title, content, tags, poll FROM drafts
+		WHERE id = ? AND publish_at IS NOT NULL AND publish_at <= ?`,
+		draftID, time.Now().UTC().Format(sqliteTimeLayout)).
+		Scan(&draft.UserID, &draft.Title, &draft.Content, &tags, &poll)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if tags != "" {
+		draft.Tags = strings.Split(tags, ",")
+	}
+	if err := draft.setPoll(poll); err != nil {
+		return err
+	}
+
+	postID, err := createPost(tx, draft.UserID, draft.Title, draft.Content, draft.Tags)
+	if err != nil {
+		return err
+	}
+	if _, err := moveDraftAttachments(tx, draftID, draft.UserID, postID); err != nil {
+		return err
+	}
+	if draft.Poll != nil {
+		if err := createPoll(tx, postID, *draft.Poll); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM drafts WHERE id = ?", draftID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Published scheduled draft %d as post %d", draftID, postID)
+	publishedPost(postID)
+	return nil
+}
@@ -0,0 +1,43 @@
+package myserver
+
+import "testing"
+
+func TestRemapDraftTags(t *testing.T) {
+	database := openTestDB(t)
+	if _, err := database.Exec("INSERT INTO users (username, email, password) VALUES ('alice', 'alice@example.com', 'x')"); err != nil {
+		t.Fatal(err)
+	}
+	drafts := []struct{ tags, want string }{
+		{"3", "1"},
+		{"1,3", "1"},
+		{"3,5,1", "1,5"},
+		{"2,13,33", "2,13,33"},
+		{"", ""},
+	}
+	for _, draft := range drafts {
+		if _, err := database.Exec("INSERT INTO drafts (user_id, tags) VALUES (1, ?)", draft.tags); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remapDraftTags(tx, 3, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, draft := range drafts {
+		var tags string
+		if err := database.QueryRow("SELECT tags FROM drafts WHERE id = ?", i+1).Scan(&tags); err != nil {
+			t.Fatal(err)
+		}
+		if tags != draft.want {
+			t.Errorf("draft tagged %q has %q after merging 3 into 1, want %q", draft.tags, tags, draft.want)
+		}
+	}
+}
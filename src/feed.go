@@ -0,0 +1,244 @@
+package myserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 50
+
+	// sqliteTimeLayout matches CURRENT_TIMESTAMP, which is how every post
+	// timestamp is written, so cursors compare correctly as text
+	sqliteTimeLayout = "2006-01-02 15:04:05"
+)
+
+var errBadCursor = errors.New("invalid cursor")
+
+// FeedQuery selects one page of the post feed
+type FeedQuery struct {
+	Tag    string // a single tag ID, as linked from /tag
+	Filter string // a tag expression such as "Music AND NOT Gaming"
+	Sort   string // a key of feedSorts, "new" when empty
+	Window string // day, week or all, for the "top" sort
+	Limit  int
+	Cursor string // opaque, taken from the previous page's NextCursor
+
+	// Saved limits the feed to the viewer's bookmarks, in Collection if set.
+	// Viewer is filled in by the handler, never from the URL.
+	Saved      bool
+	Collection string
+	Viewer     int
+	Author     int // only posts by this user, for profiles
+}
+
+// Params encodes the query without its cursor, for links to further pages
+func (q FeedQuery) Params() url.Values {
+	params := url.Values{}
+	if q.Tag != "" {
+		params.Set("tag", q.Tag)
+	}
+	if q.Filter != "" {
+		params.Set("tags", q.Filter)
+	}
+	if q.Sort != "" && q.Sort != "new" {
+		params.Set("sort", q.Sort)
+	}
+	if q.Window != "" {
+		params.Set("t", q.Window)
+	}
+	if q.Limit > 0 {
+		params.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if q.Saved {
+		params.Set("saved", "1")
+	}
+	if q.Collection != "" {
+		params.Set("collection", q.Collection)
+	}
+	return params
+}
+
+// FeedPage is one page of posts plus the cursor of the page after it
+type FeedPage struct {
+	Posts      []Post `json:"posts"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	HTML       string `json:"html,omitempty"`
+}
+
+// feedQueryFromRequest reads tag, tags, sort, t, cursor, limit, saved and
+// collection from the query string
+func feedQueryFromRequest(r *http.Request) FeedQuery {
+	query := r.URL.Query()
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	sort, window := validSort(query)
+	return FeedQuery{
+		Tag:    query.Get("tag"),
+		Filter: strings.TrimSpace(query.Get("tags")),
+		Sort:   sort,
+		Window: window,
+		Limit:  limit,
+		Cursor: query.Get("cursor"),
+
+		Saved:      query.Get("saved") != "" || query.Get("collection") != "",
+		Collection: query.Get("collection"),
+	}
+}
+
+// getFeed returns a page of posts using keyset pagination on the sort column
+// and the id, so deep pages cost the same as the first one. Every sort column
+// is stored on posts and indexed together with the id.
+func getFeed(q FeedQuery) (FeedPage, error) {
+	if q.Limit <= 0 {
+		q.Limit = defaultPageSize
+	}
+	q.Limit = min(q.Limit, maxPageSize)
+	sort, ok := feedSorts[q.Sort]
+	if !ok {
+		q.Sort, sort = "new", feedSorts["new"]
+	}
+
+	var conditions []string
+	var args []any
+
+	if q.Tag != "" {
+		conditions = append(conditions, "posts.id IN (SELECT post_id FROM post_tags WHERE tag_id = ?)")
+		args = append(args, q.Tag)
+	}
+
+	if q.Filter != "" {
+		condition, filterArgs, err := tagFilterCondition(q.Filter)
+		if err != nil {
+			return FeedPage{}, err
+		}
+		conditions = append(conditions, condition)
+		args = append(args, filterArgs...)
+	}
+
+	if q.Author != 0 {
+		conditions = append(conditions, "posts.user_id = ?")
+		args = append(args, q.Author)
+	}
+
+	if q.Saved {
+		condition := "posts.id IN (SELECT post_id FROM bookmarks WHERE user_id = ?)"
+		args = append(args, q.Viewer)
+		if q.Collection != "" {
+			condition = "posts.id IN (SELECT post_id FROM bookmarks WHERE user_id = ? AND collection_id = ?)"
+			args = append(args, q.Collection)
+		}
+		conditions = append(conditions, condition)
+	}
+
+	if span, _ := topWindow(q.Window); q.Sort == "top" && span > 0 {
+		conditions = append(conditions, "posts.created_at >= ?")
+		args = append(args, time.Now().UTC().Add(-span).Format(sqliteTimeLayout))
+	}
+
+	if q.Cursor != "" {
+		key, id, err := decodeCursor(q.Cursor, q.Sort, sort.parse)
+		if err != nil {
+			return FeedPage{}, err
+		}
+		conditions = append(conditions, "("+sort.column+" < ? OR ("+sort.column+" = ? AND posts.id < ?))")
+		args = append(args, key, key, id)
+	}
+
+	// one extra row tells us whether there is a next page
+	order := sort.column + " DESC, posts.id DESC"
+	posts, err := queryPosts(conditions, args, order, q.Limit+1)
+	if err != nil {
+		return FeedPage{}, err
+	}
+
+	page := FeedPage{Posts: posts}
+	if len(posts) > q.Limit {
+		page.Posts = posts[:q.Limit]
+		last := page.Posts[q.Limit-1]
+		page.NextCursor = encodeCursor(q.Sort, sort.key(last), last.ID)
+	}
+	return page, nil
+}
+
+// Cursors hold the sort name, the last item's sort key and its id. A cursor
+// is only valid for the sort that produced it. Comment pages use them too.
+func encodeCursor(sortName, key string, id int) string {
+	raw := sortName + "|" + key + "|" + strconv.Itoa(id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(cursor, sortName string, parse func(string) (any, error)) (any, int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, 0, errBadCursor
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 || parts[0] != sortName {
+		return nil, 0, errBadCursor
+	}
+	key, err := parse(parts[1])
+	if err != nil {
+		return nil, 0, errBadCursor
+	}
+	id, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return nil, 0, errBadCursor
+	}
+	return key, id, nil
+}
+
+// PostsAPI serves feed pages as JSON for infinite scroll. Next to the posts
+// it returns their rendered markup so the client reuses the server template.
+func PostsAPI(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := feedQueryFromRequest(r)
+	query.Viewer = userID
+	page, err := getFeed(query)
+	if err == errBadCursor {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	} else if errors.Is(err, errBadFilter) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Println("Failed to fetch posts:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := setViewer(page.Posts, userID); err != nil {
+		log.Println("Failed to load posts for viewer:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	for i := range page.Posts {
+		if err := templates.ExecuteTemplate(&buf, "post", page.Posts[i]); err != nil {
+			log.Println("Failed to render post:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	page.HTML = buf.String()
+	if page.Posts == nil {
+		page.Posts = []Post{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,172 @@
+package myserver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// queryCount counts statements prepared through the "sqlite3_counting" driver
+var queryCount atomic.Int64
+
+// countingDriver hides sqlite3's fast query path, so database/sql prepares
+// every query and each one can be counted. Exec is passed through because
+// the schema is a multi statement script.
+type countingDriver struct{ driver.Driver }
+
+type countingConn struct{ driver.Conn }
+
+func (d countingDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{conn}, nil
+}
+
+func (c countingConn) Prepare(query string) (driver.Stmt, error) {
+	queryCount.Add(1)
+	return c.Conn.Prepare(query)
+}
+
+func (c countingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	queryCount.Add(1)
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func init() {
+	sql.Register("sqlite3_counting", countingDriver{&sqlite3.SQLiteDriver{}})
+}
+
+// openTestDB creates an empty database with the current schema
+func openTestDB(tb testing.TB) *sql.DB {
+	tb.Helper()
+
+	database, err := sql.Open("sqlite3_counting", filepath.Join(tb.TempDir(), "test.db"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { database.Close() })
+
+	schema, err := os.ReadFile("../database/my.sql")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := database.Exec(string(schema)); err != nil {
+		tb.Fatal(err)
+	}
+	if err := Migrate(database); err != nil {
+		tb.Fatal(err)
+	}
+	return database
+}
+
+// seedFeed creates a database with the given number of posts, each with three
+// tags, a few comments and reactions
+func seedFeed(b *testing.B, posts int) *sql.DB {
+	b.Helper()
+
+	database := openTestDB(b)
+	tx, err := database.Begin()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for u := 1; u <= 10; u++ {
+		tx.Exec("INSERT INTO users (username, email, password) VALUES (?, ?, 'x')",
+			fmt.Sprintf("user%d", u), fmt.Sprintf("user%d@example.com", u))
+	}
+	for t := 1; t <= 10; t++ {
+		tx.Exec("INSERT INTO tags (name) VALUES (?)", fmt.Sprintf("tag%d", t))
+	}
+	for p := 1; p <= posts; p++ {
+		tx.Exec(`INSERT INTO posts (user_id, title, content, created_at, updated_at)
+			VALUES (?, ?, 'content', datetime('now', ?), datetime('now', ?))`,
+			p%10+1, fmt.Sprintf("post %d", p), fmt.Sprintf("-%d minutes", posts-p), fmt.Sprintf("-%d minutes", posts-p))
+		for t := range 3 {
+			tx.Exec("INSERT INTO post_tags (post_id, tag_id) VALUES (?, ?)", p, (p+t)%10+1)
+		}
+		for c := range 5 {
+			tx.Exec("INSERT INTO comments (post_id, user_id, content) VALUES (?, ?, 'comment')", p, c+1)
+		}
+		for l := range 3 {
+			tx.Exec("INSERT INTO post_reactions (post_id, user_id, emoji) VALUES (?, ?, '👍')", p, l+1)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		b.Fatal(err)
+	}
+	return database
+}
+
+// feedSizes are the database sizes BenchmarkGetFeed compares
+var feedSizes = []int{100, 1000, 10000, 100000}
+
+// maxFeedGrowth is how much slower a feed page may get on the largest
+// database than on the smallest before BenchmarkGetFeed fails. A page reads
+// the same number of rows whatever the size, so it only grows with the
+// depth of the indexes; at the last measurement all sizes were within
+// 1.5-2.6ms/op of each other.
+const maxFeedGrowth = 3
+
+// BenchmarkGetFeed loads the first feed page for growing databases, in every
+// sort order, and fails when queries/op or ns/op do not stay flat as the
+// number of posts grows.
+func BenchmarkGetFeed(b *testing.B) {
+	type result struct{ nsPerOp, queriesPerOp float64 }
+	results := map[string]map[int]result{}
+
+	for _, n := range feedSizes {
+		b.Run(fmt.Sprintf("posts=%d", n), func(b *testing.B) {
+			db = seedFeed(b, n)
+
+			for _, sort := range sortOrder {
+				b.Run("sort="+sort, func(b *testing.B) {
+					queryCount.Store(0)
+					iterations := 0
+					for b.Loop() {
+						iterations++
+						page, err := getFeed(FeedQuery{Sort: sort})
+						if err != nil {
+							b.Fatal(err)
+						}
+						if len(page.Posts) != defaultPageSize {
+							b.Fatalf("got %d posts, want %d", len(page.Posts), defaultPageSize)
+						}
+					}
+					queries := float64(queryCount.Load()) / float64(iterations)
+					b.ReportMetric(queries, "queries/op")
+
+					if results[sort] == nil {
+						results[sort] = map[int]result{}
+					}
+					results[sort][n] = result{float64(b.Elapsed().Nanoseconds()) / float64(iterations), queries}
+				})
+			}
+		})
+	}
+
+	// sizes left out by -bench are not compared
+	smallest, largest := feedSizes[0], feedSizes[len(feedSizes)-1]
+	for _, sort := range sortOrder {
+		small, ok := results[sort][smallest]
+		large, ok2 := results[sort][largest]
+		if !ok || !ok2 {
+			continue
+		}
+		if large.queriesPerOp != small.queriesPerOp {
+			b.Errorf("sort=%s: %.1f queries/op with %d posts, %.1f with %d",
+				sort, large.queriesPerOp, largest, small.queriesPerOp, smallest)
+		}
+		if growth := large.nsPerOp / small.nsPerOp; growth > maxFeedGrowth {
+			b.Errorf("sort=%s: %.0fns/op with %d posts is %.1fx the %.0fns/op with %d, want at most %dx",
+				sort, large.nsPerOp, largest, growth, small.nsPerOp, smallest, maxFeedGrowth)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package myserver
+
+import (
+	"fmt"
+	"html/template"
+	"time"
+)
+
+// templateFuncs are available in every template
+var templateFuncs = template.FuncMap{
+	"timeAgo":      timeAgo,
+	"reactions":    availableReactions,
+	"commentSorts": commentSortLinks,
+	"imageURL":     imageURL,
+	"imageSrcset":  imageSrcset,
+	"fileSize":     fileSize,
+}
+
+// timeAgo renders a timestamp relative to now, e.g. "just now", "3h ago"
+// or "5d ago". Anything older than a month falls back to the date.
+func timeAgo(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	case d < 30*24*time.Hour:
+		return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+	}
+	if t.Year() == time.Now().Year() {
+		return t.Format("Jan 2")
+	}
+	return t.Format("Jan 2, 2006")
+}
+
+// fileSize renders a size in bytes for people, e.g. "812 B" or "2.4 MB"
+func fileSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGT"[exp])
+}
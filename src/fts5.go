@@ -0,0 +1,8 @@
+//go:build sqlite_fts5
+
+package myserver
+
+// fts5Compiled records that the server was built with -tags sqlite_fts5,
+// which compiles FTS5 into mattn/go-sqlite3. Full text search needs it; the
+// Makefile builds with the tag.
+const fts5Compiled = true
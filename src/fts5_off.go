@@ -0,0 +1,7 @@
+//go:build !sqlite_fts5
+
+package myserver
+
+// fts5Compiled is false in builds without -tags sqlite_fts5, whose SQLite
+// lacks FTS5. See fts5.go.
+const fts5Compiled = false
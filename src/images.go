@@ -0,0 +1,231 @@
+package myserver
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"path"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// imageVariant is one of the sizes every post image is stored in. Images
+// are scaled down to the width, never up.
+type imageVariant struct {
+	name  string
+	width int
+}
+
+var imageVariants = []imageVariant{
+	{"thumb", 320},
+	{"feed", 800},
+	{"full", 1600},
+}
+
+// imageDir prefixes the keys of post images, next to the avatars
+const imageDir = "images"
+
+const jpegQuality = 85
+
+// imageSlots bounds how many uploads are decoded at once. A large photo
+// takes a few hundred megabytes while it is being resized.
+var imageSlots = make(chan struct{}, runtime.NumCPU())
+
+// processImage re-encodes a checked upload in every variant size, stages
+// them and returns the key the variants are named after, stored as the
+// attachment path, with the size of the full variant attachments link to.
+// The key is made of the hash of the upload, so the same file always gets
+// the same key. Only pixels are carried over, so EXIF data such as the GPS
+// position and any other metadata is left behind.
+//
+// Processing runs synchronously, so the post is never shown with the
+// original file; imageSlots keeps concurrent uploads from exhausting memory.
+func processImage(stage, hash string, data []byte, mimeType string) (string, int64, error) {
+	imageSlots <- struct{}{}
+	defer func() { <-imageSlots }()
+
+	var encoded map[string][]byte
+	var ext string
+	var err error
+	if mimeType == "image/gif" {
+		encoded, ext, err = encodeGIFVariants(data)
+	} else {
+		encoded, ext, err = encodeVariants(data, mimeType)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	key := path.Join(imageDir, hash+ext)
+	for _, variant := range imageVariants {
+		if err := stageBlob(stage, imageVariantKey(key, variant.name), encoded[variant.name]); err != nil {
+			discardBlobs(stage, uploadKeys([]string{key}))
+			return "", 0, err
+		}
+	}
+	return key, int64(len(encoded["full"])), nil
+}
+
+// encodeVariants scales a still image to every variant. JPEGs stay JPEGs,
+// everything else becomes a PNG so transparency survives.
+func encodeVariants(data []byte, mimeType string) (map[string][]byte, string, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	rgba := toRGBA(img)
+	if mimeType == "image/jpeg" {
+		rgba = orient(rgba, jpegOrientation(data))
+	}
+
+	ext := ".png"
+	if mimeType == "image/jpeg" {
+		ext = ".jpg"
+	}
+
+	encoded := map[string][]byte{}
+	w, h := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+	for _, variant := range imageVariants {
+		scaled := rgba
+		if w > variant.width {
+			scaled = resize(rgba, variant.width, max(h*variant.width/w, 1))
+		}
+		var buf bytes.Buffer
+		if ext == ".jpg" {
+			err = jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: jpegQuality})
+		} else {
+			err = png.Encode(&buf, scaled)
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("encode %s variant: %w", variant.name, err)
+		}
+		encoded[variant.name] = buf.Bytes()
+	}
+	return encoded, ext, nil
+}
+
+// encodeGIFVariants handles GIFs. A still GIF is treated like any other
+// image. Animations are re-encoded frame by frame, which drops comments and
+// application data. Frames may cover only part of the canvas, so variants
+// smaller than the animation are played onto a canvas, and each whole
+// canvas is scaled and mapped back onto its frame's palette. checkImage has
+// capped the frames decoded here.
+func encodeGIFVariants(data []byte) (map[string][]byte, string, error) {
+	animation, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(animation.Image) == 1 {
+		return encodeVariants(data, "image/gif")
+	}
+
+	w, h := animation.Config.Width, animation.Config.Height
+	scaled := map[string]*gif.GIF{}
+	for _, variant := range imageVariants {
+		if w > variant.width {
+			config := image.Config{Width: variant.width, Height: max(h*variant.width/w, 1)}
+			scaled[variant.name] = &gif.GIF{LoopCount: animation.LoopCount, Config: config}
+		}
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i, frame := range animation.Image {
+		var previous *image.RGBA
+		if animation.Disposal[i] == gif.DisposalPrevious {
+			previous = toRGBA(canvas)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		for name, variant := range scaled {
+			small := resize(canvas, variant.Config.Width, variant.Config.Height)
+			paletted := image.NewPaletted(small.Bounds(), withTransparent(frame.Palette))
+			draw.Draw(paletted, paletted.Bounds(), small, image.Point{}, draw.Src)
+			scaled[name].Image = append(variant.Image, paletted)
+			scaled[name].Delay = append(variant.Delay, animation.Delay[i])
+			scaled[name].Disposal = append(variant.Disposal, gif.DisposalNone)
+		}
+
+		switch animation.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	clean := &gif.GIF{
+		Image:           animation.Image,
+		Delay:           animation.Delay,
+		LoopCount:       animation.LoopCount,
+		Disposal:        animation.Disposal,
+		Config:          animation.Config,
+		BackgroundIndex: animation.BackgroundIndex,
+	}
+	encoded := map[string][]byte{}
+	for _, variant := range imageVariants {
+		g := clean
+		if scaled[variant.name] != nil {
+			g = scaled[variant.name]
+		}
+		var buf bytes.Buffer
+		if err := gif.EncodeAll(&buf, g); err != nil {
+			return nil, "", fmt.Errorf("encode %s variant: %w", variant.name, err)
+		}
+		encoded[variant.name] = buf.Bytes()
+	}
+	return encoded, ".gif", nil
+}
+
+// withTransparent returns a palette that can show the canvas where no frame
+// has painted yet, adding a transparent color if there is room
+func withTransparent(p color.Palette) color.Palette {
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return p
+		}
+	}
+	if len(p) == 256 {
+		return p
+	}
+	return append(slices.Clip(p), color.Transparent)
+}
+
+// isProcessedImage tells keys of processed images from the single files
+// stored before images were processed
+func isProcessedImage(key string) bool {
+	return strings.HasPrefix(key, imageDir+"/")
+}
+
+// imageVariantKey names the blob of one size of a processed image
+func imageVariantKey(key, variant string) string {
+	ext := path.Ext(key)
+	return strings.TrimSuffix(key, ext) + "_" + variant + ext
+}
+
+// imageURL links to one size of a post image. Images stored before they
+// were processed only have their original.
+func imageURL(key, variant string) string {
+	if !isProcessedImage(key) {
+		return blobURL(key)
+	}
+	return blobURL(imageVariantKey(key, variant))
+}
+
+// imageSrcset lists every size of a post image for the srcset attribute,
+// letting browsers pick the smallest that fills the layout
+func imageSrcset(key string) string {
+	if !isProcessedImage(key) {
+		return ""
+	}
+	candidates := make([]string, len(imageVariants))
+	for i, variant := range imageVariants {
+		candidates[i] = fmt.Sprintf("%s %dw", imageURL(key, variant.name), variant.width)
+	}
+	return strings.Join(candidates, ", ")
+}
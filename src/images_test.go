@@ -0,0 +1,69 @@
+package myserver
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+// testAnimation is a 1000×10 animation: a blue frame, then a red one over
+// the left half only
+func testAnimation() *gif.GIF {
+	palette := color.Palette{color.RGBA{0, 0, 255, 255}, color.RGBA{255, 0, 0, 255}}
+	blue := image.NewPaletted(image.Rect(0, 0, 1000, 10), palette)
+	red := image.NewPaletted(image.Rect(0, 0, 500, 10), palette)
+	for i := range red.Pix {
+		red.Pix[i] = 1
+	}
+	return &gif.GIF{
+		Image:    []*image.Paletted{blue, red},
+		Delay:    []int{10, 20},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalNone},
+		Config:   image.Config{ColorModel: palette, Width: 1000, Height: 10},
+	}
+}
+
+func TestEncodeGIFVariants(t *testing.T) {
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, testAnimation()); err != nil {
+		t.Fatal(err)
+	}
+	encoded, ext, err := encodeGIFVariants(buf.Bytes())
+	if err != nil || ext != ".gif" {
+		t.Fatalf("encodeGIFVariants: %q, %v", ext, err)
+	}
+
+	for _, variant := range imageVariants {
+		animation, err := gif.DecodeAll(bytes.NewReader(encoded[variant.name]))
+		if err != nil {
+			t.Fatalf("%s: %v", variant.name, err)
+		}
+		width := min(variant.width, 1000)
+		if animation.Config.Width != width || len(animation.Image) != 2 {
+			t.Errorf("%s: %d frames %d wide, want 2 frames %d wide", variant.name, len(animation.Image), animation.Config.Width, width)
+			continue
+		}
+		if animation.Delay[1] != 20 {
+			t.Errorf("%s: second frame delay %d, want 20", variant.name, animation.Delay[1])
+		}
+
+		last := animation.Image[1]
+		if width == 1000 {
+			// kept as it was, covering only part of the canvas
+			if last.Bounds().Dx() != 500 {
+				t.Errorf("%s: second frame is %d wide, want 500", variant.name, last.Bounds().Dx())
+			}
+			continue
+		}
+		// scaled from the canvas, showing the first frame where the second
+		// does not cover it
+		y := last.Bounds().Dy() / 2
+		left := color.RGBAModel.Convert(last.At(0, y)).(color.RGBA)
+		right := color.RGBAModel.Convert(last.At(width-1, y)).(color.RGBA)
+		if left != (color.RGBA{255, 0, 0, 255}) || right != (color.RGBA{0, 0, 255, 255}) {
+			t.Errorf("%s: second frame is %v on the left and %v on the right, want red and blue", variant.name, left, right)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package myserver
+
+import (
+	"html"
+	"html/template"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Posts, comments and chat messages are stored as written and rendered on the
+// way out with a small Markdown subset: *emphasis*, **strong**, `code`,
+// fenced code blocks, [links](https://…), bare URLs, lists and > quotes.
+// Everything else is escaped, and the result goes through sanitizeHTML so
+// only allowlisted markup can ever reach a page.
+
+const maxQuoteDepth = 5
+
+var (
+	bulletItem  = regexp.MustCompile(`^ {0,3}[-*+]\s+(.*)$`)
+	orderedItem = regexp.MustCompile(`^ {0,3}(\d{1,9})[.)]\s+(.*)$`)
+)
+
+// renderMarkdown turns user content into safe HTML
+func renderMarkdown(source string) template.HTML {
+	return renderWithMentions(source, nil)
+}
+
+// renderWithMentions is renderMarkdown that also links @username for each of
+// the mentioned users, as recorded when the content was written. Names match
+// whatever their case, like saveMentions matches them.
+func renderWithMentions(source string, mentioned []string) template.HTML {
+	mentions := make(map[string]string, len(mentioned))
+	for _, username := range mentioned {
+		mentions[strings.ToLower(username)] = username
+	}
+	source = strings.ReplaceAll(source, "\r\n", "\n")
+	var b strings.Builder
+	renderBlocks(&b, strings.Split(source, "\n"), 0, mentions)
+	return template.HTML(sanitizeHTML(b.String()))
+}
+
+func isFence(line string) bool {
+	return strings.HasPrefix(strings.TrimLeft(line, " "), "```")
+}
+
+func isQuote(line string) bool {
+	return strings.HasPrefix(strings.TrimLeft(line, " "), ">")
+}
+
+func startsBlock(line string) bool {
+	return isFence(line) || isQuote(line) || bulletItem.MatchString(line) || orderedItem.MatchString(line)
+}
+
+func renderBlocks(b *strings.Builder, lines []string, depth int, mentions map[string]string) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+
+		case isFence(line):
+			end := i + 1
+			for end < len(lines) && !isFence(lines[end]) {
+				end++
+			}
+			b.WriteString("<pre><code>")
+			b.WriteString(html.EscapeString(strings.Join(lines[i+1:end], "\n")))
+			b.WriteString("</code></pre>\n")
+			i = end + 1
+
+		case isQuote(line) && depth < maxQuoteDepth:
+			var inner []string
+			for ; i < len(lines) && isQuote(lines[i]); i++ {
+				text := strings.TrimPrefix(strings.TrimLeft(lines[i], " "), ">")
+				inner = append(inner, strings.TrimPrefix(text, " "))
+			}
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, inner, depth+1, mentions)
+			b.WriteString("</blockquote>\n")
+
+		case bulletItem.MatchString(line):
+			i = renderList(b, lines, i, bulletItem, "ul", mentions)
+
+		case orderedItem.MatchString(line):
+			i = renderList(b, lines, i, orderedItem, "ol", mentions)
+
+		default:
+			var paragraph []string
+			for ; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+				if len(paragraph) > 0 && startsBlock(lines[i]) {
+					break
+				}
+				paragraph = append(paragraph, renderInline(strings.TrimSpace(lines[i]), true, mentions))
+			}
+			b.WriteString("<p>")
+			b.WriteString(strings.Join(paragraph, "<br>\n"))
+			b.WriteString("</p>\n")
+		}
+	}
+}
+
+// renderList writes consecutive items of one kind and returns the index of
+// the first line after the list. Indented lines continue the previous item.
+func renderList(b *strings.Builder, lines []string, i int, item *regexp.Regexp, tag string, mentions map[string]string) int {
+	b.WriteString("<" + tag)
+	if m := item.FindStringSubmatch(lines[i]); tag == "ol" && strings.TrimLeft(m[1], "0") != "1" {
+		b.WriteString(` start="` + m[1] + `"`)
+	}
+	b.WriteString(">\n")
+
+	for i < len(lines) {
+		m := item.FindStringSubmatch(lines[i])
+		if m == nil {
+			break
+		}
+		parts := []string{renderInline(strings.TrimSpace(m[len(m)-1]), true, mentions)}
+		i++
+		for i < len(lines) && strings.HasPrefix(lines[i], "  ") && strings.TrimSpace(lines[i]) != "" &&
+			!item.MatchString(lines[i]) {
+			parts = append(parts, renderInline(strings.TrimSpace(lines[i]), true, mentions))
+			i++
+		}
+		b.WriteString("<li>" + strings.Join(parts, "<br>\n") + "</li>\n")
+	}
+
+	b.WriteString("</" + tag + ">\n")
+	return i
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// renderInline handles the span level syntax of one line. Links, mentions
+// included, are not allowed inside link text.
+func renderInline(s string, links bool, mentions map[string]string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		rest := s[i:]
+
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_[]()>#+-.!", s[i+1]) >= 0:
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '`':
+			if j := strings.IndexByte(s[i+1:], '`'); j > 0 {
+				b.WriteString("<code>" + html.EscapeString(s[i+1:i+1+j]) + "</code>")
+				i += j + 2
+				continue
+			}
+
+		case strings.HasPrefix(rest, "**") || strings.HasPrefix(rest, "__"):
+			if j := strings.Index(s[i+2:], rest[:2]); j > 0 && s[i+2] != ' ' {
+				b.WriteString("<strong>" + renderInline(s[i+2:i+2+j], links, mentions) + "</strong>")
+				i += j + 4
+				continue
+			}
+
+		case c == '*' || c == '_':
+			// snake_case words are left alone
+			if c == '_' && i > 0 && isWordByte(s[i-1]) {
+				break
+			}
+			if j := strings.IndexByte(s[i+1:], c); j > 0 && s[i+1] != ' ' && s[i+j] != ' ' {
+				end := i + 1 + j
+				if c == '_' && end+1 < len(s) && isWordByte(s[end+1]) {
+					break
+				}
+				b.WriteString("<em>" + renderInline(s[i+1:end], links, mentions) + "</em>")
+				i = end + 1
+				continue
+			}
+
+		case c == '[' && links:
+			if text, href, n, ok := parseLink(rest); ok {
+				b.WriteString(`<a href="` + html.EscapeString(href) + `">` + renderInline(text, false, nil) + "</a>")
+				i += n
+				continue
+			}
+
+		case c == '@' && links && (i == 0 || !isWordByte(s[i-1])):
+			name := mentionAt(s[i+1:])
+			if username, ok := mentions[strings.ToLower(name)]; ok {
+				b.WriteString(`<a href="/profile?user=` + html.EscapeString(url.QueryEscape(username)) + `" class="mention">@` +
+					html.EscapeString(name) + "</a>")
+				i += 1 + len(name)
+				continue
+			}
+
+		case links && (strings.HasPrefix(rest, "http://") || strings.HasPrefix(rest, "https://")) &&
+			(i == 0 || !isWordByte(s[i-1])):
+			end := strings.IndexAny(rest, " \t<>\"")
+			if end < 0 {
+				end = len(rest)
+			}
+			href := strings.TrimRight(rest[:end], ".,;:!?)'")
+			b.WriteString(`<a href="` + html.EscapeString(href) + `">` + html.EscapeString(href) + "</a>")
+			i += len(href)
+			continue
+		}
+
+		b.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+	return b.String()
+}
+
+// parseLink reads [text](url) at the start of s
+func parseLink(s string) (text, href string, n int, ok bool) {
+	close := strings.Index(s, "](")
+	if close < 1 || strings.IndexByte(s[1:close], '[') >= 0 {
+		return "", "", 0, false
+	}
+	end := strings.IndexByte(s[close+2:], ')')
+	if end < 1 {
+		return "", "", 0, false
+	}
+	href = strings.TrimSpace(s[close+2 : close+2+end])
+	if !safeURL(href) {
+		return "", "", 0, false
+	}
+	return s[1:close], href, close + 3 + end, true
+}
+
+// safeURL allows web and mail links and links within the site. Links
+// within the site are a path or a fragment: browsers read "//host" and
+// "/\host" alike as a link to another host, so neither may pass.
+func safeURL(raw string) bool {
+	if strings.ContainsAny(raw, " \t\n\"<>") || strings.IndexFunc(raw, unicode.IsControl) >= 0 {
+		return false
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return u.Host != ""
+	case "mailto":
+		return u.Opaque != ""
+	case "":
+		return u.Host == "" && !strings.Contains(raw, "\\") &&
+			(strings.HasPrefix(raw, "/") && !strings.HasPrefix(raw, "//") || strings.HasPrefix(raw, "#"))
+	}
+	return false
+}
+
+// allowedTags maps each allowed element to the attributes it may keep
+var allowedTags = map[string][]string{
+	"p": nil, "br": nil, "em": nil, "strong": nil, "code": nil, "pre": nil,
+	"blockquote": nil, "ul": nil, "ol": {"start"}, "li": nil, "a": {"href", "class"},
+}
+
+var (
+	tagPattern  = regexp.MustCompile(`^<(/?)([a-zA-Z][a-zA-Z0-9]*)((?:\s+[a-zA-Z-]+="[^"<>]*")*)\s*/?>`)
+	attrPattern = regexp.MustCompile(`([a-zA-Z-]+)="([^"<>]*)"`)
+	digits      = regexp.MustCompile(`^\d{1,9}$`)
+)
+
+// sanitizeHTML keeps allowlisted elements and attributes and escapes
+// everything else. Unclosed elements are closed, stray end tags dropped, and
+// every link gets rel="nofollow noopener noreferrer".
+func sanitizeHTML(input string) string {
+	var b strings.Builder
+	var open []string
+
+	for i := 0; i < len(input); {
+		switch input[i] {
+		case '<':
+			m := tagPattern.FindStringSubmatch(input[i:])
+			if m == nil {
+				b.WriteString("&lt;")
+				i++
+				continue
+			}
+			i += len(m[0])
+
+			name := strings.ToLower(m[2])
+			allowedAttrs, ok := allowedTags[name]
+			if !ok {
+				continue
+			}
+
+			if m[1] == "/" {
+				for j := len(open) - 1; j >= 0; j-- {
+					if open[j] == name {
+						for k := len(open) - 1; k >= j; k-- {
+							b.WriteString("</" + open[k] + ">")
+						}
+						open = open[:j]
+						break
+					}
+				}
+				continue
+			}
+
+			b.WriteString("<" + name)
+			for _, attr := range attrPattern.FindAllStringSubmatch(m[3], -1) {
+				key, value := strings.ToLower(attr[1]), html.UnescapeString(attr[2])
+				switch {
+				case !slices.Contains(allowedAttrs, key):
+				case key == "href" && !safeURL(value):
+				case key == "start" && !digits.MatchString(value):
+				case key == "class" && value != "mention":
+				default:
+					b.WriteString(" " + key + `="` + html.EscapeString(value) + `"`)
+				}
+			}
+			if name == "a" {
+				b.WriteString(` rel="nofollow noopener noreferrer"`)
+			}
+			b.WriteString(">")
+			if name != "br" {
+				open = append(open, name)
+			}
+
+		case '>':
+			b.WriteString("&gt;")
+			i++
+
+		default:
+			b.WriteByte(input[i])
+			i++
+		}
+	}
+
+	for j := len(open) - 1; j >= 0; j-- {
+		b.WriteString("</" + open[j] + ">")
+	}
+	return b.String()
+}
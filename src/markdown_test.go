@@ -0,0 +1,86 @@
+package myserver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSafeURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		safe bool
+	}{
+		{"https://example.com/a?b=1", true},
+		{"http://example.com", true},
+		{"mailto:someone@example.com", true},
+		{"/post?id=1", true},
+		{"#comment-3", true},
+		{"javascript:alert(1)", false},
+		{"JaVaScRiPt:alert(1)", false},
+		{"jav&#x61;script:alert(1)", false},
+		{"data:text/html,hi", false},
+		{"vbscript:msgbox", false},
+		{"//evil.com", false},
+		{"/\\evil.com", false},
+		{"\\\\evil.com", false},
+		{"https:///path", false},
+		{"https://example.com/\"onmouseover", false},
+		{"java\tscript:alert(1)", false},
+		{"relative/path", false},
+		{"mailto:", false},
+	}
+	for _, test := range tests {
+		if got := safeURL(test.url); got != test.safe {
+			t.Errorf("safeURL(%q) = %v, want %v", test.url, got, test.safe)
+		}
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"link", "[x](/post?id=1)", `<p><a href="/post?id=1" rel="nofollow noopener noreferrer">x</a></p>`},
+		{"escaped query", "[x](https://example.com/a?b=1&c=2)", `<p><a href="https://example.com/a?b=1&amp;c=2" rel="nofollow noopener noreferrer">x</a></p>`},
+		{"javascript link", "[x](javascript:alert(1))", `<p>[x](javascript:alert(1))</p>`},
+		{"mixed case scheme", "[x](JaVaScRiPt:alert(1))", `<p>[x](JaVaScRiPt:alert(1))</p>`},
+		{"entity encoded scheme", "[x](jav&#x61;script:alert(1))", `<p>[x](jav&amp;#x61;script:alert(1))</p>`},
+		{"protocol relative", "[x](//evil.com)", `<p>[x](//evil.com)</p>`},
+		{"backslash host", "[x](/\\evil.com)", `<p>[x](/\evil.com)</p>`},
+		{"script", "<script>alert(1)</script>", `<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>`},
+		{"event handler", "<img src=x onerror=alert(1)>", `<p>&lt;img src=x onerror=alert(1)&gt;</p>`},
+		{"raw anchor", `<a href="javascript:alert(1)">x</a>`, `<p>&lt;a href=&#34;javascript:alert(1)&#34;&gt;x&lt;/a&gt;</p>`},
+		{"code span", "`<b>`", `<p><code>&lt;b&gt;</code></p>`},
+		{"nested emphasis", "**bold *and em* inside**", `<p><strong>bold <em>and em</em> inside</strong></p>`},
+		{"intraword underscores", "snake_case_word", `<p>snake_case_word</p>`},
+		{"bare url", "https://example.com/x.", `<p><a href="https://example.com/x" rel="nofollow noopener noreferrer">https://example.com/x</a>.</p>`},
+		{"nested quote", "> quote\n> > nested", "<blockquote>\n<p>quote</p>\n<blockquote>\n<p>nested</p>\n</blockquote>\n</blockquote>"},
+		{"ordered list", "3. x\n4. y", "<ol start=\"3\">\n<li>x</li>\n<li>y</li>\n</ol>"},
+	}
+	for _, test := range tests {
+		if got := strings.TrimSpace(string(renderMarkdown(test.in))); got != test.want {
+			t.Errorf("%s: renderMarkdown(%q)\n got %q\nwant %q", test.name, test.in, got, test.want)
+		}
+	}
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"entity encoded scheme", `<a href="jav&#x61;script:alert(1)">x</a>`, `<a rel="nofollow noopener noreferrer">x</a>`},
+		{"upper case scheme", `<a href="JAVASCRIPT:alert(1)">x</a>`, `<a rel="nofollow noopener noreferrer">x</a>`},
+		{"backslash host", `<a href="/\evil.com">x</a>`, `<a rel="nofollow noopener noreferrer">x</a>`},
+		{"protocol relative", `<a href="//evil.com">x</a>`, `<a rel="nofollow noopener noreferrer">x</a>`},
+		{"attributes", `<a href="/x" class="evil" onclick="x()">y</a>`, `<a href="/x" rel="nofollow noopener noreferrer">y</a>`},
+		{"script", `<script>alert(1)</script>`, `alert(1)`},
+		{"unclosed emphasis", `<p><em>a</p>`, `<p><em>a</em></p>`},
+		{"stray end tag", `</strong>x`, `x`},
+		{"bad list start", `<ol start="3x"><li>a</li></ol>`, `<ol><li>a</li></ol>`},
+	}
+	for _, test := range tests {
+		if got := sanitizeHTML(test.in); got != test.want {
+			t.Errorf("%s: sanitizeHTML(%q)\n got %q\nwant %q", test.name, test.in, got, test.want)
+		}
+	}
+}
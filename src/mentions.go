@@ -0,0 +1,326 @@
+package myserver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// @username is recognised when the name is made of letters, digits, _ . and
+// -, and is not glued to a preceding word, so e-mail addresses stay plain text.
+// Only names that belong to a user are recorded and linked.
+const (
+	maxMentionLength = 30
+	maxMentions      = 10 // per post, comment or message
+	excerptLength    = 140
+)
+
+// querier is what both *sql.DB and *sql.Tx offer
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func isMentionByte(c byte) bool {
+	return c == '_' || c == '.' || c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// validUsername tells whether name can be mentioned: made of mention
+// characters only, and not ending in a character a mention drops
+func validUsername(name string) bool {
+	if name == "" || len(name) > maxMentionLength || mentionAt(name) != name {
+		return false
+	}
+	return true
+}
+
+// mentionAt returns the username at the start of s, which follows an @
+func mentionAt(s string) string {
+	n := 0
+	for n < len(s) && n < maxMentionLength && isMentionByte(s[n]) {
+		n++
+	}
+	// a sentence may end right after a name
+	return strings.TrimRight(s[:n], ".-")
+}
+
+// parseMentions returns the distinct names mentioned in content, in order.
+// Code is skipped like the renderer does, roughly: anything between
+// backticks.
+func parseMentions(content string) []string {
+	var names []string
+	seen := map[string]bool{}
+	inCode := false
+	for i := 0; i < len(content) && len(names) < maxMentions; i++ {
+		switch c := content[i]; {
+		case c == '`':
+			inCode = !inCode
+		case c == '@' && !inCode && (i == 0 || !isWordByte(content[i-1])):
+			if name := mentionAt(content[i+1:]); name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// saveMentions records who content written by authorID mentions, replacing
+// the source's previous mentions, and returns the users who were not
+// mentioned there before. kind is post, comment or message.
+func saveMentions(q querier, kind string, sourceID int64, authorID int, content string) ([]int, error) {
+	names := parseMentions(content)
+
+	users := map[int]bool{}
+	if len(names) > 0 {
+		args := make([]any, len(names))
+		for i, name := range names {
+			args[i] = name
+		}
+		// names are matched case-insensitively, preferring a user whose
+		// name is written exactly like that
+		rows, err := q.Query("SELECT id, username FROM users WHERE username COLLATE NOCASE IN ("+
+			placeholders(len(args))+") ORDER BY id", args...)
+		if err != nil {
+			return nil, err
+		}
+		found := map[string]int{}
+		for rows.Next() {
+			var id int
+			var username string
+			if err := rows.Scan(&id, &username); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			found[username] = id
+			if _, ok := found[strings.ToLower(username)]; !ok {
+				found[strings.ToLower(username)] = id
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			id, ok := found[name]
+			if !ok {
+				id, ok = found[strings.ToLower(name)]
+			}
+			if ok && id != authorID {
+				users[id] = true
+			}
+		}
+	}
+
+	// an edit drops the mentions that are gone
+	keep := []any{kind, sourceID}
+	for id := range users {
+		keep = append(keep, id)
+	}
+	condition := ""
+	if len(users) > 0 {
+		condition = " AND user_id NOT IN (" + placeholders(len(users)) + ")"
+	}
+	if _, err := q.Exec("DELETE FROM mentions WHERE kind = ? AND source_id = ?"+condition, keep...); err != nil {
+		return nil, err
+	}
+
+	var added []int
+	for id := range users {
+		result, err := q.Exec("INSERT OR IGNORE INTO mentions (user_id, author_id, kind, source_id) VALUES (?, ?, ?, ?)",
+			id, authorID, kind, sourceID)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			added = append(added, id)
+		}
+	}
+	return added, nil
+}
+
+// mentionedUsers returns the ids and names of who the source mentions
+func mentionedUsers(kind string, sourceID int64) ([]int, []string, error) {
+	rows, err := db.Query(`SELECT users.id, users.username FROM mentions JOIN users ON users.id = mentions.user_id
+		WHERE mentions.kind = ? AND mentions.source_id = ?`, kind, sourceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	var names []string
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		names = append(names, name)
+	}
+	return ids, names, rows.Err()
+}
+
+// mentionNames is a column expression listing the usernames a row mentions,
+// separated by spaces, which never occur in a mentionable name
+func mentionNames(kind, idColumn string) string {
+	return `(SELECT group_concat(users.username, ' ') FROM mentions JOIN users ON users.id = mentions.user_id
+		WHERE mentions.kind = '` + kind + `' AND mentions.source_id = ` + idColumn + `)`
+}
+
+// excerpt shortens content for a notification
+func excerpt(content string) string {
+	content = strings.Join(strings.Fields(content), " ")
+	if len(content) <= excerptLength {
+		return content
+	}
+	cut := excerptLength
+	for cut > 0 && !utf8.RuneStart(content[cut]) {
+		cut--
+	}
+	return content[:cut] + "…"
+}
+
+// notify stores a notification for each user and pushes it to their open
+// pages. It runs after the write it reports on has been committed.
+func notify(userIDs []int, n Notification) {
+	if len(userIDs) == 0 {
+		return
+	}
+	err := db.QueryRow("SELECT username FROM users WHERE id = ?", n.ActorID).Scan(&n.Actor)
+	if err != nil {
+		log.Printf("Failed to load notification actor %d: %v", n.ActorID, err)
+		return
+	}
+	n.Type = "notification"
+	n.CreatedAt = time.Now().UTC()
+	n.CreatedAgo = timeAgo(n.CreatedAt)
+
+	for _, userID := range userIDs {
+		result, err := db.Exec(`INSERT INTO notifications (user_id, actor_id, kind, link, excerpt)
+			VALUES (?, ?, ?, ?, ?)`, userID, n.ActorID, n.Kind, n.Link, n.Excerpt)
+		if err != nil {
+			log.Printf("Failed to store notification for user %d: %v", userID, err)
+			continue
+		}
+		id, _ := result.LastInsertId()
+		n.ID = int(id)
+		message, _ := json.Marshal(n)
+		manager.SendToClient(userID, message)
+	}
+}
+
+// notifyMentions tells newly mentioned users where they were mentioned
+func notifyMentions(userIDs []int, actorID int, link, content string) {
+	notify(userIDs, Notification{Kind: "mention", ActorID: actorID, Link: link, Excerpt: excerpt(content)})
+}
+
+func getNotifications(userID, limit int) ([]Notification, error) {
+	rows, err := db.Query(`
+		SELECT notifications.id, notifications.kind, notifications.actor_id, users.username, notifications.link,
+		notifications.excerpt, notifications.is_read, notifications.created_at
+		FROM notifications
+		JOIN users ON users.id = notifications.actor_id
+		WHERE notifications.user_id = ?
+		ORDER BY notifications.id DESC
+		LIMIT ?`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		n := Notification{Type: "notification"}
+		if err := rows.Scan(&n.ID, &n.Kind, &n.ActorID, &n.Actor, &n.Link, &n.Excerpt, &n.Read, &n.CreatedAt); err != nil {
+			return nil, err
+		}
+		n.CreatedAgo = timeAgo(n.CreatedAt)
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+func unreadNotifications(userID int) int {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND is_read = FALSE", userID).Scan(&count); err != nil {
+		log.Println("Failed to count notifications:", err)
+	}
+	return count
+}
+
+// notificationPageSize is how many notifications are kept in view
+const notificationPageSize = 50
+
+// NotificationsPage lists the current user's latest notifications and marks
+// them as read
+func NotificationsPage(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+
+	notifications, err := getNotifications(userID, notificationPageSize)
+	if err != nil {
+		log.Println("Failed to fetch notifications:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("UPDATE notifications SET is_read = TRUE WHERE user_id = ? AND is_read = FALSE", userID); err != nil {
+		log.Println("Failed to mark notifications as read:", err)
+	}
+
+	templates.ExecuteTemplate(w, "notifications.html", notifications)
+}
+
+// NotificationsAPI returns the latest notifications with the unread count
+// (GET), or marks them as read (POST, all of them or ?id=)
+func NotificationsAPI(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		notifications, err := getNotifications(userID, notificationPageSize)
+		if err != nil {
+			log.Println("Failed to fetch notifications:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Unread        int            `json:"unread"`
+			Notifications []Notification `json:"notifications"`
+		}{unreadNotifications(userID), notifications})
+
+	case http.MethodPost:
+		query, args := "UPDATE notifications SET is_read = TRUE WHERE user_id = ?", []any{userID}
+		if id := r.FormValue("id"); id != "" {
+			if _, err := strconv.Atoi(id); err != nil {
+				http.Error(w, "Notification not found", http.StatusNotFound)
+				return
+			}
+			query, args = query+" AND id = ?", append(args, id)
+		}
+		if _, err := db.Exec(query, args...); err != nil {
+			log.Println("Failed to mark notifications as read:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Unread int `json:"unread"`
+		}{unreadNotifications(userID)})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
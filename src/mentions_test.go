@@ -0,0 +1,67 @@
+package myserver
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidUsername(t *testing.T) {
+	for name, want := range map[string]bool{
+		"alice":                 true,
+		"Bob_2":                 true,
+		"j.doe-smith":           true,
+		"":                      false,
+		"alice.":                false,
+		"alice-":                false,
+		"al ice":                false,
+		"élodie":                false,
+		"a@b":                   false,
+		strings.Repeat("a", 30): true,
+		strings.Repeat("a", 31): false,
+	} {
+		if got := validUsername(name); got != want {
+			t.Errorf("validUsername(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestSaveMentionsIgnoresCase(t *testing.T) {
+	database := openTestDB(t)
+	// Bob and bob both signed up before names were unique in any case
+	for _, name := range []string{"alice", "Bob", "bob", "carol"} {
+		_, err := database.Exec("INSERT INTO users (username, email, password) VALUES (?, ?, 'x')", name, name+"@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		content string
+		want    []int
+	}{
+		{"hi @Alice and @ALICE", []int{1}},
+		{"@BOB", []int{3}},
+		{"@Bob", []int{2}},
+		{"@Carol @nobody", nil},
+		{"`@alice` in code", nil},
+	}
+	for i, test := range tests {
+		added, err := saveMentions(database, "post", int64(i+1), 4, test.content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(added)
+		if !slices.Equal(added, test.want) {
+			t.Errorf("%q mentions users %v, want %v", test.content, added, test.want)
+		}
+	}
+}
+
+func TestRenderMentions(t *testing.T) {
+	got := string(renderWithMentions("thanks @Alice, not @mallory", []string{"alice"}))
+	want := `<p>thanks <a href="/profile?user=alice" class="mention" rel="nofollow noopener noreferrer">@Alice</a>, not @mallory</p>`
+	if strings.TrimSpace(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,615 @@
+package myserver
+
+import (
+	"database/sql"
+	"fmt"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrations run in order on every start, after my.sql. my.sql only creates
+// tables that are missing, so columns added to a table that already shipped
+// have to be applied here. Every step must be safe to run more than once.
+var migrations = []func(*sql.DB) error{
+	addUserAvatar,
+	addUserRole,
+	addPostEditedAt,
+	addPostTitleAndTimestamps,
+	addTagDetails,
+	seedDefaultTags,
+	addPostCounters,
+	addDraftPoll,
+	addPostAuthorIndex,
+	seedReactionTypes,
+	migrateLikesToReactions,
+	addCommentThreads,
+	addCommentModeration,
+	addCommentReactionCount,
+	moveImagesToAttachments,
+	addBlobKeys,
+	addUploadRefs,
+	backdatePostCreation,
+	fixImageSizes,
+}
+
+// Migrate brings an existing database up to the current schema
+func Migrate(database *sql.DB) error {
+	if err := dropSearchTriggers(database); err != nil {
+		return err
+	}
+	for _, migrate := range migrations {
+		if err := migrate(database); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addUserAvatar(database *sql.DB) error {
+	return addColumn(database, "users", "avatar", "TEXT")
+}
+
+func addUserRole(database *sql.DB) error {
+	return addColumn(database, "users", "role", "TEXT NOT NULL DEFAULT 'user'")
+}
+
+func addPostEditedAt(database *sql.DB) error {
+	return addColumn(database, "posts", "edited_at", "DATETIME")
+}
+
+// postFirstActivity is the earliest time a post is known to have existed:
+// its first revision, its last edit or its first comment. Posts created
+// before creation times were recorded are dated with it.
+const postFirstActivity = `(SELECT MIN(at) FROM (
+	SELECT posts.edited_at AS at
+	UNION ALL SELECT created_at FROM post_revisions WHERE post_revisions.post_id = posts.id
+	UNION ALL SELECT created_at FROM comments WHERE comments.post_id = posts.id))`
+
+// addPostTitleAndTimestamps adds the required title and the created/updated
+// timestamps. Existing posts get their first line as title. Their real
+// creation time was never recorded, so they are dated with the first sign of
+// them in their history, or the migration time when there is none; the id
+// keeps their relative order.
+func addPostTitleAndTimestamps(database *sql.DB) error {
+	if err := addColumn(database, "posts", "title", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumn(database, "posts", "created_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := addColumn(database, "posts", "updated_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := addColumn(database, "post_revisions", "title", "TEXT"); err != nil {
+		return err
+	}
+
+	_, err := database.Exec(`
+		UPDATE posts SET title = substr(trim(CASE WHEN instr(content, char(10)) > 0
+			THEN substr(content, 1, instr(content, char(10)) - 1) ELSE content END), 1, 80)
+		WHERE title = '';
+		UPDATE posts SET title = 'Untitled' WHERE title = '';
+		UPDATE posts SET created_at = COALESCE(` + postFirstActivity + `, CURRENT_TIMESTAMP) WHERE created_at IS NULL;
+		UPDATE posts SET updated_at = COALESCE(edited_at, created_at) WHERE updated_at IS NULL;
+		CREATE INDEX IF NOT EXISTS idx_posts_created ON posts(created_at, id);`)
+	if err != nil {
+		return fmt.Errorf("backfill post titles and timestamps: %w", err)
+	}
+	return nil
+}
+
+// addTagDetails adds the slug, description, color and moderation status.
+// Tags that already exist were picked by the admins, so they are approved.
+func addTagDetails(database *sql.DB) error {
+	columns := [][2]string{
+		{"slug", "TEXT"},
+		{"description", "TEXT NOT NULL DEFAULT ''"},
+		{"color", "TEXT NOT NULL DEFAULT '#4a6fa5'"},
+		{"status", "TEXT NOT NULL DEFAULT 'approved'"},
+		{"proposed_by", "INTEGER REFERENCES users(id)"},
+	}
+	for _, column := range columns {
+		if err := addColumn(database, "tags", column[0], column[1]); err != nil {
+			return err
+		}
+	}
+
+	// names that only differ in case or punctuation would share a slug,
+	// the later ones get their id appended
+	rows, err := database.Query("SELECT id, name FROM tags WHERE slug IS NULL ORDER BY id")
+	if err != nil {
+		return err
+	}
+	slugs := map[int]string{}
+	used := map[string]bool{}
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return err
+		}
+		slug := slugify(name)
+		if slug == "" || used[slug] {
+			slug = strings.Trim(slug+"-"+strconv.Itoa(id), "-")
+		}
+		used[slug] = true
+		slugs[id] = slug
+	}
+	rows.Close()
+	for id, slug := range slugs {
+		if _, err := database.Exec("UPDATE tags SET slug = ? WHERE id = ?", slug, id); err != nil {
+			return fmt.Errorf("backfill tag slugs: %w", err)
+		}
+	}
+
+	_, err = database.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_tags_slug ON tags(slug)")
+	return err
+}
+
+// addPostCounters stores the reaction and comment counts on posts, so the
+// feed can sort on them through an index. Triggers keep the counts in step
+// with the post_reactions and comments tables; the hot score is derived from
+// them in Go. The reaction count kept the name it had when reactions were
+// likes.
+func addPostCounters(database *sql.DB) error {
+	existed, err := hasColumn(database, "posts", "like_count")
+	if err != nil {
+		return err
+	}
+	for _, column := range []string{"like_count INTEGER", "comment_count INTEGER", "hot_score REAL"} {
+		name, kind, _ := strings.Cut(column, " ")
+		if err := addColumn(database, "posts", name, kind+" NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+
+	_, err = database.Exec(`
+		CREATE TRIGGER IF NOT EXISTS reactions_count_insert AFTER INSERT ON post_reactions BEGIN
+			UPDATE posts SET like_count = like_count + 1 WHERE id = new.post_id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS reactions_count_delete AFTER DELETE ON post_reactions BEGIN
+			UPDATE posts SET like_count = like_count - 1 WHERE id = old.post_id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS comments_count_insert AFTER INSERT ON comments BEGIN
+			UPDATE posts SET comment_count = comment_count + 1 WHERE id = new.post_id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS comments_count_delete AFTER DELETE ON comments BEGIN
+			UPDATE posts SET comment_count = comment_count - 1 WHERE id = old.post_id;
+		END;
+		CREATE INDEX IF NOT EXISTS idx_posts_likes ON posts(like_count, id);
+		CREATE INDEX IF NOT EXISTS idx_posts_comments ON posts(comment_count, id);
+		CREATE INDEX IF NOT EXISTS idx_posts_hot ON posts(hot_score, id);`)
+	if err != nil {
+		return fmt.Errorf("create post counter triggers: %w", err)
+	}
+	if existed {
+		return nil
+	}
+
+	_, err = database.Exec(`
+		UPDATE posts SET
+			like_count = (SELECT COUNT(*) FROM post_reactions WHERE post_reactions.post_id = posts.id),
+			comment_count = (SELECT COUNT(*) FROM comments WHERE comments.post_id = posts.id)`)
+	if err != nil {
+		return fmt.Errorf("backfill post counters: %w", err)
+	}
+	return backfillHotScores(database)
+}
+
+// backfillHotScores recomputes every post's hot score from its counters
+func backfillHotScores(database *sql.DB) error {
+	rows, err := database.Query("SELECT id, like_count, comment_count, created_at FROM posts")
+	if err != nil {
+		return err
+	}
+	scores := map[int]float64{}
+	for rows.Next() {
+		var id, likes, comments int
+		var createdAt time.Time
+		if err := rows.Scan(&id, &likes, &comments, &createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+		scores[id] = hotScore(likes, comments, createdAt)
+	}
+	rows.Close()
+	for id, score := range scores {
+		if _, err := database.Exec("UPDATE posts SET hot_score = ? WHERE id = ?", score, id); err != nil {
+			return fmt.Errorf("backfill hot scores: %w", err)
+		}
+	}
+	return nil
+}
+
+func addDraftPoll(database *sql.DB) error {
+	return addColumn(database, "drafts", "poll", "TEXT NOT NULL DEFAULT ''")
+}
+
+// addPostAuthorIndex serves profile pages, which list one user's posts
+func addPostAuthorIndex(database *sql.DB) error {
+	_, err := database.Exec("CREATE INDEX IF NOT EXISTS idx_posts_user ON posts(user_id, created_at, id)")
+	return err
+}
+
+// migrateLikesToReactions turns the likes of posts and comments into 👍
+// reactions and drops the like tables. Copying fires the reaction count
+// trigger on top of the counts the likes already made, so the counters are
+// recounted afterwards; the hot scores follow from them.
+func migrateLikesToReactions(database *sql.DB) error {
+	exists, err := hasTable(database, "likes")
+	if err != nil || !exists {
+		return err
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		DROP TRIGGER IF EXISTS likes_count_insert;
+		DROP TRIGGER IF EXISTS likes_count_delete;
+		INSERT OR IGNORE INTO post_reactions (post_id, user_id, emoji, created_at)
+			SELECT post_id, user_id, ?, created_at FROM likes;
+		INSERT OR IGNORE INTO comment_reactions (comment_id, user_id, emoji, created_at)
+			SELECT comment_id, user_id, ?, created_at FROM comment_likes;
+		DROP TABLE likes;
+		DROP TABLE IF EXISTS comment_likes;
+		UPDATE posts SET like_count = (SELECT COUNT(*) FROM post_reactions WHERE post_reactions.post_id = posts.id);`,
+		defaultReactions[0], defaultReactions[0])
+	if err != nil {
+		return fmt.Errorf("migrate likes to reactions: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return backfillHotScores(database)
+}
+
+// addCommentThreads lets comments reply to each other. Existing comments
+// stay at the top level, so their reply counts start at zero.
+func addCommentThreads(database *sql.DB) error {
+	columns := [][2]string{
+		{"parent_id", "INTEGER REFERENCES comments(id)"},
+		{"depth", "INTEGER NOT NULL DEFAULT 0"},
+		{"reply_count", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, column := range columns {
+		if err := addColumn(database, "comments", column[0], column[1]); err != nil {
+			return err
+		}
+	}
+
+	_, err := database.Exec(`
+		CREATE TRIGGER IF NOT EXISTS replies_count_insert AFTER INSERT ON comments
+		WHEN new.parent_id IS NOT NULL BEGIN
+			UPDATE comments SET reply_count = reply_count + 1 WHERE id = new.parent_id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS replies_count_delete AFTER DELETE ON comments
+		WHEN old.parent_id IS NOT NULL BEGIN
+			UPDATE comments SET reply_count = reply_count - 1 WHERE id = old.parent_id;
+		END;
+		CREATE INDEX IF NOT EXISTS idx_comments_parent ON comments(parent_id);`)
+	if err != nil {
+		return fmt.Errorf("create comment reply triggers: %w", err)
+	}
+	return nil
+}
+
+// addCommentModeration adds what editing and deleting comments record
+func addCommentModeration(database *sql.DB) error {
+	columns := [][2]string{
+		{"edited_at", "DATETIME"},
+		{"deleted_at", "DATETIME"},
+		{"deleted_by", "INTEGER REFERENCES users(id)"},
+		{"delete_reason", "TEXT"},
+	}
+	for _, column := range columns {
+		if err := addColumn(database, "comments", column[0], column[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addCommentReactionCount stores the number of reactions on comments, which
+// comment pages and feed previews sort on. Existing comments are counted
+// once, when the column is added.
+func addCommentReactionCount(database *sql.DB) error {
+	existed, err := hasColumn(database, "comments", "reaction_count")
+	if err != nil {
+		return err
+	}
+	if err := addColumn(database, "comments", "reaction_count", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	_, err = database.Exec(`
+		CREATE TRIGGER IF NOT EXISTS comment_reactions_count_insert AFTER INSERT ON comment_reactions BEGIN
+			UPDATE comments SET reaction_count = reaction_count + 1 WHERE id = new.comment_id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS comment_reactions_count_delete AFTER DELETE ON comment_reactions BEGIN
+			UPDATE comments SET reaction_count = reaction_count - 1 WHERE id = old.comment_id;
+		END;
+		CREATE INDEX IF NOT EXISTS idx_comments_top ON comments(post_id, reaction_count, id);`)
+	if err != nil {
+		return fmt.Errorf("create comment reaction triggers: %w", err)
+	}
+	if existed {
+		return nil
+	}
+
+	_, err = database.Exec(`UPDATE comments SET reaction_count =
+		(SELECT COUNT(*) FROM comment_reactions WHERE comment_reactions.comment_id = comments.id)`)
+	if err != nil {
+		return fmt.Errorf("backfill comment reaction counts: %w", err)
+	}
+	return nil
+}
+
+// moveImagesToAttachments turns the single image of posts and drafts into
+// their first attachment and drops the image_path columns. Revisions keep
+// theirs, since they record what a post looked like at the time.
+func moveImagesToAttachments(database *sql.DB) error {
+	if err := addColumn(database, "post_revisions", "attachments", "TEXT"); err != nil {
+		return err
+	}
+	for _, owner := range [][2]string{{"posts", "post_id"}, {"drafts", "draft_id"}} {
+		table, column := owner[0], owner[1]
+		exists, err := hasColumn(database, table, "image_path")
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if err := moveImages(database, table, column); err != nil {
+			return fmt.Errorf("move %s images to attachments: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func moveImages(database *sql.DB, table, column string) error {
+	rows, err := database.Query("SELECT id, image_path FROM " + table + " WHERE image_path IS NOT NULL AND image_path != ''")
+	if err != nil {
+		return err
+	}
+	var attachments []Attachment
+	var owners []int64
+	for rows.Next() {
+		var id int64
+		var attachment Attachment
+		if err := rows.Scan(&id, &attachment.Path); err != nil {
+			rows.Close()
+			return err
+		}
+		attachments = append(attachments, legacyImage(attachment.Path))
+		owners = append(owners, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, attachment := range attachments {
+		if err := insertAttachments(tx, column, owners[i], []Attachment{attachment}, 0); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("ALTER TABLE " + table + " DROP COLUMN image_path"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// legacyImage describes a stored image_path as an attachment. Files kept
+// from before uploads were checked may not be images at all; those become
+// plain downloads.
+func legacyImage(imagePath string) Attachment {
+	key := strings.TrimPrefix(imagePath, "uploads/")
+	attachment := Attachment{Kind: "image", Path: key, Name: path.Base(key)}
+	attachment.MimeType, _, _ = strings.Cut(mime.TypeByExtension(path.Ext(key)), ";")
+	if !isImageType(attachment.MimeType) {
+		attachment.Kind = "file"
+	}
+	if attachment.MimeType == "" {
+		attachment.MimeType = "application/octet-stream"
+	}
+	attachment.Size, _ = storedSize(key)
+	return attachment
+}
+
+// addBlobKeys drops the "uploads/" directory from stored file paths, which
+// are now keys of the blob store. Avatars were always stored as keys.
+func addBlobKeys(database *sql.DB) error {
+	_, err := database.Exec(`
+		UPDATE attachments SET path = substr(path, 9) WHERE path LIKE 'uploads/%';
+		UPDATE post_revisions SET image_path = substr(image_path, 9) WHERE image_path LIKE 'uploads/%';`)
+	if err != nil {
+		return fmt.Errorf("turn upload paths into keys: %w", err)
+	}
+	return nil
+}
+
+// addUploadRefs counts the references to every stored upload, which the
+// triggers keep current from then on. Uploads stored before keep their
+// random names, so only new uploads are deduplicated. The triggers and the
+// first count go in together: counts missing a reference would let the
+// file be deleted while still in use.
+func addUploadRefs(database *sql.DB) error {
+	var existed bool
+	err := database.QueryRow(`SELECT EXISTS (SELECT 1 FROM sqlite_master
+		WHERE type = 'trigger' AND name = 'attachments_upload_insert')`).Scan(&existed)
+	if err != nil || existed {
+		return err
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TRIGGER attachments_upload_insert AFTER INSERT ON attachments BEGIN
+			INSERT INTO uploads (path, refs) VALUES (new.path, 1)
+				ON CONFLICT (path) DO UPDATE SET refs = refs + 1;
+		END;
+		CREATE TRIGGER attachments_upload_delete AFTER DELETE ON attachments BEGIN
+			UPDATE uploads SET refs = refs - 1 WHERE path = old.path;
+			DELETE FROM uploads WHERE path = old.path AND refs <= 0;
+		END;
+		CREATE TRIGGER revisions_upload_insert AFTER INSERT ON post_revisions
+		WHEN new.image_path IS NOT NULL AND new.image_path != '' BEGIN
+			INSERT INTO uploads (path, refs) VALUES (new.image_path, 1)
+				ON CONFLICT (path) DO UPDATE SET refs = refs + 1;
+		END;
+		CREATE TRIGGER revisions_upload_delete AFTER DELETE ON post_revisions
+		WHEN old.image_path IS NOT NULL AND old.image_path != '' BEGIN
+			UPDATE uploads SET refs = refs - 1 WHERE path = old.image_path;
+			DELETE FROM uploads WHERE path = old.image_path AND refs <= 0;
+		END;`)
+	if err != nil {
+		return fmt.Errorf("create upload reference triggers: %w", err)
+	}
+
+	_, err = tx.Exec(`DELETE FROM uploads;
+		INSERT INTO uploads (path, refs)
+		SELECT path, COUNT(*) FROM (
+			SELECT path FROM attachments
+			UNION ALL
+			SELECT image_path FROM post_revisions WHERE image_path IS NOT NULL AND image_path != '')
+		GROUP BY path`)
+	if err != nil {
+		return fmt.Errorf("count upload references: %w", err)
+	}
+	return tx.Commit()
+}
+
+// backdatePostCreation repairs posts that addPostTitleAndTimestamps dated
+// with the migration time although their history shows they are older,
+// which made them look edited before they were written. It runs once.
+func backdatePostCreation(database *sql.DB) error {
+	version, err := schemaVersion(database, "post_created_at")
+	if err != nil || version >= 1 {
+		return err
+	}
+	_, err = database.Exec(`UPDATE posts SET created_at = ` + postFirstActivity + `
+		WHERE ` + postFirstActivity + ` < created_at`)
+	if err != nil {
+		return fmt.Errorf("backdate post creation times: %w", err)
+	}
+	return setSchemaVersion(database, "post_created_at", 1)
+}
+
+// fixImageSizes replaces the size of image attachments, which used to be
+// the size of the upload, with that of the full variant they link to. It
+// runs once; images whose files are missing keep the size they had.
+func fixImageSizes(database *sql.DB) error {
+	version, err := schemaVersion(database, "image_size")
+	if err != nil || version >= 1 {
+		return err
+	}
+
+	rows, err := database.Query("SELECT DISTINCT path FROM attachments WHERE kind = 'image'")
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		paths = append(paths, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, key := range paths {
+		size, err := storedSize(key)
+		if err != nil {
+			continue
+		}
+		if _, err := database.Exec("UPDATE attachments SET size = ? WHERE path = ?", size, key); err != nil {
+			return fmt.Errorf("fix image sizes: %w", err)
+		}
+	}
+	return setSchemaVersion(database, "image_size", 1)
+}
+
+// schemaVersion returns the version recorded under name, 0 when none is
+func schemaVersion(database *sql.DB, name string) (int, error) {
+	var version int
+	err := database.QueryRow("SELECT version FROM schema_versions WHERE name = ?", name).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+func setSchemaVersion(database *sql.DB, name string, version int) error {
+	_, err := database.Exec(`INSERT INTO schema_versions (name, version) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET version = excluded.version`, name, version)
+	return err
+}
+
+// addColumn adds a column unless the table already has it
+func addColumn(database *sql.DB, table, column, definition string) error {
+	exists, err := hasColumn(database, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = database.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+func hasTable(database *sql.DB, table string) (bool, error) {
+	var exists bool
+	err := database.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)", table).
+		Scan(&exists)
+	return exists, err
+}
+
+func hasColumn(database *sql.DB, table, column string) (bool, error) {
+	rows, err := database.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name, typ  string
+			notNull    bool
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &defaultVal, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
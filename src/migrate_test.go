@@ -0,0 +1,32 @@
+package myserver
+
+import "testing"
+
+// TestMoveImagesToAttachments moves the images of drafts when posts were
+// moved already
+func TestMoveImagesToAttachments(t *testing.T) {
+	database := openTestDB(t)
+	useTestStore(t)
+	setup := []string{
+		"ALTER TABLE drafts ADD COLUMN image_path TEXT",
+		"INSERT INTO users (id, username, email, password) VALUES (1, 'alice', 'alice@example.com', 'x')",
+		"INSERT INTO drafts (id, user_id, image_path) VALUES (1, 1, 'uploads/1_1700000000.png')",
+	}
+	for _, statement := range setup {
+		if _, err := database.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := moveImagesToAttachments(database); err != nil {
+		t.Fatal(err)
+	}
+	var path, kind string
+	err := database.QueryRow("SELECT path, kind FROM attachments WHERE draft_id = 1").Scan(&path, &kind)
+	if err != nil || path != "1_1700000000.png" || kind != "image" {
+		t.Errorf("draft attachment %q, %q, %v; want the image", path, kind, err)
+	}
+	if exists, err := hasColumn(database, "drafts", "image_path"); err != nil || exists {
+		t.Errorf("drafts.image_path still there: %v", err)
+	}
+}
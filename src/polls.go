@@ -0,0 +1,392 @@
+package myserver
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxPollQuestionLength = 200
+	maxPollOptionLength   = 100
+	maxPollOptions        = 10
+)
+
+var (
+	errPollNotFound = errors.New("poll not found")
+	errPollClosed   = errors.New("poll is closed")
+	errAlreadyVoted = errors.New("already voted")
+	errBadVote      = errors.New("invalid choice")
+)
+
+// pollFromRequest reads the poll fields of the post form. It returns nil when
+// they are all empty.
+func pollFromRequest(r *http.Request) (*PollInput, error) {
+	poll := PollInput{
+		Question: strings.TrimSpace(r.FormValue("poll_question")),
+		Multiple: r.FormValue("poll_multiple") != "",
+	}
+	for _, option := range r.Form["poll_options"] {
+		if option = strings.TrimSpace(option); option != "" {
+			poll.Options = append(poll.Options, option)
+		}
+	}
+	if poll.Question == "" && len(poll.Options) == 0 {
+		return nil, nil
+	}
+	if value := r.FormValue("poll_closes_at"); value != "" {
+		closesAt, err := parsePublishAt(value)
+		if err != nil {
+			return nil, err
+		}
+		poll.ClosesAt = closesAt
+	}
+	return &poll, nil
+}
+
+// problem returns why the poll cannot be created on a post published at
+// opensAt, or ""
+func (p PollInput) problem(opensAt time.Time) string {
+	switch {
+	case p.Question == "":
+		return "A poll needs a question"
+	case len(p.Question) > maxPollQuestionLength:
+		return "Poll question is too long"
+	case len(p.Options) < 2:
+		return "A poll needs at least two options"
+	case len(p.Options) > maxPollOptions:
+		return "A poll can have at most 10 options"
+	case !p.ClosesAt.IsZero() && !p.ClosesAt.After(opensAt):
+		return "A poll must close after the post is published"
+	}
+	seen := map[string]bool{}
+	for _, option := range p.Options {
+		if len(option) > maxPollOptionLength {
+			return "Poll option is too long"
+		}
+		if seen[strings.ToLower(option)] {
+			return "Poll options must be different"
+		}
+		seen[strings.ToLower(option)] = true
+	}
+	return ""
+}
+
+// createPoll attaches a poll to a post inside the post's transaction
+func createPoll(tx *sql.Tx, postID int64, poll PollInput) error {
+	var closesAt any
+	if !poll.ClosesAt.IsZero() {
+		closesAt = poll.ClosesAt.UTC().Format(sqliteTimeLayout)
+	}
+	result, err := tx.Exec("INSERT INTO polls (post_id, question, multiple, closes_at) VALUES (?, ?, ?, ?)",
+		postID, poll.Question, poll.Multiple, closesAt)
+	if err != nil {
+		return err
+	}
+	pollID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for position, label := range poll.Options {
+		_, err := tx.Exec("INSERT INTO poll_options (poll_id, position, label) VALUES (?, ?, ?)",
+			pollID, position, label)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryPolls loads the polls matching the condition with their options and
+// tallies. Nothing is hidden yet; that is up to loadPollVotes.
+func queryPolls(condition string, args ...any) ([]*Poll, error) {
+	rows, err := db.Query(`
+		SELECT polls.id, polls.post_id, polls.question, polls.multiple, polls.closes_at, polls.voters,
+		poll_options.id, poll_options.label, poll_options.votes
+		FROM polls
+		JOIN poll_options ON poll_options.poll_id = polls.id
+		WHERE `+condition+`
+		ORDER BY polls.id, poll_options.position`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var polls []*Poll
+	for rows.Next() {
+		var poll Poll
+		var option PollOption
+		var closesAt sql.NullTime
+		if err := rows.Scan(&poll.ID, &poll.PostID, &poll.Question, &poll.Multiple, &closesAt, &poll.Voters,
+			&option.ID, &option.Label, &option.Votes); err != nil {
+			return nil, err
+		}
+		if len(polls) == 0 || polls[len(polls)-1].ID != poll.ID {
+			poll.ClosesAt = closesAt.Time
+			poll.Closed = closesAt.Valid && !closesAt.Time.After(now)
+			polls = append(polls, &poll)
+		}
+		current := polls[len(polls)-1]
+		if current.Voters > 0 {
+			option.Percent = option.Votes * 100 / current.Voters
+		}
+		current.Options = append(current.Options, option)
+	}
+	return polls, rows.Err()
+}
+
+func loadPostPolls(byID map[int]*Post, ids []any) error {
+	polls, err := queryPolls("polls.post_id IN ("+placeholders(len(ids))+")", ids...)
+	if err != nil {
+		return err
+	}
+	for _, poll := range polls {
+		byID[poll.PostID].Poll = poll
+	}
+	return nil
+}
+
+// loadPollVotes marks the viewing user's choices in the polls of the posts.
+// Tallies of polls they have not voted in are cleared while the poll is open,
+// so they cannot sway the vote.
+func loadPollVotes(posts []Post, userID int) error {
+	byID := map[int]*Poll{}
+	var ids []any
+	for _, post := range posts {
+		if post.Poll != nil {
+			byID[post.Poll.ID] = post.Poll
+			ids = append(ids, post.Poll.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	rows, err := db.Query("SELECT poll_id, option_id FROM poll_votes WHERE user_id = ? AND poll_id IN ("+
+		placeholders(len(ids))+")", append([]any{userID}, ids...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	chosen := map[int]bool{}
+	for rows.Next() {
+		var pollID, optionID int
+		if err := rows.Scan(&pollID, &optionID); err != nil {
+			return err
+		}
+		byID[pollID].Voted = true
+		chosen[optionID] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, poll := range byID {
+		poll.ShowResults = poll.Voted || poll.Closed
+		for i := range poll.Options {
+			option := &poll.Options[i]
+			option.Chosen = chosen[option.ID]
+			if !poll.ShowResults {
+				option.Votes, option.Percent = 0, 0
+			}
+		}
+	}
+	return nil
+}
+
+// castVote records a user's only ballot in a poll
+func castVote(pollID, userID int, optionIDs []int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var multiple bool
+	var closesAt sql.NullTime
+	err = tx.QueryRow("SELECT multiple, closes_at FROM polls WHERE id = ?", pollID).Scan(&multiple, &closesAt)
+	if err == sql.ErrNoRows {
+		return errPollNotFound
+	} else if err != nil {
+		return err
+	}
+	if closesAt.Valid && !closesAt.Time.After(time.Now()) {
+		return errPollClosed
+	}
+
+	options := map[int]bool{}
+	var ids []any
+	for _, id := range optionIDs {
+		if !options[id] {
+			options[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 || !multiple && len(ids) > 1 {
+		return errBadVote
+	}
+	var valid int
+	err = tx.QueryRow("SELECT COUNT(*) FROM poll_options WHERE poll_id = ? AND id IN ("+placeholders(len(ids))+")",
+		append([]any{pollID}, ids...)...).Scan(&valid)
+	if err != nil {
+		return err
+	}
+	if valid != len(ids) {
+		return errBadVote
+	}
+
+	result, err := tx.Exec("INSERT OR IGNORE INTO poll_ballots (poll_id, user_id) VALUES (?, ?)", pollID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errAlreadyVoted
+	}
+	for _, optionID := range ids {
+		if _, err := tx.Exec("INSERT INTO poll_votes (poll_id, option_id, user_id) VALUES (?, ?, ?)",
+			pollID, optionID, userID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE poll_options SET votes = votes + 1 WHERE id IN ("+placeholders(len(ids))+")",
+		ids...); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE polls SET voters = voters + 1 WHERE id = ?", pollID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PollTally carries a poll's new counts to the users who may see them
+type PollTally struct {
+	Type    string      `json:"type"`
+	PollID  int         `json:"poll_id"`
+	PostID  int         `json:"post_id"`
+	Voters  int         `json:"voters"`
+	Options []PollCount `json:"options"`
+}
+
+type PollCount struct {
+	ID      int `json:"id"`
+	Votes   int `json:"votes"`
+	Percent int `json:"percent"`
+}
+
+// sendPollTally pushes the current counts to everyone who voted in the poll.
+// The others only see results once they vote or the poll closes.
+func sendPollTally(poll *Poll) {
+	tally := PollTally{Type: "poll", PollID: poll.ID, PostID: poll.PostID, Voters: poll.Voters}
+	for _, option := range poll.Options {
+		tally.Options = append(tally.Options, PollCount{option.ID, option.Votes, option.Percent})
+	}
+	message, _ := json.Marshal(tally)
+	go sendToVoters(poll.ID, message)
+}
+
+func sendToVoters(pollID int, message []byte) {
+	rows, err := db.Query("SELECT user_id FROM poll_ballots WHERE poll_id = ?", pollID)
+	if err != nil {
+		log.Printf("Failed to load voters of poll %d: %v", pollID, err)
+		return
+	}
+	var voters []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err == nil {
+			voters = append(voters, userID)
+		}
+	}
+	rows.Close()
+
+	for _, userID := range voters {
+		manager.SendToClient(userID, message)
+	}
+}
+
+// VotePoll records a vote. The page posts with fetch and gets the poll back
+// as JSON with its results markup; a plain form post is sent back to the post.
+func VotePoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	pollID, _ := strconv.Atoi(r.FormValue("poll_id"))
+	var optionIDs []int
+	for _, value := range r.Form["option_id"] {
+		if id, err := strconv.Atoi(value); err == nil {
+			optionIDs = append(optionIDs, id)
+		}
+	}
+
+	switch err := castVote(pollID, userID, optionIDs); err {
+	case nil:
+	case errPollNotFound:
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	case errPollClosed:
+		http.Error(w, "This poll is closed", http.StatusConflict)
+		return
+	case errAlreadyVoted:
+		http.Error(w, "You already voted in this poll", http.StatusConflict)
+		return
+	case errBadVote:
+		http.Error(w, "Pick one of the poll's options", http.StatusBadRequest)
+		return
+	default:
+		log.Println("Failed to record vote:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	polls, err := queryPolls("polls.id = ?", pollID)
+	if err != nil || len(polls) == 0 {
+		log.Println("Failed to load poll:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	poll := polls[0]
+	sendPollTally(poll)
+
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		http.Redirect(w, r, "/post?id="+strconv.Itoa(poll.PostID), http.StatusSeeOther)
+		return
+	}
+
+	if err := loadPollVotes([]Post{{Poll: poll}}, userID); err != nil {
+		log.Println("Failed to load votes:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, "poll", poll); err != nil {
+		log.Println("Failed to render poll:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*Poll
+		HTML string `json:"html"`
+	}{poll, buf.String()})
+}
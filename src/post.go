@@ -0,0 +1,554 @@
+package myserver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// maxTitleLength caps post titles, in bytes
+const maxTitleLength = 200
+
+// uploadKeys lists the blobs stored for uploaded files: every size of
+// processed images, the file itself otherwise
+func uploadKeys(paths []string) []string {
+	var keys []string
+	for _, key := range paths {
+		if !isProcessedImage(key) {
+			keys = append(keys, key)
+			continue
+		}
+		for _, variant := range imageVariants {
+			keys = append(keys, imageVariantKey(key, variant.name))
+		}
+	}
+	return keys
+}
+
+// uploadPath is the reverse of uploadKeys: the path an attachment stores
+// for one of its blobs
+func uploadPath(key string) string {
+	if !isProcessedImage(key) {
+		return key
+	}
+	ext := path.Ext(key)
+	for _, variant := range imageVariants {
+		if name, ok := strings.CutSuffix(strings.TrimSuffix(key, ext), "_"+variant.name); ok {
+			return name + ext
+		}
+	}
+	return key
+}
+
+// EditPost shows the edit form and saves the author's changes, keeping the
+// previous version as a revision.
+func EditPost(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+
+	postID := r.FormValue("id")
+
+	var authorID int
+	var title, content string
+	err = db.QueryRow("SELECT user_id, title, content FROM posts WHERE id = ?", postID).Scan(&authorID, &title, &content)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to load post: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if authorID != userID {
+		http.Error(w, "You can only edit your own posts", http.StatusForbidden)
+		return
+	}
+
+	attachments, err := loadAttachments(db, "post_id", postID)
+	if err != nil {
+		log.Printf("Failed to load attachments: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		tags, err := getAllTags()
+		if err != nil {
+			log.Println("Failed to fetch tags:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		selected, err := postTagIDs(postID)
+		if err != nil {
+			log.Println("Failed to fetch post tags:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			ID             string
+			Title          string
+			Content        string
+			Attachments    []Attachment
+			MaxAttachments int
+			Tags           []Tag
+			SelectedTags   map[int]bool
+		}{
+			ID:             postID,
+			Title:          title,
+			Content:        content,
+			Attachments:    attachments,
+			MaxAttachments: maxAttachments,
+			Tags:           tags,
+			SelectedTags:   selected,
+		}
+		templates.ExecuteTemplate(w, "edit_post.html", data)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadRequest)
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	newTitle := strings.TrimSpace(r.FormValue("title"))
+	newContent := r.FormValue("content")
+	if newTitle == "" || newContent == "" {
+		http.Error(w, "Title and content are required", http.StatusBadRequest)
+		return
+	}
+	if len(newTitle) > maxTitleLength {
+		http.Error(w, "Title is too long", http.StatusBadRequest)
+		return
+	}
+
+	kept, removed, err := editedAttachments(r, attachments)
+	if err != nil {
+		uploadFailed(w, err)
+		return
+	}
+	added, err := attachmentsFromRequest(r)
+	if err != nil {
+		uploadFailed(w, err)
+		return
+	}
+	if len(kept)+len(added) > maxAttachments {
+		discardAttachments(added)
+		http.Error(w, fmt.Sprintf("A post can have at most %d attachments", maxAttachments), http.StatusBadRequest)
+		return
+	}
+
+	// drop freshly uploaded files again if the edit does not go through
+	committed := false
+	defer func() {
+		if !committed {
+			discardAttachments(added)
+		}
+	}()
+
+	oldTags, err := postTagNames(postID)
+	if err != nil {
+		log.Println("Failed to fetch post tags:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("Failed to begin transaction:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// the revision keeps the version being replaced, so the history plus the
+	// current post covers every version
+	_, err = tx.Exec(`INSERT INTO post_revisions (post_id, editor_id, title, content, tags, attachments)
+		VALUES (?, ?, ?, ?, ?, ?)`, postID, userID, title, content, strings.Join(oldTags, ", "), attachmentNames(attachments))
+	if err != nil {
+		log.Println("Failed to save revision:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE posts SET title = ?, content = ?,
+		edited_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		newTitle, newContent, postID)
+	if err != nil {
+		log.Println("Failed to update post:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := strconv.ParseInt(postID, 10, 64)
+	if err := saveAttachmentChanges(tx, id, kept, removed, added); err != nil {
+		log.Println("Failed to update attachments:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err = tx.Exec("DELETE FROM post_tags WHERE post_id = ?", postID); err != nil {
+		log.Println("Failed to clear post tags:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	for _, tagID := range r.Form["tags"] {
+		if _, err = tx.Exec("INSERT INTO post_tags (post_id, tag_id) SELECT ?, id FROM tags WHERE id = ? AND status = 'approved'", postID, tagID); err != nil {
+			log.Printf("Failed to insert tag %s for post %s: %v", tagID, postID, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// only people who were not mentioned before hear about the edit
+	mentioned, err := saveMentions(tx, "post", id, userID, newContent)
+	if err != nil {
+		log.Println("Failed to save mentions:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Println("Failed to commit transaction:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	committed = true
+	promoteAttachments(added)
+	removeAttachmentFiles(removed)
+	notifyMentions(mentioned, userID, "/post?id="+postID, newContent)
+
+	http.Redirect(w, r, "/homepage", http.StatusSeeOther)
+}
+
+// DeletePost removes a post together with its comments, reactions, tags,
+// revisions and attachments. Authors and moderators may delete.
+func DeletePost(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	postID := r.FormValue("post_id")
+
+	var authorID int
+	err = db.QueryRow("SELECT user_id FROM posts WHERE id = ?", postID).Scan(&authorID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to load post: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if authorID != userID && !isModerator(userID) {
+		http.Error(w, "You can only delete your own posts", http.StatusForbidden)
+		return
+	}
+
+	// every file attached to the post, and the images older revisions kept,
+	// removed below unless other posts use them too
+	rows, err := db.Query(`
+		SELECT path FROM attachments WHERE post_id = ?
+		UNION
+		SELECT image_path FROM post_revisions WHERE post_id = ? AND image_path IS NOT NULL`, postID, postID)
+	if err != nil {
+		log.Printf("Failed to load post files: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	var files []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err == nil {
+			files = append(files, path)
+		}
+	}
+	rows.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("Failed to begin transaction:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	cleanup := []string{
+		"DELETE FROM comment_reactions WHERE comment_id IN (SELECT id FROM comments WHERE post_id = ?)",
+		"DELETE FROM mentions WHERE kind = 'comment' AND source_id IN (SELECT id FROM comments WHERE post_id = ?)",
+		"DELETE FROM comment_revisions WHERE comment_id IN (SELECT id FROM comments WHERE post_id = ?)",
+		"DELETE FROM comments WHERE post_id = ?",
+		"DELETE FROM post_reactions WHERE post_id = ?",
+		"DELETE FROM bookmarks WHERE post_id = ?",
+		"DELETE FROM poll_votes WHERE poll_id IN (SELECT id FROM polls WHERE post_id = ?)",
+		"DELETE FROM poll_ballots WHERE poll_id IN (SELECT id FROM polls WHERE post_id = ?)",
+		"DELETE FROM poll_options WHERE poll_id IN (SELECT id FROM polls WHERE post_id = ?)",
+		"DELETE FROM polls WHERE post_id = ?",
+		"DELETE FROM post_tags WHERE post_id = ?",
+		"DELETE FROM post_revisions WHERE post_id = ?",
+		"DELETE FROM attachments WHERE post_id = ?",
+		"DELETE FROM mentions WHERE kind = 'post' AND source_id = ?",
+		"DELETE FROM posts WHERE id = ?",
+	}
+	for _, query := range cleanup {
+		if _, err := tx.Exec(query, postID); err != nil {
+			log.Printf("Failed to delete post %s: %v", postID, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Println("Failed to commit transaction:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	removeUploads(files)
+
+	http.Redirect(w, r, "/homepage", http.StatusSeeOther)
+}
+
+// ViewPost renders the permalink page of a single post
+func ViewPost(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+
+	post, err := getPost(r.URL.Query().Get("id"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to load post: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := loadFirstCommentPage(&post, r.URL.Query().Get("comments")); err != nil {
+		log.Printf("Failed to load comments: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	posts := []Post{post}
+	if err := setViewer(posts, userID); err != nil {
+		log.Println("Failed to load post for viewer:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	post = posts[0]
+
+	templates.ExecuteTemplate(w, "post.html", post)
+}
+
+// PostAPI returns a single post as JSON, with the first page of comments
+// sorted by ?comments=
+func PostAPI(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	post, err := getPost(r.URL.Query().Get("id"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to load post: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := loadFirstCommentPage(&post, r.URL.Query().Get("comments")); err != nil {
+		log.Printf("Failed to load comments: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	posts := []Post{post}
+	if err := setViewer(posts, userID); err != nil {
+		log.Println("Failed to load post for viewer:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	post = posts[0]
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(post)
+}
+
+// setViewer fills in everything about the posts that depends on the viewing
+// user, with one query per kind of data for the whole page
+func setViewer(posts []Post, userID int) error {
+	moderator := isModerator(userID)
+	for i := range posts {
+		setPermissions(&posts[i], userID, moderator)
+		setCommentPermissions(posts[i].Comments, userID, moderator)
+	}
+	if err := loadPollVotes(posts, userID); err != nil {
+		return err
+	}
+	if err := loadViewerReactions(posts, userID); err != nil {
+		return err
+	}
+	return loadBookmarks(posts, userID)
+}
+
+// setPermissions fills in what the viewing user may do with a post
+func setPermissions(post *Post, userID int, moderator bool) {
+	post.CanEdit = post.UserID == userID
+	post.CanDelete = post.CanEdit || moderator
+	post.CanViewHistory = moderator && !post.EditedAt.IsZero()
+}
+
+// PostRevisions lets moderators browse every version of a post, each diffed
+// against the version that replaced it.
+func PostRevisions(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+	if !isModerator(userID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	postID := r.URL.Query().Get("id")
+
+	var current Revision
+	var editedAt sql.NullTime
+	err = db.QueryRow(`
+		SELECT users.username, posts.title, posts.content, posts.edited_at
+		FROM posts JOIN users ON posts.user_id = users.id
+		WHERE posts.id = ?`, postID).Scan(&current.Editor, &current.Title, &current.Content, &editedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to load post: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	current.CreatedAt = editedAt.Time
+	tags, err := postTagNames(postID)
+	if err != nil {
+		log.Println("Failed to fetch post tags:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	current.Tags = strings.Join(tags, ", ")
+	attachments, err := loadAttachments(db, "post_id", postID)
+	if err != nil {
+		log.Println("Failed to fetch attachments:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	current.Attachments = attachmentNames(attachments)
+
+	rows, err := db.Query(`
+		SELECT post_revisions.id, users.username, post_revisions.title, post_revisions.content, post_revisions.tags,
+		       post_revisions.image_path, post_revisions.attachments, post_revisions.created_at
+		FROM post_revisions JOIN users ON post_revisions.editor_id = users.id
+		WHERE post_revisions.post_id = ?
+		ORDER BY post_revisions.id ASC`, postID)
+	if err != nil {
+		log.Printf("Failed to load revisions: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var revisions []Revision
+	for rows.Next() {
+		var rev Revision
+		var revTitle, revTags, revImage, revAttachments sql.NullString
+		if err := rows.Scan(&rev.ID, &rev.Editor, &revTitle, &rev.Content, &revTags, &revImage, &revAttachments,
+			&rev.CreatedAt); err != nil {
+			log.Printf("Error scanning revision: %v", err)
+			continue
+		}
+		rev.Title = revTitle.String
+		rev.Tags = revTags.String
+		rev.ImagePath = revImage.String
+		rev.Attachments = revAttachments.String
+		revisions = append(revisions, rev)
+	}
+
+	// diff every version against its successor, the last one against the live post
+	for i := range revisions {
+		next := current
+		if i+1 < len(revisions) {
+			next = revisions[i+1]
+		}
+		revisions[i].Diff = diffLines(revisions[i].Content, next.Content)
+	}
+
+	data := struct {
+		PostID    string
+		Current   Revision
+		Revisions []Revision
+	}{
+		PostID:    postID,
+		Current:   current,
+		Revisions: revisions,
+	}
+	templates.ExecuteTemplate(w, "revisions.html", data)
+}
+
+func postTagIDs(postID string) (map[int]bool, error) {
+	rows, err := db.Query("SELECT tag_id FROM post_tags WHERE post_id = ?", postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+func postTagNames(postID string) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT tags.name FROM post_tags
+		JOIN tags ON post_tags.tag_id = tags.id
+		WHERE post_tags.post_id = ?
+		ORDER BY tags.name`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
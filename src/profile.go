@@ -0,0 +1,80 @@
+package myserver
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// ProfilePage shows a user and their posts, newest first. It is where
+// @mentions link to; without ?user= it shows the current user.
+func ProfilePage(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+
+	var profileID int
+	var username string
+	var nickname, avatar sql.NullString
+	query, args := "SELECT id, username, nickname, avatar FROM users WHERE id = ?", []any{userID}
+	if name := r.URL.Query().Get("user"); name != "" {
+		query, args = "SELECT id, username, nickname, avatar FROM users WHERE username = ?", []any{name}
+	}
+	err = db.QueryRow(query, args...).Scan(&profileID, &username, &nickname, &avatar)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Failed to load user:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	feedQuery := FeedQuery{Author: profileID, Viewer: userID, Cursor: r.URL.Query().Get("cursor")}
+	page, err := getFeed(feedQuery)
+	if err == errBadCursor {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Println("Failed to fetch posts:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := setViewer(page.Posts, userID); err != nil {
+		log.Println("Failed to load posts for viewer:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	var postCount int
+	if err := db.QueryRow("SELECT COUNT(*) FROM posts WHERE user_id = ?", profileID).Scan(&postCount); err != nil {
+		log.Println("Failed to count posts:", err)
+	}
+
+	data := struct {
+		Username   string
+		Nickname   string
+		Avatar     string
+		Initials   string
+		Own        bool
+		PostCount  int
+		Posts      []Post
+		NextCursor string
+		NextPage   string
+	}{
+		Username:   username,
+		Nickname:   nickname.String,
+		Avatar:     avatarURL(avatar.String, 128),
+		Initials:   initials(username),
+		Own:        profileID == userID,
+		PostCount:  postCount,
+		Posts:      page.Posts,
+		NextCursor: page.NextCursor,
+		NextPage:   "/profile?user=" + url.QueryEscape(username) + "&cursor=" + page.NextCursor,
+	}
+
+	templates.ExecuteTemplate(w, "profile.html", data)
+}
@@ -0,0 +1,148 @@
+package myserver
+
+import (
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Hot ranking follows the well known log-plus-age formula: every tenfold
+// increase in points is worth hotHalfLife seconds of freshness. The score only
+// depends on the points and the creation time, never on the current time, so
+// it is stored and only recomputed when a post's likes or comments change.
+const (
+	hotEpoch    = 1704067200 // 2024-01-01, keeps the scores small
+	hotHalfLife = 45000      // seconds, 12.5 hours
+)
+
+func hotScore(likes, comments int, createdAt time.Time) float64 {
+	points := float64(likes + comments)
+	return math.Log10(max(points, 1)) + float64(createdAt.Unix()-hotEpoch)/hotHalfLife
+}
+
+// refreshHotScore recomputes a post's hot score from the like and comment
+// counters, which triggers keep up to date. SQLite has no log10, so this runs
+// after every write that changes a counter.
+func refreshHotScore(postID any) error {
+	var likes, comments int
+	var createdAt time.Time
+	err := db.QueryRow("SELECT like_count, comment_count, created_at FROM posts WHERE id = ?", postID).
+		Scan(&likes, &comments, &createdAt)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE posts SET hot_score = ? WHERE id = ?", hotScore(likes, comments, createdAt), postID)
+	return err
+}
+
+// feedSort describes one feed order. Pages are keyed on (column, id), both
+// descending, and key extracts the column's value from the last post of a page.
+type feedSort struct {
+	label  string
+	column string
+	key    func(Post) string
+	parse  func(string) (any, error)
+}
+
+var feedSorts = map[string]feedSort{
+	"new": {
+		label:  "New",
+		column: "posts.created_at",
+		key:    func(p Post) string { return p.CreatedAt.UTC().Format(sqliteTimeLayout) },
+		parse: func(s string) (any, error) {
+			_, err := time.Parse(sqliteTimeLayout, s)
+			return s, err
+		},
+	},
+	"hot": {
+		label:  "Hot",
+		column: "posts.hot_score",
+		key:    func(p Post) string { return strconv.FormatFloat(p.HotScore, 'g', -1, 64) },
+		parse:  func(s string) (any, error) { return strconv.ParseFloat(s, 64) },
+	},
+	"top": {
+		label:  "Top",
+		column: "posts.like_count",
+		key:    func(p Post) string { return strconv.Itoa(p.Likes) },
+		parse:  func(s string) (any, error) { return strconv.Atoi(s) },
+	},
+	"discussed": {
+		label:  "Most discussed",
+		column: "posts.comment_count",
+		key:    func(p Post) string { return strconv.Itoa(p.CommentCount) },
+		parse:  func(s string) (any, error) { return strconv.Atoi(s) },
+	},
+}
+
+// sortOrder lists the sorts in the order the feed shows them
+var sortOrder = []string{"new", "hot", "top", "discussed"}
+
+// topWindows limit "top" to recent posts
+var topWindows = []struct {
+	name, label string
+	span        time.Duration
+}{
+	{"day", "Today", 24 * time.Hour},
+	{"week", "This week", 7 * 24 * time.Hour},
+	{"all", "All time", 0},
+}
+
+func topWindow(name string) (time.Duration, bool) {
+	for _, window := range topWindows {
+		if window.name == name {
+			return window.span, true
+		}
+	}
+	return 0, false
+}
+
+// SortLink is one entry of the sort bar above the feed
+type SortLink struct {
+	Label  string
+	URL    string
+	Active bool
+}
+
+// sortLinks builds the sort bar, keeping the current tag filter
+func sortLinks(q FeedQuery) (sorts, windows []SortLink) {
+	link := func(sort, window string) string {
+		params := q.Params()
+		params.Del("limit")
+		params.Del("sort")
+		params.Del("t")
+		if sort != "new" {
+			params.Set("sort", sort)
+		}
+		if window != "" && window != "all" {
+			params.Set("t", window)
+		}
+		return "/homepage?" + params.Encode()
+	}
+
+	for _, name := range sortOrder {
+		sorts = append(sorts, SortLink{Label: feedSorts[name].label, URL: link(name, ""), Active: q.Sort == name})
+	}
+	if q.Sort == "top" {
+		for _, window := range topWindows {
+			windows = append(windows, SortLink{Label: window.label, URL: link("top", window.name), Active: q.Window == window.name})
+		}
+	}
+	return sorts, windows
+}
+
+// validSort normalises the sort and window read from a query string
+func validSort(values url.Values) (string, string) {
+	sort := values.Get("sort")
+	if _, ok := feedSorts[sort]; !ok {
+		sort = "new"
+	}
+	window := ""
+	if sort == "top" {
+		window = values.Get("t")
+		if _, ok := topWindow(window); !ok {
+			window = "all"
+		}
+	}
+	return sort, window
+}
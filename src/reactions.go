@@ -0,0 +1,457 @@
+package myserver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxReactionRunes leaves room for emoji built from several code points,
+// such as flags, skin tones and ZWJ sequences
+const maxReactionRunes = 8
+
+// defaultReactions are created on a fresh database; admins can add custom
+// ones. The first one is what a like used to be.
+var defaultReactions = []string{"👍", "❤️", "😂", "😮", "😢"}
+
+// reactionTargets maps what can be reacted to onto the table holding the
+// reactions and the column naming the target
+var reactionTargets = map[string][2]string{
+	"post":    {"post_reactions", "post_id"},
+	"comment": {"comment_reactions", "comment_id"},
+}
+
+var (
+	errUnknownReaction = errors.New("unknown reaction")
+	errReactionTarget  = errors.New("post or comment not found")
+)
+
+// reactionSet caches the reactions users can pick from, in order. It is
+// rendered with every post and comment and only changes when an admin edits
+// it.
+var reactionSet struct {
+	sync.RWMutex
+	emojis []string
+}
+
+// availableReactions returns the reaction set, loading it on first use
+func availableReactions() []string {
+	reactionSet.RLock()
+	emojis := reactionSet.emojis
+	reactionSet.RUnlock()
+	if emojis != nil {
+		return emojis
+	}
+
+	rows, err := db.Query("SELECT emoji FROM reaction_types ORDER BY position, emoji")
+	if err != nil {
+		log.Println("Failed to load reactions:", err)
+		return defaultReactions
+	}
+	defer rows.Close()
+
+	emojis = []string{}
+	for rows.Next() {
+		var emoji string
+		if err := rows.Scan(&emoji); err != nil {
+			log.Println("Failed to load reactions:", err)
+			return defaultReactions
+		}
+		emojis = append(emojis, emoji)
+	}
+
+	reactionSet.Lock()
+	reactionSet.emojis = emojis
+	reactionSet.Unlock()
+	return emojis
+}
+
+func isAvailableReaction(emoji string) bool {
+	for _, available := range availableReactions() {
+		if emoji == available {
+			return true
+		}
+	}
+	return false
+}
+
+// seedReactionTypes fills the reaction set on a fresh database only, so
+// the defaults an admin removed stay removed
+func seedReactionTypes(database *sql.DB) error {
+	var count int
+	if err := database.QueryRow("SELECT COUNT(*) FROM reaction_types").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	for i, emoji := range defaultReactions {
+		if _, err := database.Exec("INSERT INTO reaction_types (emoji, position) VALUES (?, ?)", emoji, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reactionProblem checks a custom reaction. It has to look like an emoji:
+// a few non-ASCII symbols, without spaces.
+func reactionProblem(emoji string) string {
+	if emoji == "" {
+		return "Reaction is required"
+	}
+	if !utf8.ValidString(emoji) || utf8.RuneCountInString(emoji) > maxReactionRunes {
+		return "Reaction must be a single emoji"
+	}
+	for _, r := range emoji {
+		if r < utf8.RuneSelf || unicode.IsSpace(r) || !unicode.IsGraphic(r) && r != '\u200d' {
+			return "Reaction must be a single emoji"
+		}
+	}
+	return ""
+}
+
+// loadReactionCounts returns the reactions of each target in the order of
+// the reaction set, emoji that have since left the set last
+func loadReactionCounts(kind string, ids []any) (map[int][]Reaction, error) {
+	target := reactionTargets[kind]
+	rows, err := db.Query(`
+		SELECT r.`+target[1]+`, r.emoji, COUNT(*)
+		FROM `+target[0]+` r
+		LEFT JOIN reaction_types ON reaction_types.emoji = r.emoji
+		WHERE r.`+target[1]+` IN (`+placeholders(len(ids))+`)
+		GROUP BY r.`+target[1]+`, r.emoji
+		ORDER BY COALESCE(reaction_types.position, 1000000), MIN(r.created_at)`, ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[int][]Reaction{}
+	for rows.Next() {
+		var id int
+		var reaction Reaction
+		if err := rows.Scan(&id, &reaction.Emoji, &reaction.Count); err != nil {
+			return nil, err
+		}
+		counts[id] = append(counts[id], reaction)
+	}
+	return counts, rows.Err()
+}
+
+// loadOwnReactions returns which reactions the user left on each target
+func loadOwnReactions(kind string, ids []any, userID int) (map[int]map[string]bool, error) {
+	target := reactionTargets[kind]
+	rows, err := db.Query("SELECT "+target[1]+", emoji FROM "+target[0]+" WHERE user_id = ? AND "+
+		target[1]+" IN ("+placeholders(len(ids))+")", append([]any{userID}, ids...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	own := map[int]map[string]bool{}
+	for rows.Next() {
+		var id int
+		var emoji string
+		if err := rows.Scan(&id, &emoji); err != nil {
+			return nil, err
+		}
+		if own[id] == nil {
+			own[id] = map[string]bool{}
+		}
+		own[id][emoji] = true
+	}
+	return own, rows.Err()
+}
+
+// loadPostReactions fills in the reaction counts of a page of posts and of
+// their comments
+func loadPostReactions(byID map[int]*Post, ids []any) error {
+	counts, err := loadReactionCounts("post", ids)
+	if err != nil {
+		return err
+	}
+	for id, reactions := range counts {
+		byID[id].Reactions = reactions
+	}
+	return loadCommentReactions(postComments(byID))
+}
+
+// loadViewerReactions marks the reactions the viewing user left on the
+// posts and their comments
+func loadViewerReactions(posts []Post, userID int) error {
+	if len(posts) == 0 {
+		return nil
+	}
+	byID := make(map[int]*Post, len(posts))
+	ids := make([]any, len(posts))
+	for i := range posts {
+		byID[posts[i].ID] = &posts[i]
+		ids[i] = posts[i].ID
+	}
+
+	own, err := loadOwnReactions("post", ids, userID)
+	if err != nil {
+		return err
+	}
+	for id, emojis := range own {
+		markReacted(byID[id].Reactions, emojis)
+	}
+
+	comments, commentIDs := postComments(byID)
+	return loadViewerCommentReactions(comments, commentIDs, userID)
+}
+
+// loadCommentReactions fills in the reaction counts of indexed comments
+func loadCommentReactions(comments map[int]*Comment, ids []any) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	counts, err := loadReactionCounts("comment", ids)
+	if err != nil {
+		return err
+	}
+	for id, reactions := range counts {
+		comments[id].Reactions = reactions
+	}
+	return nil
+}
+
+// loadViewerCommentReactions marks the reactions the viewing user left on
+// indexed comments
+func loadViewerCommentReactions(comments map[int]*Comment, ids []any, userID int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	own, err := loadOwnReactions("comment", ids, userID)
+	if err != nil {
+		return err
+	}
+	for id, emojis := range own {
+		markReacted(comments[id].Reactions, emojis)
+	}
+	return nil
+}
+
+// postComments indexes the comments of the posts by id, replies included
+func postComments(byID map[int]*Post) (map[int]*Comment, []any) {
+	comments := map[int]*Comment{}
+	var ids []any
+	for _, post := range byID {
+		indexComments(post.Comments, comments, &ids)
+	}
+	return comments, ids
+}
+
+// indexComments adds a thread's comments to index and ids
+func indexComments(thread []Comment, index map[int]*Comment, ids *[]any) {
+	walkComments(thread, func(comment *Comment) {
+		index[comment.ID] = comment
+		*ids = append(*ids, comment.ID)
+	})
+}
+
+func markReacted(reactions []Reaction, emojis map[string]bool) {
+	for i := range reactions {
+		reactions[i].Reacted = emojis[reactions[i].Emoji]
+	}
+}
+
+// reactionSummary loads the reactions of one post or comment, as seen by
+// the user
+func reactionSummary(kind string, id, userID int) (ReactionSummary, error) {
+	summary := ReactionSummary{Type: "reactions", Reactions: []Reaction{}}
+	if kind == "post" {
+		summary.PostID = id
+	} else {
+		summary.CommentID = id
+	}
+
+	counts, err := loadReactionCounts(kind, []any{id})
+	if err != nil {
+		return summary, err
+	}
+	own, err := loadOwnReactions(kind, []any{id}, userID)
+	if err != nil {
+		return summary, err
+	}
+	if counts[id] != nil {
+		summary.Reactions = counts[id]
+	}
+	markReacted(summary.Reactions, own[id])
+	return summary, nil
+}
+
+// setReaction adds or removes the user's reaction and reports whether
+// anything changed. Post reactions feed the like counter through a
+// trigger, so the hot score is refreshed with them.
+func setReaction(kind string, id, userID int, emoji string, add bool) (bool, error) {
+	target := reactionTargets[kind]
+	var result sql.Result
+	var err error
+	if add {
+		if !isAvailableReaction(emoji) {
+			return false, errUnknownReaction
+		}
+		table := "posts"
+		if kind == "comment" {
+			table = "comments"
+		}
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM "+table+" WHERE id = ?)", id).Scan(&exists); err != nil {
+			return false, err
+		}
+		if !exists {
+			return false, errReactionTarget
+		}
+		result, err = db.Exec("INSERT OR IGNORE INTO "+target[0]+" ("+target[1]+", user_id, emoji) VALUES (?, ?, ?)",
+			id, userID, emoji)
+	} else {
+		result, err = db.Exec("DELETE FROM "+target[0]+" WHERE "+target[1]+" = ? AND user_id = ? AND emoji = ?",
+			id, userID, emoji)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	n, _ := result.RowsAffected()
+	if n > 0 && kind == "post" {
+		if err := refreshHotScore(id); err != nil {
+			log.Printf("Failed to score post %d: %v", id, err)
+		}
+	}
+	return n > 0, nil
+}
+
+// broadcastReactions sends the new counts to every open page. Whether the
+// receiving user reacted is left out; pages keep track of their own.
+func broadcastReactions(summary ReactionSummary) {
+	reactions := make([]Reaction, len(summary.Reactions))
+	for i, reaction := range summary.Reactions {
+		reactions[i] = Reaction{Emoji: reaction.Emoji, Count: reaction.Count}
+	}
+	summary.Reactions = reactions
+
+	message, err := json.Marshal(summary)
+	if err != nil {
+		log.Println("Failed to encode reactions:", err)
+		return
+	}
+	manager.broadcast <- message
+}
+
+// ReactionsAPI returns the reactions of a post or comment (GET), adds one of
+// the user's (PUT) or takes it back (DELETE). The target is given as post_id
+// or comment_id, the reaction as emoji. Adding and removing are idempotent
+// and answer with the updated counts; PUT answers 201 when it added the
+// reaction.
+func ReactionsAPI(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	kind, value := "post", r.FormValue("post_id")
+	if value == "" {
+		kind, value = "comment", r.FormValue("comment_id")
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		http.Error(w, "Post or comment not found", http.StatusNotFound)
+		return
+	}
+
+	status, changed := http.StatusOK, false
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodDelete:
+		changed, err = setReaction(kind, id, userID, r.FormValue("emoji"), r.Method == http.MethodPut)
+		switch {
+		case errors.Is(err, errUnknownReaction):
+			http.Error(w, "Unknown reaction", http.StatusBadRequest)
+			return
+		case errors.Is(err, errReactionTarget):
+			http.Error(w, "Post or comment not found", http.StatusNotFound)
+			return
+		case err != nil:
+			log.Println("Failed to save reaction:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if changed && r.Method == http.MethodPut {
+			status = http.StatusCreated
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	summary, err := reactionSummary(kind, id, userID)
+	if err != nil {
+		log.Println("Failed to load reactions:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, status, summary)
+	if changed {
+		broadcastReactions(summary)
+	}
+}
+
+// ReactionTypesAPI lists the reaction set (GET). Admins add a custom
+// reaction at the end of it (POST emoji) or remove one (DELETE ?emoji=);
+// reactions already left with a removed emoji stay until taken back.
+func ReactionTypesAPI(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet && !isAdmin(userID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	emoji := r.FormValue("emoji")
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if problem := reactionProblem(emoji); problem != "" {
+			http.Error(w, problem, http.StatusBadRequest)
+			return
+		}
+		result, err := db.Exec(`INSERT OR IGNORE INTO reaction_types (emoji, position)
+			VALUES (?, (SELECT COALESCE(MAX(position), -1) + 1 FROM reaction_types))`, emoji)
+		if err != nil {
+			log.Println("Failed to add reaction:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			status = http.StatusCreated
+		}
+	case http.MethodDelete:
+		if _, err := db.Exec("DELETE FROM reaction_types WHERE emoji = ?", emoji); err != nil {
+			log.Println("Failed to remove reaction:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		reactionSet.Lock()
+		reactionSet.emojis = nil
+		reactionSet.Unlock()
+	}
+	writeJSON(w, status, availableReactions())
+}
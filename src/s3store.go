@@ -0,0 +1,422 @@
+package myserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Store keeps blobs in a bucket of an S3 compatible service such as AWS
+// S3 or MinIO. Requests are signed with AWS Signature Version 4 and use
+// path style URLs, which every implementation supports.
+type S3Store struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// s3TimeLayout is the ISO 8601 basic format signatures are dated in
+const s3TimeLayout = "20060102T150405Z"
+
+// maxS3URLExpiry is the longest a presigned URL may last
+const maxS3URLExpiry = 7 * 24 * time.Hour
+
+// NewS3Store connects to a bucket, creating it when it does not exist yet
+func NewS3Store(endpoint, region, bucket, accessKey, secretKey string) (*S3Store, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("S3_ENDPOINT must be an http or https URL, got %q", endpoint)
+	}
+	if bucket == "" || accessKey == "" || secretKey == "" {
+		return nil, errors.New("S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required")
+	}
+	s := &S3Store{
+		endpoint:  u,
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+
+	resp, err := s.do(http.MethodHead, "", nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("reach bucket %s: %w", bucket, err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return s, nil
+	case http.StatusNotFound:
+		resp, err := s.do(http.MethodPut, "", nil, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("create bucket %s: %w", bucket, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("create bucket %s: %w", bucket, s3Error(resp))
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("reach bucket %s: %w", bucket, s3Error(resp))
+	}
+}
+
+// Put uploads with If-None-Match, so the service refuses to overwrite an
+// existing object. The type and disposition the uploads handler would
+// send are stored with the object for when it is fetched directly.
+func (s *S3Store) Put(key string, data []byte) error {
+	if !validBlobKey(key) {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	mimeType := uploadContentType(key)
+	header := http.Header{
+		"Content-Type":           {mimeType},
+		"Content-Disposition":    {uploadDisposition(mimeType)},
+		"X-Content-Type-Options": {"nosniff"},
+		"If-None-Match":          {"*"},
+	}
+	resp, err := s.do(http.MethodPut, key, nil, header, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed:
+		return errBlobExists
+	default:
+		return fmt.Errorf("put %s: %w", key, s3Error(resp))
+	}
+}
+
+// Open only looks the object up. Its content is fetched when it is read,
+// from the offset it was seeked to, so range requests only download the
+// part that was asked for.
+func (s *S3Store) Open(key string) (*Blob, error) {
+	if !validBlobKey(key) {
+		return nil, errBlobNotFound
+	}
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		object := &s3Object{store: s, key: key, size: resp.ContentLength}
+		return &Blob{ReadSeekCloser: object, Size: resp.ContentLength, ModTime: modTime}, nil
+	case http.StatusNotFound:
+		return nil, errBlobNotFound
+	default:
+		return nil, fmt.Errorf("head %s: %w", key, s3Error(resp))
+	}
+}
+
+// s3Object reads an object with ranged GETs. A seek only moves the offset;
+// the next read drops the response it was reading if that is somewhere
+// else and asks for the rest of the object from the offset.
+type s3Object struct {
+	store      *S3Store
+	key        string
+	size       int64
+	offset     int64
+	body       io.ReadCloser
+	bodyOffset int64 // where body continues
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.body != nil && o.bodyOffset != o.offset {
+		o.body.Close()
+		o.body = nil
+	}
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.offset)}}
+		resp, err := o.store.do(http.MethodGet, o.key, nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && (resp.StatusCode != http.StatusOK || o.offset != 0) {
+			defer resp.Body.Close()
+			return 0, fmt.Errorf("get %s: %w", o.key, s3Error(resp))
+		}
+		o.body, o.bodyOffset = resp.Body, o.offset
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	o.bodyOffset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek %s: negative offset", o.key)
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	return o.body.Close()
+}
+
+func (s *S3Store) Delete(key string) error {
+	if !validBlobKey(key) {
+		return nil
+	}
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return fmt.Errorf("delete %s: %w", key, s3Error(resp))
+	}
+}
+
+// Move copies the object, which keeps its type and disposition, and then
+// deletes the original. S3 has no rename.
+func (s *S3Store) Move(from, to string) error {
+	if !validBlobKey(from) || !validBlobKey(to) {
+		return fmt.Errorf("invalid key %q or %q", from, to)
+	}
+	header := http.Header{"X-Amz-Copy-Source": {s3Escape(s.bucket+"/"+from, false)}}
+	resp, err := s.do(http.MethodPut, to, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return errBlobNotFound
+	default:
+		return fmt.Errorf("copy %s to %s: %w", from, to, s3Error(resp))
+	}
+	// a copy can fail after the status was sent, reporting it in the body
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if bytes.Contains(body, []byte("<Error>")) {
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return fmt.Errorf("copy %s to %s: %w", from, to, s3Error(resp))
+	}
+	return s.Delete(from)
+}
+
+// s3ListResult is the part of a ListObjectsV2 response that List reads
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+}
+
+func (s *S3Store) List(prefix string) ([]BlobInfo, error) {
+	var list []BlobInfo
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return nil, fmt.Errorf("list %s: %w", prefix, s3Error(resp))
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", prefix, err)
+		}
+
+		for _, object := range result.Contents {
+			list = append(list, BlobInfo{Key: object.Key, Size: object.Size, ModTime: object.LastModified})
+		}
+		if !result.IsTruncated {
+			return list, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// SignedURL presigns a GET of the object, so browsers fetch it from the
+// bucket directly
+func (s *S3Store) SignedURL(key string, expires time.Duration) (string, error) {
+	if !validBlobKey(key) {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	expires = min(expires, maxS3URLExpiry)
+	signedAt := signingTime(expires)
+
+	u := s.objectURL(key)
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.accessKey + "/" + s.scope(signedAt)},
+		"X-Amz-Date":          {signedAt.Format(s3TimeLayout)},
+		"X-Amz-Expires":       {strconv.Itoa(int(expires.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	u.RawQuery = canonicalQuery(query)
+	request := canonicalRequest(http.MethodGet, u, http.Header{}, []string{"host"}, "UNSIGNED-PAYLOAD")
+	u.RawQuery += "&X-Amz-Signature=" + s.signature(signedAt, request)
+	return u.String(), nil
+}
+
+// do sends a signed request for an object, or for the bucket when key is ""
+func (s *S3Store) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := s.objectURL(key)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+func (s *S3Store) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	return &u
+}
+
+// sign adds the Authorization header of Signature Version 4. Every header
+// set so far is signed; the ones the transport adds later are not.
+func (s *S3Store) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeLayout))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	signed := []string{"host"}
+	for name := range req.Header {
+		signed = append(signed, strings.ToLower(name))
+	}
+	sort.Strings(signed)
+
+	request := canonicalRequest(req.Method, req.URL, req.Header, signed, hex.EncodeToString(payloadHash[:]))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, s.scope(now), strings.Join(signed, ";"), s.signature(now, request)))
+}
+
+func (s *S3Store) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+// signature signs a canonical request with the key derived for its day
+func (s *S3Store) signature(t time.Time, request string) string {
+	hash := sha256.Sum256([]byte(request))
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.Format(s3TimeLayout) + "\n" + s.scope(t) + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{t.Format("20060102"), s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// canonicalRequest lays a request out the way Signature Version 4 hashes
+// it; signed lists the lower case names of the signed headers, sorted
+func canonicalRequest(method string, u *url.URL, header http.Header, signed []string, payloadHash string) string {
+	var headers strings.Builder
+	for _, name := range signed {
+		value := u.Host
+		if name != "host" {
+			value = strings.Join(header.Values(name), ",")
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	return strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		canonicalQuery(u.Query()),
+		headers.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func canonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes everything but unreserved characters, and
+// slashes unless they are part of a query
+func s3Escape(s string, query bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !query:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Error reads the error code S3 answers failed requests with
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	code := "no details"
+	if start := bytes.Index(body, []byte("<Code>")); start >= 0 {
+		if end := bytes.Index(body[start:], []byte("</Code>")); end >= 0 {
+			code = string(body[start+len("<Code>") : start+end])
+		}
+	}
+	return fmt.Errorf("%s (%s)", resp.Status, code)
+}
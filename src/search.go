@@ -0,0 +1,447 @@
+package myserver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const searchPageSize = 20
+
+// searchFTS is set when SQLite was built with FTS5, see fts5Compiled.
+// Without it search falls back to LIKE matching ordered by recency.
+var searchFTS bool
+
+// searchIndexVersion is bumped whenever searchSchema changes how posts and
+// comments are indexed, which rebuilds the indexes on the next start
+const searchIndexVersion = 1
+
+// snippet markers, swapped for <mark> after the text has been escaped
+const (
+	markOpen  = "\x02"
+	markClose = "\x03"
+)
+
+var searchSchema = `
+CREATE VIRTUAL TABLE IF NOT EXISTS posts_fts USING fts5(
+    title, content, content='posts', content_rowid='id', tokenize='unicode61 remove_diacritics 2'
+);
+CREATE VIRTUAL TABLE IF NOT EXISTS comments_fts USING fts5(
+    content, content='comments', content_rowid='id', tokenize='unicode61 remove_diacritics 2'
+);
+
+CREATE TRIGGER IF NOT EXISTS posts_fts_insert AFTER INSERT ON posts BEGIN
+    INSERT INTO posts_fts(rowid, title, content) VALUES (new.id, new.title, new.content);
+END;
+CREATE TRIGGER IF NOT EXISTS posts_fts_delete AFTER DELETE ON posts BEGIN
+    INSERT INTO posts_fts(posts_fts, rowid, title, content) VALUES ('delete', old.id, old.title, old.content);
+END;
+CREATE TRIGGER IF NOT EXISTS posts_fts_update AFTER UPDATE OF title, content ON posts BEGIN
+    INSERT INTO posts_fts(posts_fts, rowid, title, content) VALUES ('delete', old.id, old.title, old.content);
+    INSERT INTO posts_fts(rowid, title, content) VALUES (new.id, new.title, new.content);
+END;
+
+CREATE TRIGGER IF NOT EXISTS comments_fts_insert AFTER INSERT ON comments BEGIN
+    INSERT INTO comments_fts(rowid, content) VALUES (new.id, new.content);
+END;
+CREATE TRIGGER IF NOT EXISTS comments_fts_delete AFTER DELETE ON comments BEGIN
+    INSERT INTO comments_fts(comments_fts, rowid, content) VALUES ('delete', old.id, old.content);
+END;
+CREATE TRIGGER IF NOT EXISTS comments_fts_update AFTER UPDATE OF content ON comments BEGIN
+    INSERT INTO comments_fts(comments_fts, rowid, content) VALUES ('delete', old.id, old.content);
+    INSERT INTO comments_fts(rowid, content) VALUES (new.id, new.content);
+END;`
+
+const searchRebuild = `
+INSERT INTO posts_fts(posts_fts) VALUES ('rebuild');
+INSERT INTO comments_fts(comments_fts) VALUES ('rebuild');`
+
+// searchTriggers keep the FTS indexes in sync
+var searchTriggers = []string{
+	"posts_fts_insert", "posts_fts_delete", "posts_fts_update",
+	"comments_fts_insert", "comments_fts_delete", "comments_fts_update",
+}
+
+// dropSearchTriggers removes the FTS sync triggers when SQLite lacks FTS5.
+// Migrate runs it first: any statement touching posts or comments would
+// otherwise fail to compile the triggers. InitSearch puts them back, and
+// rebuilds the indexes, once FTS5 is available again.
+func dropSearchTriggers(database *sql.DB) error {
+	if fts5Available(database) {
+		return nil
+	}
+	for _, trigger := range searchTriggers {
+		if _, err := database.Exec("DROP TRIGGER IF EXISTS " + trigger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fts5Available(database *sql.DB) bool {
+	_, err := database.Exec("CREATE VIRTUAL TABLE temp.fts5_probe USING fts5(x); DROP TABLE temp.fts5_probe;")
+	return err == nil
+}
+
+// InitSearch creates the FTS5 indexes and the triggers keeping them in sync
+// with posts and comments. The indexes are only rebuilt when they are new,
+// when writes may have missed them because the triggers were gone, or when
+// searchIndexVersion changed.
+func InitSearch(database *sql.DB) error {
+	if !fts5Available(database) {
+		problem := "the server was built without -tags sqlite_fts5 (make build adds it)"
+		if fts5Compiled {
+			problem = "the linked SQLite has no FTS5"
+		}
+		log.Printf("Warning: full text search is not available, %s; search falls back to LIKE", problem)
+		searchFTS = false
+		return nil
+	}
+
+	names := make([]any, len(searchTriggers))
+	for i, trigger := range searchTriggers {
+		names[i] = trigger
+	}
+	var existing int
+	err := database.QueryRow(`SELECT COUNT(*) FROM sqlite_master
+		WHERE type = 'trigger' AND name IN (`+placeholders(len(names))+`)`, names...).Scan(&existing)
+	if err != nil {
+		return err
+	}
+	version, err := schemaVersion(database, "search")
+	if err != nil {
+		return err
+	}
+
+	if _, err := database.Exec(searchSchema); err != nil {
+		return err
+	}
+	if existing != len(searchTriggers) || version != searchIndexVersion {
+		log.Println("Rebuilding the search indexes")
+		if _, err := database.Exec(searchRebuild); err != nil {
+			return fmt.Errorf("rebuild search indexes: %w", err)
+		}
+		if err := setSchemaVersion(database, "search", searchIndexVersion); err != nil {
+			return err
+		}
+	}
+	searchFTS = true
+	return nil
+}
+
+// SearchResult is a matching post or comment
+type SearchResult struct {
+	Kind      string        `json:"kind"` // "post" or "comment"
+	PostID    int           `json:"post_id"`
+	CommentID int           `json:"comment_id,omitempty"`
+	Title     string        `json:"title"`
+	Username  string        `json:"username"`
+	Snippet   template.HTML `json:"snippet"`
+	CreatedAt time.Time     `json:"created_at"`
+	Rank      float64       `json:"rank"`
+}
+
+// UserResult is a user whose name matches the query
+type UserResult struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Avatar   string `json:"avatar,omitempty"`
+	Initials string `json:"initials"`
+}
+
+// SearchResults is one page of search results
+type SearchResults struct {
+	Query   string         `json:"query"`
+	Tag     string         `json:"tag,omitempty"`
+	Page    int            `json:"page"`
+	HasMore bool           `json:"has_more"`
+	Results []SearchResult `json:"results"`
+	Users   []UserResult   `json:"users"`
+}
+
+// runSearch searches posts, comments and usernames. Users are only listed on
+// the first page.
+func runSearch(query, tag string, page int) (SearchResults, error) {
+	res := SearchResults{Query: query, Tag: tag, Page: page, Results: []SearchResult{}, Users: []UserResult{}}
+	terms := strings.Fields(query)
+	if len(terms) == 0 {
+		return res, nil
+	}
+
+	var err error
+	if searchFTS {
+		res.Results, err = searchFullText(terms, tag, page)
+	} else {
+		res.Results, err = searchLike(terms, tag, page)
+	}
+	if err != nil {
+		return res, err
+	}
+	if res.Results == nil {
+		res.Results = []SearchResult{}
+	}
+	if len(res.Results) > searchPageSize {
+		res.Results = res.Results[:searchPageSize]
+		res.HasMore = true
+	}
+
+	if page == 1 {
+		res.Users, err = searchUsers(terms[0])
+	}
+	return res, err
+}
+
+// ftsQuery quotes every term so user input cannot inject FTS5 syntax. The
+// last term is a prefix match, which suits search-as-you-type.
+func ftsQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+	}
+	return strings.Join(quoted, " ") + "*"
+}
+
+func searchFullText(terms []string, tag string, page int) ([]SearchResult, error) {
+	match := ftsQuery(terms)
+	tagFilter := ""
+	args := []any{match}
+	if tag != "" {
+		tagFilter = "AND posts.id IN (SELECT post_id FROM post_tags WHERE tag_id = ?)"
+		args = append(args, tag)
+	}
+	args = append(args, match)
+	if tag != "" {
+		args = append(args, tag)
+	}
+	args = append(args, searchPageSize+1, (page-1)*searchPageSize)
+
+	// titles weigh more than bodies; bm25 is lower for better matches
+	rows, err := db.Query(`
+		SELECT 'post', posts.id, 0, posts.title, users.username,
+		       snippet(posts_fts, -1, char(2), char(3), '…', 16), posts.created_at,
+		       bm25(posts_fts, 5.0, 1.0) AS rank
+		FROM posts_fts
+		JOIN posts ON posts.id = posts_fts.rowid
+		JOIN users ON users.id = posts.user_id
+		WHERE posts_fts MATCH ? `+tagFilter+`
+		UNION ALL
+		SELECT 'comment', posts.id, comments.id, posts.title, users.username,
+		       snippet(comments_fts, 0, char(2), char(3), '…', 16), comments.created_at,
+		       bm25(comments_fts) AS rank
+		FROM comments_fts
+		JOIN comments ON comments.id = comments_fts.rowid
+		JOIN posts ON posts.id = comments.post_id
+		JOIN users ON users.id = comments.user_id
+		WHERE comments_fts MATCH ? `+tagFilter+`
+		ORDER BY rank
+		LIMIT ? OFFSET ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var res SearchResult
+		var snippet string
+		if err := rows.Scan(&res.Kind, &res.PostID, &res.CommentID, &res.Title, &res.Username,
+			&snippet, &res.CreatedAt, &res.Rank); err != nil {
+			log.Printf("Error scanning search result: %v", err)
+			continue
+		}
+		res.Snippet = highlight(snippet)
+		results = append(results, res)
+	}
+	return results, rows.Err()
+}
+
+// searchLike is the fallback without FTS5: every term must appear in the
+// title or content, newest first.
+func searchLike(terms []string, tag string, page int) ([]SearchResult, error) {
+	var postConds, commentConds []string
+	var postArgs, commentArgs []any
+	for _, term := range terms {
+		pattern := "%" + escapeLike(term) + "%"
+		postConds = append(postConds, `(posts.title LIKE ? ESCAPE '\' OR posts.content LIKE ? ESCAPE '\')`)
+		postArgs = append(postArgs, pattern, pattern)
+		commentConds = append(commentConds, `comments.content LIKE ? ESCAPE '\'`)
+		commentArgs = append(commentArgs, pattern)
+	}
+	if tag != "" {
+		postConds = append(postConds, "posts.id IN (SELECT post_id FROM post_tags WHERE tag_id = ?)")
+		postArgs = append(postArgs, tag)
+		commentConds = append(commentConds, "posts.id IN (SELECT post_id FROM post_tags WHERE tag_id = ?)")
+		commentArgs = append(commentArgs, tag)
+	}
+
+	args := append(postArgs, commentArgs...)
+	args = append(args, searchPageSize+1, (page-1)*searchPageSize)
+
+	rows, err := db.Query(`
+		SELECT 'post', posts.id, 0, posts.title, users.username, posts.title || ' ' || posts.content, posts.created_at
+		FROM posts JOIN users ON users.id = posts.user_id
+		WHERE `+strings.Join(postConds, " AND ")+`
+		UNION ALL
+		SELECT 'comment', posts.id, comments.id, posts.title, users.username, comments.content, comments.created_at
+		FROM comments
+		JOIN posts ON posts.id = comments.post_id
+		JOIN users ON users.id = comments.user_id
+		WHERE `+strings.Join(commentConds, " AND ")+`
+		ORDER BY 7 DESC
+		LIMIT ? OFFSET ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []SearchResult
+	for rows.Next() {
+		var res SearchResult
+		var text string
+		if err := rows.Scan(&res.Kind, &res.PostID, &res.CommentID, &res.Title, &res.Username, &text, &res.CreatedAt); err != nil {
+			log.Printf("Error scanning search result: %v", err)
+			continue
+		}
+		res.Snippet = highlight(markTerms(text, terms))
+		results = append(results, res)
+	}
+	return results, rows.Err()
+}
+
+func searchUsers(term string) ([]UserResult, error) {
+	rows, err := db.Query(`SELECT id, username, avatar FROM users
+		WHERE username LIKE ? ESCAPE '\' ORDER BY username LIMIT 10`, "%"+escapeLike(term)+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []UserResult{}
+	for rows.Next() {
+		var user UserResult
+		var avatar sql.NullString
+		if err := rows.Scan(&user.ID, &user.Username, &avatar); err != nil {
+			log.Printf("Error scanning user: %v", err)
+			continue
+		}
+		user.Avatar = avatarURL(avatar.String, 32)
+		user.Initials = initials(user.Username)
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// markTerms wraps every occurrence of the terms in snippet markers and trims
+// the text to a window around the first match, like FTS5's snippet().
+func markTerms(text string, terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	re := regexp.MustCompile("(?i)(" + strings.Join(quoted, "|") + ")")
+	marked := re.ReplaceAllString(text, markOpen+"$1"+markClose)
+
+	const window = 80
+	if first := strings.Index(marked, markOpen); first > window {
+		cut := first - window/2
+		for cut > 0 && !utf8.RuneStart(marked[cut]) {
+			cut--
+		}
+		marked = "…" + marked[cut:]
+	}
+	if runes := []rune(marked); len(runes) > 2*window {
+		marked = string(runes[:2*window]) + "…"
+	}
+	return marked
+}
+
+// highlight escapes a snippet and turns its markers into <mark> tags
+func highlight(snippet string) template.HTML {
+	escaped := html.EscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, markOpen, "<mark>")
+	escaped = strings.ReplaceAll(escaped, markClose, "</mark>")
+	// a marker cut off by truncation must not leave an open tag behind
+	if strings.Count(escaped, "<mark>") > strings.Count(escaped, "</mark>") {
+		escaped += "</mark>"
+	}
+	return template.HTML(escaped)
+}
+
+func searchParams(r *http.Request) (string, string, int) {
+	query := r.URL.Query()
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	return strings.TrimSpace(query.Get("q")), query.Get("tag"), page
+}
+
+// Search renders the search page
+func Search(w http.ResponseWriter, r *http.Request) {
+	if _, err := currentUserID(r); err != nil {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+
+	q, tag, page := searchParams(r)
+	results, err := runSearch(q, tag, page)
+	if err != nil {
+		log.Println("Search failed:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	tags, err := getAllTags()
+	if err != nil {
+		log.Println("Failed to fetch tags:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		SearchResults
+		Tags     []Tag
+		NextPage int
+		PrevPage int
+	}{
+		SearchResults: results,
+		Tags:          tags,
+		PrevPage:      page - 1,
+	}
+	if results.HasMore {
+		data.NextPage = page + 1
+	}
+	templates.ExecuteTemplate(w, "search.html", data)
+}
+
+// SearchAPI returns search results as JSON
+func SearchAPI(w http.ResponseWriter, r *http.Request) {
+	if _, err := currentUserID(r); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	q, tag, page := searchParams(r)
+	results, err := runSearch(q, tag, page)
+	if err != nil {
+		log.Println("Search failed:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -2,16 +2,60 @@ package myserver
 
 import (
 	"database/sql"
+	"errors"
+	"html/template"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// initialise database
+// initialise database and templates
 func InitHandlers(database *sql.DB) {
 	db = database
+	templates = template.Must(template.New("").Funcs(templateFuncs).ParseGlob("./templates/*.html"))
+}
+
+// errSessionExpired is returned for a session cookie whose expiry has passed
+var errSessionExpired = errors.New("session expired")
+
+// currentUserID returns the signed in user behind the request's session cookie
+func currentUserID(r *http.Request) (int, error) {
+	cookie, err := r.Cookie("session")
+	if err != nil {
+		return 0, err
+	}
+
+	var userID int
+	var expiry time.Time
+	err = db.QueryRow("SELECT user_id, expiry FROM sessions WHERE session_id = ?", cookie.Value).Scan(&userID, &expiry)
+	if err != nil {
+		return 0, err
+	}
+	if time.Now().After(expiry) {
+		return 0, errSessionExpired
+	}
+	return userID, nil
+}
+
+// isModerator reports whether the user may moderate other people's content.
+// Admins are moderators too.
+func isModerator(userID int) bool {
+	var role string
+	if err := db.QueryRow("SELECT role FROM users WHERE id = ?", userID).Scan(&role); err != nil {
+		return false
+	}
+	return role == "moderator" || role == "admin"
+}
+
+func isAdmin(userID int) bool {
+	var role string
+	if err := db.QueryRow("SELECT role FROM users WHERE id = ?", userID).Scan(&role); err != nil {
+		return false
+	}
+	return role == "admin"
 }
 
 func FilterByTag(w http.ResponseWriter, r *http.Request) {
@@ -20,8 +64,9 @@ func FilterByTag(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/homepage?tag="+tag, http.StatusSeeOther)
 }
 
+// getAllTags returns the approved tags, the ones posts can be filed under
 func getAllTags() ([]Tag, error) {
-	rows, err := db.Query("SELECT id, name FROM tags ORDER BY name")
+	rows, err := db.Query("SELECT id, name, slug, description, color FROM tags WHERE status = 'approved' ORDER BY name")
 	if err != nil {
 		return nil, err
 	}
@@ -30,38 +75,42 @@ func getAllTags() ([]Tag, error) {
 	var tags []Tag
 	for rows.Next() {
 		var tag Tag
-		if err := rows.Scan(&tag.ID, &tag.Name); err != nil {
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Slug, &tag.Description, &tag.Color); err != nil {
 			return nil, err
 		}
 		tags = append(tags, tag)
 	}
 	return tags, nil
 }
-func getPosts(tagFilter string) ([]Post, error) {
-	var rows *sql.Rows
-	var err error
-
-	if tagFilter != "" {
-		// DISTINCT avoid selection same post everytime if it have multp tags
-		rows, err = db.Query(`
-            SELECT DISTINCT posts.id, users.username, posts.content, posts.image_path,
-            (SELECT COUNT(*) FROM likes WHERE likes.post_id = posts.id) AS likesj
-            FROM posts 
-            JOIN users ON posts.user_id = users.id 
-            JOIN post_tags ON posts.id = post_tags.post_id
-            JOIN tags ON post_tags.tag_id = tags.id
-            WHERE tags.id = ?
-            ORDER BY posts.id DESC`, tagFilter)
-
-	} else {
-		rows, err = db.Query(`
-            SELECT posts.id, users.username, posts.content, posts.image_path,
-            (SELECT COUNT(*) FROM likes WHERE likes.post_id = posts.id) AS likes
-            FROM posts 
-            JOIN users ON posts.user_id = users.id 
-            ORDER BY posts.id DESC`)
+// getPost loads a single post for its permalink page and the API
+func getPost(postID string) (Post, error) {
+	posts, err := queryPosts([]string{"posts.id = ?"}, []any{postID}, "posts.id", 1)
+	if err != nil {
+		return Post{}, err
+	}
+	if len(posts) == 0 {
+		return Post{}, sql.ErrNoRows
+	}
+	return posts[0], nil
+}
+
+// queryPosts loads up to limit posts matching all conditions in the given
+// order, with their tags, comment previews, attachments, polls and reactions
+func queryPosts(conditions []string, args []any, order string, limit int) ([]Post, error) {
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
 	}
 
+	rows, err := db.Query(`
+            SELECT posts.id, posts.user_id, users.username, users.avatar, posts.title, posts.content,
+            posts.created_at, posts.updated_at, posts.edited_at,
+            posts.like_count, posts.comment_count, posts.hot_score, `+mentionNames("post", "posts.id")+`
+            FROM posts 
+            JOIN users ON posts.user_id = users.id 
+            `+where+`
+            ORDER BY `+order+`
+            LIMIT ?`, append(args, limit)...)
 	if err != nil {
 		return nil, err
 	}
@@ -70,68 +119,164 @@ func getPosts(tagFilter string) ([]Post, error) {
 	var posts []Post
 	for rows.Next() {
 		var post Post
-		var imagePath sql.NullString
-		if err := rows.Scan(&post.ID, &post.Username, &post.Content, &imagePath, &post.Likes); err != nil {
+		var avatar, mentions sql.NullString
+		var updatedAt, editedAt sql.NullTime
+		if err := rows.Scan(&post.ID, &post.UserID, &post.Username, &avatar, &post.Title, &post.Content,
+			&post.CreatedAt, &updatedAt, &editedAt, &post.Likes, &post.CommentCount, &post.HotScore, &mentions); err != nil {
 			log.Printf("Error scanning post: %v", err)
 			continue
 		}
-		if imagePath.Valid {
-			post.ImagePath = imagePath.String
-		}
+		post.ContentHTML = renderWithMentions(post.Content, strings.Fields(mentions.String))
+		post.UpdatedAt = updatedAt.Time
+		post.EditedAt = editedAt.Time
+		post.CreatedAgo = timeAgo(post.CreatedAt)
+		post.Avatar = avatarURL(avatar.String, 64)
+		post.Initials = initials(post.Username)
+		posts = append(posts, post)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if len(posts) == 0 {
+		return posts, nil
+	}
+
+	// tags, comments, polls and reactions for the whole page come from one
+	// query each, however many posts the page holds
+	byID := make(map[int]*Post, len(posts))
+	ids := make([]any, len(posts))
+	for i := range posts {
+		byID[posts[i].ID] = &posts[i]
+		ids[i] = posts[i].ID
+	}
+	if err := loadPostTags(byID, ids); err != nil {
+		return nil, err
+	}
+	if err := loadCommentPreviews(byID, ids); err != nil {
+		return nil, err
+	}
+	if err := loadPostAttachments(byID, ids); err != nil {
+		return nil, err
+	}
+	if err := loadPostPolls(byID, ids); err != nil {
+		return nil, err
+	}
+	if err := loadPostReactions(byID, ids); err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
 
-		// Get tags for post
-		tagRows, err := db.Query(`
-			SELECT tags.name 
-			FROM post_tags 
-			JOIN tags ON post_tags.tag_id = tags.id 
-			WHERE post_tags.post_id = ?`, post.ID)
-		if err != nil {
-			log.Printf("Failed to get tags for post %d: %v", post.ID, err)
+// placeholders returns "?, ?, ?" for n bind parameters
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func loadPostTags(byID map[int]*Post, ids []any) error {
+	rows, err := db.Query(`
+		SELECT post_tags.post_id, tags.name 
+		FROM post_tags 
+		JOIN tags ON post_tags.tag_id = tags.id 
+		WHERE post_tags.post_id IN (`+placeholders(len(ids))+`)
+		ORDER BY tags.name`, ids...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID int
+		var tagName string
+		if err := rows.Scan(&postID, &tagName); err != nil {
+			log.Printf("Error scanning tag: %v", err)
 			continue
 		}
-		defer tagRows.Close()
-
-		for tagRows.Next() {
-			var tagName string
-			if err := tagRows.Scan(&tagName); err != nil {
-				log.Printf("Error scanning tag: %v", err)
-				continue
-			}
-			post.Tags = append(post.Tags, tagName)
-		}
+		byID[postID].Tags = append(byID[postID].Tags, tagName)
+	}
+	return rows.Err()
+}
+
+// commentColumns is the select list scanComments reads, from comments
+// joined with their authors as users
+var commentColumns = `comments.post_id, comments.id, comments.parent_id, comments.depth, comments.reply_count,
+	comments.user_id, users.username, users.avatar, comments.content, comments.created_at, comments.edited_at,
+	comments.deleted_at IS NOT NULL, comments.deleted_by, comments.delete_reason, comments.reaction_count,
+	` + mentionNames("comment", "comments.id")
+
+func scanComments(rows *sql.Rows) ([]Comment, error) {
+	defer rows.Close()
 
-		// Get comments for post
-		commentRows, err := db.Query(`
-			SELECT comments.id, users.username, comments.content,
-			(SELECT COUNT(*) FROM comment_likes WHERE comment_likes.comment_id = comments.id) AS likes
-			FROM comments 
-			JOIN users ON comments.user_id = users.id 
-			WHERE comments.post_id = ? 
-			ORDER BY comments.created_at ASC`, post.ID)
-		if err != nil {
-			log.Printf("Failed to get comments: %v", err)
+	var comments []Comment
+	for rows.Next() {
+		var comment Comment
+		var parentID, deletedBy sql.NullInt64
+		var editedAt sql.NullTime
+		var commentAvatar, reason, mentions sql.NullString
+		if err := rows.Scan(&comment.PostID, &comment.ID, &parentID, &comment.Depth, &comment.ReplyCount,
+			&comment.UserID, &comment.Username, &commentAvatar, &comment.Content, &comment.CreatedAt, &editedAt,
+			&comment.Deleted, &deletedBy, &reason, &comment.ReactionCount, &mentions); err != nil {
+			log.Printf("Error scanning comment: %v", err)
 			continue
 		}
-		defer commentRows.Close()
-
-		for commentRows.Next() {
-			var comment Comment
-			if err := commentRows.Scan(&comment.ID, &comment.Username, &comment.Content, &comment.Likes); err != nil {
-				log.Printf("Error scanning comment: %v", err)
-				continue
-			}
-			post.Comments = append(post.Comments, comment)
+		comment.ParentID = int(parentID.Int64)
+		comment.EditedAt = editedAt.Time
+		if comment.Deleted {
+			// who wrote a deleted comment is not shown
+			comment.Removed = int(deletedBy.Int64) != comment.UserID
+			comment.Reason = reason.String
+			comment.UserID, comment.Username = 0, ""
+			comments = append(comments, comment)
+			continue
 		}
-		posts = append(posts, post)
+		comment.ContentHTML = renderWithMentions(comment.Content, strings.Fields(mentions.String))
+		comment.Avatar = avatarURL(commentAvatar.String, 32)
+		comment.Initials = initials(comment.Username)
+		comments = append(comments, comment)
 	}
+	return comments, rows.Err()
+}
 
-	return posts, nil
+// loadCommentPreviews gives each post its commentPreviewSize most reacted
+// top level comments, oldest first among equals. The full threads are
+// loaded per post through the comments API. The unary + keeps SQLite from
+// looking the comments up through idx_comments_parent, which would read
+// every top level comment of every post instead of those of this page.
+func loadCommentPreviews(byID map[int]*Post, ids []any) error {
+	rows, err := db.Query(`
+		SELECT `+commentColumns+`
+		FROM (
+			SELECT id, ROW_NUMBER() OVER (PARTITION BY post_id ORDER BY reaction_count DESC, id ASC) AS rank
+			FROM comments
+			WHERE post_id IN (`+placeholders(len(ids))+`) AND +parent_id IS NULL AND deleted_at IS NULL
+		) ranked
+		JOIN comments ON comments.id = ranked.id
+		JOIN users ON comments.user_id = users.id
+		WHERE ranked.rank <= ?
+		ORDER BY comments.post_id, ranked.rank`, append(ids, commentPreviewSize)...)
+	if err != nil {
+		return err
+	}
+	comments, err := scanComments(rows)
+	if err != nil {
+		return err
+	}
+
+	for _, comment := range comments {
+		post := byID[comment.PostID]
+		post.Comments = append(post.Comments, comment)
+	}
+	for _, post := range byID {
+		post.CommentsPreview = true
+	}
+	return nil
 }
 
 func GetAllConn(w http.ResponseWriter, currentUserID int) []Contact {
 	// Get all other users with unread counts
 	rows, err := db.Query(`
-        SELECT u.id, u.username, 
+        SELECT u.id, u.username, u.avatar,
                (SELECT COUNT(*) FROM messages m WHERE m.sender_id = u.id AND m.recipient_id = ? AND m.is_read = FALSE) as unread_count
         FROM users u
         WHERE u.id != ?
@@ -146,22 +291,14 @@ func GetAllConn(w http.ResponseWriter, currentUserID int) []Contact {
 	var contacts []Contact
 	for rows.Next() {
 		var contact Contact
-		if err := rows.Scan(&contact.ID, &contact.Username, &contact.Unread); err != nil {
+		var avatar sql.NullString
+		if err := rows.Scan(&contact.ID, &contact.Username, &avatar, &contact.Unread); err != nil {
 			log.Printf("Error scanning user: %v", err)
 			continue
 		}
-		// avatar
-		initials := ""
-		words := strings.Fields(contact.Username)
-		for _, word := range words {
-			if len(word) > 0 {
-				initials += string(word[0])
-			}
-			if len(initials) >= 2 {
-				break
-			}
-		}
-		contact.Initials = strings.ToUpper(initials)
+		// avatar, initials when none was uploaded
+		contact.Avatar = avatarURL(avatar.String, 64)
+		contact.Initials = initials(contact.Username)
 		contacts = append(contacts, contact)
 	}
 	return contacts
@@ -13,33 +13,234 @@ import (
 var db *sql.DB
 
 // ---------HOMEPAGE-----------
-var templates = template.Must(template.ParseFiles(
-	"./templates/signin.html",
-	"./templates/signup.html",
-	"./templates/homepage.html",
-	"./templates/chat.html",
-))
+// parsed by InitHandlers
+var templates *template.Template
 
 type Post struct {
-	ID        int
-	Username  string
-	Content   string
-	ImagePath string
-	Likes     int
-	Comments  []Comment
-	Tags      []string
+	ID           int           `json:"id"`
+	UserID       int           `json:"user_id"`
+	Username     string        `json:"username"`
+	Avatar       string        `json:"avatar,omitempty"`
+	Initials     string        `json:"initials"`
+	Title        string        `json:"title"`
+	Content      string        `json:"content"` // Markdown source
+	ContentHTML  template.HTML `json:"content_html"`
+	Likes        int           `json:"likes"` // reactions of any kind
+	Reactions    []Reaction    `json:"reactions"`
+	Comments     []Comment     `json:"comments"`
+	CommentCount int           `json:"comment_count"` // replies and tombstones included
+	HotScore     float64       `json:"-"`             // only needed for the "hot" cursor
+	Tags         []string      `json:"tags"`
+	Poll         *Poll         `json:"poll,omitempty"`
+	Attachments  []Attachment  `json:"attachments"`
+
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	EditedAt   time.Time `json:"edited_at"`
+	CreatedAgo string    `json:"created_ago"`
+
+	// Comments holds a preview in feeds and the first page of threads on
+	// the post's own page, sorted by CommentSort
+	CommentsPreview bool   `json:"comments_preview"`
+	CommentsCursor  string `json:"comments_cursor,omitempty"`
+	CommentSort     string `json:"comment_sort,omitempty"`
+
+	// filled in for the viewing user
+	CanEdit        bool `json:"can_edit"`
+	CanDelete      bool `json:"can_delete"`
+	CanViewHistory bool `json:"-"`
+	Bookmarked     bool `json:"bookmarked"`
+	CollectionID   int  `json:"collection_id,omitempty"` // of the bookmark
+}
+
+// Attachment is an image or document attached to a post, or to a scheduled
+// draft until it is published
+type Attachment struct {
+	ID       int    `json:"id"`
+	Kind     string `json:"kind"` // "image" or "file"
+	Path     string `json:"-"`    // image key, see processImage, or file path
+	URL      string `json:"url"`
+	Name     string `json:"name"` // as uploaded
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size"`
+	AltText  string `json:"alt_text"`
+	Caption  string `json:"caption,omitempty"`
+	Position int    `json:"position"`
+
+	// stage is the staging area of a new upload until it is promoted, ""
+	// when the upload reuses a stored file
+	stage string
+}
+
+func (a Attachment) IsImage() bool { return a.Kind == "image" }
+
+// Images returns the attachments shown in the post's gallery
+func (p Post) Images() []Attachment {
+	var images []Attachment
+	for _, attachment := range p.Attachments {
+		if attachment.IsImage() {
+			images = append(images, attachment)
+		}
+	}
+	return images
 }
 
+// Files returns the attachments offered as downloads
+func (p Post) Files() []Attachment {
+	var files []Attachment
+	for _, attachment := range p.Attachments {
+		if !attachment.IsImage() {
+			files = append(files, attachment)
+		}
+	}
+	return files
+}
+
+// Draft is an unpublished post, autosaved from the post form. Drafts with a
+// PublishAt are published by the scheduler once that time has passed.
+type Draft struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"-"`
+	Title     string     `json:"title"`
+	Content   string     `json:"content"`
+	Tags      []string   `json:"tags"` // tag ids
+	Poll      *PollInput `json:"poll,omitempty"`
+	PublishAt time.Time  `json:"publish_at,omitzero"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// Collection is a private, named group of a user's bookmarks
+type Collection struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Posts int    `json:"posts"`
+}
+
+// Bookmark is the state of one saved post, as returned by /api/bookmarks
+type Bookmark struct {
+	PostID       int  `json:"post_id"`
+	Saved        bool `json:"saved"`
+	CollectionID int  `json:"collection_id,omitempty"`
+}
+
+// Notification tells a user about something that involves them. It is both
+// stored and pushed over the websocket, where Type tells it from chat messages.
+type Notification struct {
+	ID         int       `json:"id"`
+	Type       string    `json:"type"`
+	Kind       string    `json:"kind"` // mention or reply
+	ActorID    int       `json:"actor_id"`
+	Actor      string    `json:"actor"`
+	Link       string    `json:"link"`
+	Excerpt    string    `json:"excerpt"`
+	Read       bool      `json:"read"`
+	CreatedAt  time.Time `json:"created_at"`
+	CreatedAgo string    `json:"created_ago"`
+}
+
+// Poll is attached to at most one post. Vote counts are only filled in once
+// the viewing user has voted or the poll has closed.
+type Poll struct {
+	ID          int          `json:"id"`
+	PostID      int          `json:"post_id"`
+	Question    string       `json:"question"`
+	Multiple    bool         `json:"multiple"`
+	ClosesAt    time.Time    `json:"closes_at,omitzero"`
+	Closed      bool         `json:"closed"`
+	Voters      int          `json:"voters"`
+	Options     []PollOption `json:"options"`
+	Voted       bool         `json:"voted"`
+	ShowResults bool         `json:"show_results"`
+}
+
+type PollOption struct {
+	ID      int    `json:"id"`
+	Label   string `json:"label"`
+	Votes   int    `json:"votes"`
+	Percent int    `json:"percent"` // of the voters
+	Chosen  bool   `json:"chosen"`  // by the viewing user
+}
+
+// PollInput is a poll as written in the post form, before it is created
+type PollInput struct {
+	Question string    `json:"question"`
+	Options  []string  `json:"options"`
+	Multiple bool      `json:"multiple"`
+	ClosesAt time.Time `json:"closes_at,omitzero"`
+}
+
+// Revision is a previous version of a post, kept on every edit
+type Revision struct {
+	ID          int
+	Editor      string
+	Title       string
+	Content     string
+	Tags        string
+	ImagePath   string // before posts had attachments
+	Attachments string
+	CreatedAt   time.Time
+	Diff        []DiffLine
+}
+
+// Comment is a comment or reply. A deleted comment that still has replies
+// stays in its thread as a tombstone: it keeps its place but loses its
+// author, content and reactions.
 type Comment struct {
-	ID       int
-	Username string
-	Content  string
-	Likes    int
+	ID          int           `json:"id"`
+	PostID      int           `json:"post_id"`
+	ParentID    int           `json:"parent_id,omitempty"` // 0 for top level comments
+	Depth       int           `json:"depth"`
+	UserID      int           `json:"user_id,omitempty"`
+	Username    string        `json:"username"`
+	Avatar      string        `json:"avatar,omitempty"`
+	Initials    string        `json:"initials"`
+	Content     string        `json:"content"`
+	ContentHTML template.HTML `json:"content_html"`
+	Reactions   []Reaction    `json:"reactions"`
+	ReplyCount  int           `json:"reply_count"` // direct replies
+	Replies     []Comment     `json:"replies,omitempty"`
+
+	ReactionCount int       `json:"reaction_count"` // for the "top" sort cursor
+	CreatedAt     time.Time `json:"created_at"`
+	EditedAt      time.Time `json:"edited_at,omitzero"`
+	Deleted       bool      `json:"deleted"`
+	Removed       bool      `json:"removed"` // deleted by a moderator
+	Reason        string    `json:"reason,omitempty"`
+
+	// filled in for the viewing user
+	CanReply       bool `json:"-"` // below the maximum depth
+	Own            bool `json:"-"`
+	CanEdit        bool `json:"can_edit"`
+	CanDelete      bool `json:"can_delete"`
+	CanViewHistory bool `json:"-"`
+}
+
+// Reaction counts one emoji left on a post or comment. Reacted is set for
+// the viewing user.
+type Reaction struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted"`
+}
+
+// ReactionSummary is what the reactions API answers and what is broadcast
+// when the reactions of a post or comment change
+type ReactionSummary struct {
+	Type      string     `json:"type"` // "reactions"
+	PostID    int        `json:"post_id,omitempty"`
+	CommentID int        `json:"comment_id,omitempty"`
+	Reactions []Reaction `json:"reactions"`
 }
 
 type Tag struct {
-	ID   int
-	Name string
+	ID          int
+	Name        string
+	Slug        string
+	Description string
+	Color       string
+	Status      string // pending or approved
+	ProposedBy  string
+	Posts       int
 }
 
 // --------------- ws - chat -------------
@@ -58,19 +259,23 @@ type Client struct {
 }
 
 type Message struct {
-	ID          int       `json:"id,omitempty"`
-	SenderID    int       `json:"sender_id"`
-	RecipientID int       `json:"recipient_id"`
-	Username    string    `json:"username,omitempty"`
-	Content     string    `json:"content"`
-	CreatedAt   time.Time `json:"created_at,omitempty"`
-	IsSent      bool      `json:"is_sent,omitempty"`
-	Type        string    `json:"type"` 
+	ID          int           `json:"id,omitempty"`
+	SenderID    int           `json:"sender_id"`
+	RecipientID int           `json:"recipient_id"`
+	Username    string        `json:"username,omitempty"`
+	Avatar      string        `json:"avatar,omitempty"`
+	Initials    string        `json:"initials,omitempty"`
+	Content     string        `json:"content"`
+	HTML        template.HTML `json:"html,omitempty"` // rendered Content
+	CreatedAt   time.Time     `json:"created_at,omitempty"`
+	IsSent      bool          `json:"is_sent,omitempty"`
+	Type        string        `json:"type"`
 }
 
 type Contact struct {
 	ID       int
 	Username string
+	Avatar   string
 	Initials string
 	Unread   int
 }
@@ -0,0 +1,305 @@
+package myserver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// A tag filter expression combines tag names with AND, OR, NOT and
+// parentheses, e.g. "Music AND Art" or "Technology NOT Gaming". NOT binds
+// tightest, then AND, then OR; "A NOT B" is shorthand for "A AND NOT B".
+// Names with spaces can be quoted: "Street Food" OR Travel.
+
+// Limits on a filter expression. Each term adds a level to the SQL
+// expression the filter compiles to, and SQLite refuses expressions nested
+// too deeply.
+const (
+	maxTagFilterTerms = 20
+	maxTagFilterDepth = 10
+)
+
+// errBadFilter wraps every error caused by the expression itself, as opposed
+// to the database
+var errBadFilter = errors.New("invalid tag filter")
+
+type tagNode struct {
+	op          string // "tag", "and", "or", "not"
+	name        string
+	id          int
+	left, right *tagNode
+}
+
+// parseTagFilter parses a filter expression. Tag names are looked up
+// afterwards, by resolve.
+func parseTagFilter(expr string) (*tagNode, error) {
+	tokens, err := tokenizeTagFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty tag filter")
+	}
+
+	p := &tagParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in tag filter", p.tokens[p.pos].text)
+	}
+	return node, nil
+}
+
+type tagToken struct {
+	text   string
+	quoted bool
+}
+
+// keyword returns the upper-cased operator a token stands for, or ""
+func (t tagToken) keyword() string {
+	if t.quoted {
+		return ""
+	}
+	switch up := strings.ToUpper(t.text); up {
+	case "AND", "OR", "NOT", "(", ")":
+		return up
+	}
+	return ""
+}
+
+func tokenizeTagFilter(expr string) ([]tagToken, error) {
+	var tokens []tagToken
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, tagToken{text: string(r)})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, errors.New("unterminated quote in tag filter")
+			}
+			tokens = append(tokens, tagToken{text: string(runes[i+1 : end]), quoted: true})
+			i = end + 1
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && runes[end] != '(' && runes[end] != ')' && runes[end] != '"' {
+				end++
+			}
+			tokens = append(tokens, tagToken{text: string(runes[i:end])})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type tagParser struct {
+	tokens []tagToken
+	pos    int
+	terms  int
+	depth  int // parentheses and NOTs open around the current token
+}
+
+// enter counts one more level of nesting, failing past maxTagFilterDepth
+func (p *tagParser) enter() error {
+	if p.depth++; p.depth > maxTagFilterDepth {
+		return fmt.Errorf("tag filter nested more than %d levels deep", maxTagFilterDepth)
+	}
+	return nil
+}
+
+func (p *tagParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos].keyword()
+	}
+	return ""
+}
+
+func (p *tagParser) parseOr() (*tagNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "OR" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &tagNode{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *tagParser) parseAnd() (*tagNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek() {
+		case "AND":
+			p.pos++
+		case "NOT":
+			// "A NOT B": leave NOT for parseNot to pick up
+		default:
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &tagNode{op: "and", left: left, right: right}
+	}
+}
+
+func (p *tagParser) parseNot() (*tagNode, error) {
+	if p.peek() == "NOT" {
+		p.pos++
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		p.depth--
+		return &tagNode{op: "not", left: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *tagParser) parsePrimary() (*tagNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("tag filter ends early")
+	}
+	token := p.tokens[p.pos]
+	switch token.keyword() {
+	case "(":
+		p.pos++
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("missing ) in tag filter")
+		}
+		p.pos++
+		p.depth--
+		return node, nil
+	case "":
+		p.pos++
+		if p.terms++; p.terms > maxTagFilterTerms {
+			return nil, fmt.Errorf("tag filter has more than %d tags", maxTagFilterTerms)
+		}
+		return &tagNode{op: "tag", name: token.text}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q in tag filter", token.text)
+}
+
+// resolve looks up every tag by name, case-insensitively, or by slug
+func (n *tagNode) resolve(ids map[string]int) error {
+	switch n.op {
+	case "tag":
+		id, ok := ids[strings.ToLower(n.name)]
+		if !ok {
+			return fmt.Errorf("unknown tag %q", n.name)
+		}
+		n.id = id
+	case "not":
+		return n.left.resolve(ids)
+	default:
+		if err := n.left.resolve(ids); err != nil {
+			return err
+		}
+		return n.right.resolve(ids)
+	}
+	return nil
+}
+
+// having compiles the expression into a HAVING clause over the post's
+// post_tags rows (aliased pt), one bind argument per tag reference
+func (n *tagNode) having() (string, []any) {
+	switch n.op {
+	case "tag":
+		return "COALESCE(MAX(pt.tag_id = ?), 0)", []any{n.id}
+	case "not":
+		sql, args := n.left.having()
+		return "NOT (" + sql + ")", args
+	}
+	left, leftArgs := n.left.having()
+	right, rightArgs := n.right.having()
+	return "(" + left + " " + strings.ToUpper(n.op) + " " + right + ")", append(leftArgs, rightArgs...)
+}
+
+// matchesUntagged reports whether a post carrying none of the referenced
+// tags matches, e.g. for "NOT Gaming"
+func (n *tagNode) matchesUntagged() bool {
+	switch n.op {
+	case "tag":
+		return false
+	case "not":
+		return !n.left.matchesUntagged()
+	case "and":
+		return n.left.matchesUntagged() && n.right.matchesUntagged()
+	}
+	return n.left.matchesUntagged() || n.right.matchesUntagged()
+}
+
+func (n *tagNode) tagIDs() []any {
+	switch n.op {
+	case "tag":
+		return []any{n.id}
+	case "not":
+		return n.left.tagIDs()
+	}
+	return append(n.left.tagIDs(), n.right.tagIDs()...)
+}
+
+// tagFilterCondition turns a filter expression into a condition on posts.id.
+// Each post's tags are grouped once and tested in HAVING, so the cost does
+// not grow with the number of terms and there is no per-post subquery. When
+// untagged posts cannot match, only the post_tags rows of the referenced tags
+// are read, through idx_post_tags_tag.
+func tagFilterCondition(expr string) (string, []any, error) {
+	node, err := parseTagFilter(expr)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", errBadFilter, err)
+	}
+
+	tags, err := getAllTags()
+	if err != nil {
+		return "", nil, err
+	}
+	ids := make(map[string]int, len(tags))
+	for _, tag := range tags {
+		ids[tag.Slug] = tag.ID
+		ids[strings.ToLower(tag.Name)] = tag.ID
+	}
+	if err := node.resolve(ids); err != nil {
+		return "", nil, fmt.Errorf("%w: %v", errBadFilter, err)
+	}
+
+	having, args := node.having()
+	if node.matchesUntagged() {
+		return `posts.id IN (SELECT p.id FROM posts p LEFT JOIN post_tags pt ON pt.post_id = p.id
+			GROUP BY p.id HAVING ` + having + `)`, args, nil
+	}
+
+	referenced := node.tagIDs()
+	return `posts.id IN (SELECT pt.post_id FROM post_tags pt WHERE pt.tag_id IN (` + placeholders(len(referenced)) + `)
+		GROUP BY pt.post_id HAVING ` + having + `)`, append(referenced, args...), nil
+}
@@ -0,0 +1,189 @@
+package myserver
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// show prints a parsed filter with every operation in parentheses
+func show(n *tagNode) string {
+	switch n.op {
+	case "tag":
+		return n.name
+	case "not":
+		return "NOT " + show(n.left)
+	}
+	return "(" + show(n.left) + " " + strings.ToUpper(n.op) + " " + show(n.right) + ")"
+}
+
+func TestParseTagFilter(t *testing.T) {
+	tests := []struct {
+		expr, want string
+	}{
+		{"Music", "Music"},
+		{"Music AND Art", "(Music AND Art)"},
+		{"music and art or gaming", "((music AND art) OR gaming)"},
+		{"Music OR Art AND Gaming", "(Music OR (Art AND Gaming))"},
+		{"(Music OR Art) AND Gaming", "((Music OR Art) AND Gaming)"},
+		{"Technology NOT Gaming", "(Technology AND NOT Gaming)"},
+		{"NOT Music AND Art", "(NOT Music AND Art)"},
+		{"NOT (Music OR Art)", "NOT (Music OR Art)"},
+		{"NOT NOT Music", "NOT NOT Music"},
+		{"A OR B NOT C OR D", "((A OR (B AND NOT C)) OR D)"},
+		{`"Street Food" OR Travel`, "(Street Food OR Travel)"},
+		{`"and" AND "Not"`, "(and AND Not)"},
+		{"((Music))", "Music"},
+	}
+	for _, test := range tests {
+		node, err := parseTagFilter(test.expr)
+		if err != nil {
+			t.Errorf("parseTagFilter(%q): %v", test.expr, err)
+			continue
+		}
+		if got := show(node); got != test.want {
+			t.Errorf("parseTagFilter(%q) = %s, want %s", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestParseTagFilterErrors(t *testing.T) {
+	terms := make([]string, maxTagFilterTerms+1)
+	for i := range terms {
+		terms[i] = fmt.Sprintf("t%d", i)
+	}
+	for _, expr := range []string{
+		"",
+		"   ",
+		"Music AND",
+		"AND Music",
+		"Music Art",
+		"NOT",
+		"()",
+		"(Music",
+		"Music)",
+		`"Street Food`,
+		strings.Repeat("(", maxTagFilterDepth+1) + "Music" + strings.Repeat(")", maxTagFilterDepth+1),
+		strings.Repeat("NOT ", maxTagFilterDepth+1) + "Music",
+		strings.Join(terms, " AND "),
+		strings.Join(terms, " OR "),
+	} {
+		if node, err := parseTagFilter(expr); err == nil {
+			t.Errorf("parseTagFilter(%q) = %s, want an error", expr, show(node))
+		}
+	}
+
+	deepest := strings.Repeat("(", maxTagFilterDepth) + "Music" + strings.Repeat(")", maxTagFilterDepth)
+	if _, err := parseTagFilter(deepest); err != nil {
+		t.Errorf("parseTagFilter at the depth limit: %v", err)
+	}
+	if _, err := parseTagFilter(strings.Join(terms[1:], " OR ")); err != nil {
+		t.Errorf("parseTagFilter at the term limit: %v", err)
+	}
+}
+
+// eval tells whether a post with the given tags matches
+func eval(n *tagNode, tags map[string]bool) bool {
+	switch n.op {
+	case "tag":
+		return tags[n.name]
+	case "not":
+		return !eval(n.left, tags)
+	case "and":
+		return eval(n.left, tags) && eval(n.right, tags)
+	}
+	return eval(n.left, tags) || eval(n.right, tags)
+}
+
+func TestMatchesUntagged(t *testing.T) {
+	for _, test := range []struct {
+		expr string
+		want bool
+	}{
+		{"A", false},
+		{"NOT A", true},
+		{"A NOT B", false},
+		{"NOT A AND NOT B", true},
+		{"NOT (A AND B)", true},
+		{"NOT (A OR NOT B)", false},
+		{"A OR NOT B", true},
+		{"(A OR NOT B) AND C", false},
+		{"NOT NOT A", false},
+		{"NOT (NOT A AND NOT B)", false},
+	} {
+		node, err := parseTagFilter(test.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := node.matchesUntagged(); got != test.want {
+			t.Errorf("matchesUntagged(%q) = %v, want %v", test.expr, got, test.want)
+		}
+		if got := eval(node, nil); got != node.matchesUntagged() {
+			t.Errorf("%q: matchesUntagged disagrees with evaluating the filter on no tags", test.expr)
+		}
+	}
+}
+
+// TestTagFilterCondition runs filters against the database, including the
+// untagged posts the fast path for filters that cannot match them leaves out
+func TestTagFilterCondition(t *testing.T) {
+	db = openTestDB(t)
+	if _, err := db.Exec("INSERT INTO users (username, email, password) VALUES ('alice', 'alice@example.com', 'x')"); err != nil {
+		t.Fatal(err)
+	}
+	posts := map[string][]string{
+		"music":        {"Music"},
+		"music gaming": {"Music", "Gaming"},
+		"untagged":     nil,
+		"art":          {"Art"},
+	}
+	for title, tags := range posts {
+		result, err := db.Exec("INSERT INTO posts (user_id, title, content) VALUES (1, ?, 'content')", title)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := result.LastInsertId()
+		for _, tag := range tags {
+			_, err := db.Exec("INSERT INTO post_tags (post_id, tag_id) SELECT ?, id FROM tags WHERE name = ?", id, tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{"music", []string{"music", "music gaming"}},
+		{"NOT gaming", []string{"art", "music", "untagged"}},
+		{"Music NOT Gaming", []string{"music"}},
+		{"music OR NOT art", []string{"music", "music gaming", "untagged"}},
+		{"NOT (music OR art)", []string{"untagged"}},
+		{"gaming OR art", []string{"art", "music gaming"}},
+		{"NOT NOT music", []string{"music", "music gaming"}},
+	}
+	for _, test := range tests {
+		page, err := getFeed(FeedQuery{Filter: test.expr})
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		var got []string
+		for _, post := range page.Posts {
+			got = append(got, post.Title)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%q matched %q, want %q", test.expr, got, test.want)
+		}
+	}
+
+	for _, expr := range []string{"Nonexistent", "music AND", strings.Repeat("NOT ", 50) + "music"} {
+		if _, err := getFeed(FeedQuery{Filter: expr}); !errors.Is(err, errBadFilter) {
+			t.Errorf("%q: got %v, want errBadFilter", expr, err)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package myserver
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxTagNameLength        = 30
+	maxTagDescriptionLength = 200
+	defaultTagColor         = "#4a6fa5"
+)
+
+// defaultTags are created on a fresh database only. Seeding on every start
+// would bring back tags an admin has since renamed or merged away.
+var defaultTags = []Tag{
+	{Name: "Music", Color: "#8e44ad"},
+	{Name: "Sports", Color: "#27ae60"},
+	{Name: "Technology", Color: "#2980b9"},
+	{Name: "Art", Color: "#d35400"},
+	{Name: "Food", Color: "#c0392b"},
+	{Name: "Travel", Color: "#16a085"},
+	{Name: "Fashion", Color: "#e84393"},
+	{Name: "Health", Color: "#2ecc71"},
+	{Name: "Education", Color: "#f39c12"},
+	{Name: "Gaming", Color: "#34495e"},
+}
+
+var tagColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// seedDefaultTags runs as the last migration, once the tags table has its
+// slug and color columns
+func seedDefaultTags(database *sql.DB) error {
+	var count int
+	if err := database.QueryRow("SELECT COUNT(*) FROM tags").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	for _, tag := range defaultTags {
+		_, err := database.Exec("INSERT INTO tags (name, slug, color, status) VALUES (?, ?, ?, 'approved')",
+			tag.Name, slugify(tag.Name), tag.Color)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// slugify lowercases a tag name and joins its words with dashes
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// readTagForm validates the name, description and color fields shared by
+// proposals and admin edits. It returns a user facing message on failure.
+func readTagForm(r *http.Request) (Tag, string) {
+	tag := Tag{
+		Name:        strings.Join(strings.Fields(r.FormValue("name")), " "),
+		Description: strings.TrimSpace(r.FormValue("description")),
+		Color:       strings.TrimSpace(r.FormValue("color")),
+	}
+	tag.Slug = slugify(tag.Name)
+	if tag.Color == "" {
+		tag.Color = defaultTagColor
+	}
+
+	switch {
+	case tag.Slug == "":
+		return tag, "Tag name must contain letters or digits"
+	case utf8.RuneCountInString(tag.Name) > maxTagNameLength:
+		return tag, "Tag name is too long"
+	case strings.ContainsAny(tag.Name, `()"`):
+		return tag, "Tag name cannot contain parentheses or quotes"
+	case utf8.RuneCountInString(tag.Description) > maxTagDescriptionLength:
+		return tag, "Tag description is too long"
+	case !tagColorPattern.MatchString(tag.Color):
+		return tag, "Tag color must look like #4a6fa5"
+	}
+	return tag, ""
+}
+
+// tagTaken reports whether another tag already uses the name or slug
+func tagTaken(tag Tag, exceptID int) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM tags WHERE (name = ? COLLATE NOCASE OR slug = ?) AND id != ?",
+		tag.Name, tag.Slug, exceptID).Scan(&count)
+	return count > 0, err
+}
+
+// listTags loads every tag, pending ones included, with its post count
+func listTags() ([]Tag, error) {
+	rows, err := db.Query(`
+		SELECT tags.id, tags.name, tags.slug, tags.description, tags.color, tags.status,
+			COALESCE(users.username, ''),
+			(SELECT COUNT(*) FROM post_tags WHERE post_tags.tag_id = tags.id)
+		FROM tags
+		LEFT JOIN users ON users.id = tags.proposed_by
+		ORDER BY tags.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []Tag
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Slug, &tag.Description, &tag.Color, &tag.Status,
+			&tag.ProposedBy, &tag.Posts); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// TagsPage lists the approved tags and lets users propose new ones.
+// Moderators also see the pending proposals, admins get edit and merge forms.
+func TagsPage(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+
+	all, err := listTags()
+	if err != nil {
+		log.Println("Failed to fetch tags:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	var approved, pending []Tag
+	for _, tag := range all {
+		if tag.Status == "approved" {
+			approved = append(approved, tag)
+		} else {
+			pending = append(pending, tag)
+		}
+	}
+
+	data := struct {
+		Tags      []Tag
+		Pending   []Tag
+		Moderator bool
+		Admin     bool
+		Proposed  bool
+	}{
+		Tags:      approved,
+		Pending:   pending,
+		Moderator: isModerator(userID),
+		Admin:     isAdmin(userID),
+		Proposed:  r.URL.Query().Get("proposed") != "",
+	}
+
+	templates.ExecuteTemplate(w, "tags.html", data)
+}
+
+// ProposeTag stores a new tag as pending until a moderator approves it.
+// Moderators' own proposals are approved straight away.
+func ProposeTag(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tag, problem := readTagForm(r)
+	if problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	taken, err := tagTaken(tag, 0)
+	if err != nil {
+		log.Printf("Failed to check tag name: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "A tag with that name already exists", http.StatusConflict)
+		return
+	}
+
+	status := "pending"
+	if isModerator(userID) {
+		status = "approved"
+	}
+	_, err = db.Exec("INSERT INTO tags (name, slug, description, color, status, proposed_by) VALUES (?, ?, ?, ?, ?, ?)",
+		tag.Name, tag.Slug, tag.Description, tag.Color, status, userID)
+	if err != nil {
+		log.Printf("Failed to insert tag: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/tags?proposed=1", http.StatusSeeOther)
+}
+
+// ReviewTag approves or rejects a pending tag. Rejected proposals are deleted.
+func ReviewTag(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isModerator(userID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	tagID := r.FormValue("tag_id")
+	var result sql.Result
+	switch r.FormValue("action") {
+	case "approve":
+		result, err = db.Exec("UPDATE tags SET status = 'approved' WHERE id = ? AND status = 'pending'", tagID)
+	case "reject":
+		result, err = db.Exec("DELETE FROM tags WHERE id = ? AND status = 'pending'", tagID)
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to review tag: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+
+	http.Redirect(w, r, "/tags", http.StatusSeeOther)
+}
+
+// UpdateTag lets admins rename a tag and change its description and color.
+// Posts keep the tag since they reference it by id.
+func UpdateTag(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdmin(userID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var tagID int
+	err = db.QueryRow("SELECT id FROM tags WHERE id = ?", r.FormValue("tag_id")).Scan(&tagID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to load tag: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	tag, problem := readTagForm(r)
+	if problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	taken, err := tagTaken(tag, tagID)
+	if err != nil {
+		log.Printf("Failed to check tag name: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "A tag with that name already exists, merge them instead", http.StatusConflict)
+		return
+	}
+
+	_, err = db.Exec("UPDATE tags SET name = ?, slug = ?, description = ?, color = ? WHERE id = ?",
+		tag.Name, tag.Slug, tag.Description, tag.Color, tagID)
+	if err != nil {
+		log.Printf("Failed to update tag: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/tags", http.StatusSeeOther)
+}
+
+// MergeTags folds a duplicate tag into another one. Posts carrying the
+// duplicate are moved to the target in the same transaction that deletes it,
+// and posts that already had both keep a single row.
+func MergeTags(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusSeeOther)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdmin(userID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var sourceID, targetID int
+	err = db.QueryRow("SELECT id FROM tags WHERE id = ?", r.FormValue("source_id")).Scan(&sourceID)
+	if err == nil {
+		err = db.QueryRow("SELECT id FROM tags WHERE id = ? AND status = 'approved'", r.FormValue("target_id")).Scan(&targetID)
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to load tags: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if sourceID == targetID {
+		http.Error(w, "Cannot merge a tag into itself", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("Failed to start transaction:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		"INSERT OR IGNORE INTO post_tags (post_id, tag_id) SELECT post_id, ? FROM post_tags WHERE tag_id = ?",
+		"DELETE FROM post_tags WHERE tag_id = ?",
+		"DELETE FROM tags WHERE id = ?",
+	}
+	args := [][]any{{targetID, sourceID}, {sourceID}, {sourceID}}
+	for i, statement := range statements {
+		if _, err := tx.Exec(statement, args[i]...); err != nil {
+			log.Printf("Failed to merge tags: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := remapDraftTags(tx, sourceID, targetID); err != nil {
+		log.Printf("Failed to merge draft tags: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println("Failed to commit transaction:", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/tags", http.StatusSeeOther)
+}
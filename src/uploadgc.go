@@ -0,0 +1,180 @@
+package myserver
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// uploadGCGrace keeps the collector away from uploads younger than this,
+// which may belong to a request that has not committed yet
+const uploadGCGrace = time.Hour
+
+// uploadGCReport sums up one run of the upload collector
+type uploadGCReport struct {
+	Blobs       int   // stored blobs, including ones too young to judge
+	Orphans     int   // blobs nothing in the database refers to
+	OrphanBytes int64 // their size
+	Removed     int   // orphans deleted
+	Promoted    int   // staged uploads that were committed but never promoted
+	Discarded   int   // staged uploads left behind by failed requests
+}
+
+// StartUploadGC reconciles the blob store against the database in the
+// background, configured from the environment:
+//
+//	UPLOAD_GC_INTERVAL  how often to run, "6h" by default; "0" turns it off
+//	UPLOAD_GC_REMOVE    "true" to delete orphaned uploads instead of only reporting them
+func StartUploadGC() error {
+	interval := 6 * time.Hour
+	if value := os.Getenv("UPLOAD_GC_INTERVAL"); value != "" {
+		var err error
+		if interval, err = time.ParseDuration(value); err != nil || interval < 0 {
+			return fmt.Errorf("UPLOAD_GC_INTERVAL must be a duration, got %q", value)
+		}
+	}
+	remove := os.Getenv("UPLOAD_GC_REMOVE") == "true"
+	if interval == 0 {
+		return nil
+	}
+
+	go func() {
+		runUploadGC(remove)
+		for range time.Tick(interval) {
+			runUploadGC(remove)
+		}
+	}()
+	return nil
+}
+
+func runUploadGC(remove bool) {
+	report, err := collectUploads(remove)
+	if err != nil {
+		log.Println("Upload collection failed:", err)
+		return
+	}
+	log.Printf("Upload collection: %d stored, %d orphaned (%d bytes), %d removed, %d promoted, %d staged discarded",
+		report.Blobs, report.Orphans, report.OrphanBytes, report.Removed, report.Promoted, report.Discarded)
+}
+
+// collectUploads compares the stored blobs with the ones the database
+// refers to. Staged uploads are always settled: promoted when their key is
+// referenced, which means the request committed but could not promote
+// them, and deleted otherwise. Orphans outside the staging area are logged,
+// and only deleted when remove is set.
+func collectUploads(remove bool) (uploadGCReport, error) {
+	var report uploadGCReport
+	stored, err := blobs.List("")
+	if err != nil {
+		return report, err
+	}
+
+	// references are read after listing, so blobs promoted in between are
+	// counted as referenced rather than as orphans. Holding uploadLock keeps
+	// requests from putting an upload back in place while it is deleted.
+	uploadLock.Lock()
+	defer uploadLock.Unlock()
+	referenced, err := referencedBlobs()
+	if err != nil {
+		return report, err
+	}
+
+	exists := make(map[string]bool, len(stored))
+	for _, blob := range stored {
+		exists[blob.Key] = true
+	}
+
+	cutoff := time.Now().Add(-uploadGCGrace)
+	report.Blobs = len(stored)
+	for _, blob := range stored {
+		if blob.ModTime.After(cutoff) {
+			continue
+		}
+
+		// staged keys are "staging/<uuid>/<key>"
+		if rest, staged := strings.CutPrefix(blob.Key, stagingDir+"/"); staged {
+			_, key, _ := strings.Cut(rest, "/")
+			if referenced[key] && !exists[key] {
+				if err := blobs.Move(blob.Key, key); err != nil {
+					log.Printf("Failed to promote upload %s: %v", key, err)
+					continue
+				}
+				exists[key] = true
+				report.Promoted++
+				continue
+			}
+			if err := blobs.Delete(blob.Key); err != nil {
+				log.Printf("Failed to remove staged upload %s: %v", blob.Key, err)
+				continue
+			}
+			report.Discarded++
+			continue
+		}
+
+		if referenced[blob.Key] {
+			continue
+		}
+		report.Orphans++
+		report.OrphanBytes += blob.Size
+		if !remove {
+			log.Printf("Orphaned upload %s (%d bytes, stored %s)", blob.Key, blob.Size, blob.ModTime.Format(time.RFC3339))
+			continue
+		}
+		if err := blobs.Delete(blob.Key); err != nil {
+			log.Printf("Failed to remove orphaned upload %s: %v", blob.Key, err)
+			continue
+		}
+		log.Printf("Removed orphaned upload %s (%d bytes)", blob.Key, blob.Size)
+		report.Removed++
+	}
+	return report, nil
+}
+
+// referencedBlobs collects the keys of every blob in use: uploads the
+// database refers to or a request is reusing, and avatars. The caller
+// holds uploadLock.
+func referencedBlobs() (map[string]bool, error) {
+	referenced := map[string]bool{}
+
+	rows, err := db.Query("SELECT path FROM uploads")
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for path := range pinnedUploads {
+		paths = append(paths, path)
+	}
+	for _, key := range uploadKeys(paths) {
+		referenced[key] = true
+	}
+
+	rows, err = db.Query("SELECT avatar FROM users WHERE avatar IS NOT NULL AND avatar != ''")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var avatar string
+		if err := rows.Scan(&avatar); err != nil {
+			return nil, err
+		}
+		for _, key := range avatarKeys(avatar) {
+			referenced[key] = true
+		}
+	}
+	return referenced, rows.Err()
+}
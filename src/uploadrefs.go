@@ -0,0 +1,114 @@
+package myserver
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Uploads are named after the SHA-256 of the uploaded file, so the same file
+// uploaded twice has the same key and is stored once. The uploads table
+// counts the attachments referring to each of them, and the files are only
+// deleted once nothing does.
+//
+// uploadLock orders the steps putting files in place against the ones
+// deleting them: a file is removed only when, holding the lock, nothing
+// refers to it and no request is about to. Uploads being reused by a
+// request that has not committed yet are pinned until it has.
+var (
+	uploadLock    sync.Mutex
+	pinnedUploads = map[string]int{}
+)
+
+// uploadHash is the hex SHA-256 new uploads are named after
+func uploadHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// contentKey tells the blobs of uploads named after their hash from older
+// uploads and avatars, which have random names, returning the blob's name
+func contentKey(key string) (string, bool) {
+	name := strings.TrimSuffix(path.Base(uploadPath(key)), path.Ext(key))
+	if len(name) != sha256.Size*2 || strings.Trim(name, "0123456789abcdef") != "" {
+		return "", false
+	}
+	return strings.TrimSuffix(path.Base(key), path.Ext(key)), true
+}
+
+// reuseUpload looks for an upload of the same file in dir and pins it, or
+// returns "" when the file has to be stored. The caller unpins it with
+// promoteUpload once its own reference committed, or discardUpload.
+func reuseUpload(dir, hash string) (string, error) {
+	uploadLock.Lock()
+	defer uploadLock.Unlock()
+
+	var key string
+	err := db.QueryRow("SELECT path FROM uploads WHERE path GLOB ? LIMIT 1", dir+"/"+hash+".*").Scan(&key)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	pinnedUploads[key]++
+	return key, nil
+}
+
+func unpinUpload(key string) {
+	if pinnedUploads[key]--; pinnedUploads[key] <= 0 {
+		delete(pinnedUploads, key)
+	}
+}
+
+// promoteUpload puts an upload in place after the database committed to
+// it: staged files are moved to their keys, reused ones unpinned
+func promoteUpload(stage, key string) {
+	uploadLock.Lock()
+	defer uploadLock.Unlock()
+
+	if stage == "" {
+		unpinUpload(key)
+		return
+	}
+	promoteBlobs(stage, uploadKeys([]string{key}))
+}
+
+// discardUpload drops an upload whose transaction did not commit: staged
+// files are deleted, reused ones unpinned and removed if their last other
+// reference went away in the meantime
+func discardUpload(stage, key string) {
+	if stage != "" {
+		discardBlobs(stage, uploadKeys([]string{key}))
+		return
+	}
+	uploadLock.Lock()
+	unpinUpload(key)
+	uploadLock.Unlock()
+	removeUploads([]string{key})
+}
+
+// removeUploads deletes the files of uploads nothing refers to anymore.
+// Call it after the references were deleted and committed.
+func removeUploads(paths []string) {
+	uploadLock.Lock()
+	defer uploadLock.Unlock()
+
+	for _, upload := range paths {
+		if pinnedUploads[upload] > 0 {
+			continue
+		}
+		var referenced bool
+		err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM uploads WHERE path = ?)", upload).Scan(&referenced)
+		if err != nil {
+			log.Printf("Failed to count references to upload %s: %v", upload, err)
+			continue
+		}
+		if !referenced {
+			removeBlobs(uploadKeys([]string{upload}))
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package myserver
+
+import "testing"
+
+func TestUploadRefs(t *testing.T) {
+	db = openTestDB(t)
+	useTestStore(t)
+	db.Exec("INSERT INTO users (id, username, email, password) VALUES (1, 'alice', 'alice@example.com', 'x')")
+	db.Exec("INSERT INTO posts (id, user_id, title, content) VALUES (1, 1, 'post', 'content')")
+	db.Exec("INSERT INTO posts (id, user_id, title, content) VALUES (2, 1, 'again', 'content')")
+	pdf := []byte("%PDF-1.4\n%%EOF\n")
+
+	refs := func() int {
+		t.Helper()
+		var n int
+		db.QueryRow("SELECT COALESCE(SUM(refs), 0) FROM uploads").Scan(&n)
+		return n
+	}
+	stored := func(key string) bool {
+		_, err := storedSize(key)
+		return err == nil
+	}
+	// unlink deletes a post's attachments the way deleting a post does
+	unlink := func(postID int, key string) {
+		t.Helper()
+		if _, err := db.Exec("DELETE FROM attachments WHERE post_id = ?", postID); err != nil {
+			t.Fatal(err)
+		}
+		removeUploads([]string{key})
+	}
+
+	key := storeAttachment(t, 1, pdf).Path
+	if again := storeAttachment(t, 2, pdf); again.Path != key {
+		t.Fatalf("the same file got a second key %s", again.Path)
+	}
+	if n := refs(); n != 2 {
+		t.Errorf("%d references, want 2", n)
+	}
+	_, err := db.Exec("INSERT INTO post_revisions (post_id, editor_id, content, image_path) VALUES (1, 1, 'old', ?)", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := refs(); n != 3 {
+		t.Errorf("%d references with the revision, want 3", n)
+	}
+	db.Exec("DELETE FROM post_revisions")
+
+	unlink(1, key)
+	if n := refs(); n != 1 || !stored(key) {
+		t.Errorf("after one post went: %d references, stored %v; want 1, true", n, stored(key))
+	}
+
+	// a request about to reuse the file keeps it while the last post goes
+	reused, err := reuseUpload(fileDir, uploadHash(pdf))
+	if err != nil || reused != key {
+		t.Fatalf("reuseUpload = %q, %v; want %s", reused, err, key)
+	}
+	unlink(2, key)
+	if n := refs(); n != 0 || !stored(key) {
+		t.Errorf("while pinned: %d references, stored %v; want 0, true", n, stored(key))
+	}
+	discardUpload("", reused)
+	if stored(key) || len(pinnedUploads) != 0 {
+		t.Errorf("after the request gave up: stored %v, pinned %v; want the file gone", stored(key), pinnedUploads)
+	}
+}
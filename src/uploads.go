@@ -0,0 +1,505 @@
+package myserver
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+)
+
+// uploadType is an accepted kind of upload. The type is always sniffed from
+// the file's content; the client's file name and Content-Type are ignored.
+// Only inline types are shown by the browser, the others are downloaded.
+type uploadType struct {
+	ext     string
+	maxSize int64
+	inline  bool
+	check   func(data []byte, mimeType string) error
+}
+
+var uploadTypes = map[string]uploadType{
+	"image/jpeg":      {".jpg", 8 << 20, true, checkImage},
+	"image/png":       {".png", 8 << 20, true, checkImage},
+	"image/gif":       {".gif", 4 << 20, true, checkImage},
+	"application/pdf": {".pdf", 10 << 20, false, checkPDF},
+}
+
+func isImageType(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "image/")
+}
+
+const (
+	// maxUploadRequest caps whole upload requests, a post's attachments
+	// together plus room for the other form fields
+	maxUploadRequest = 50 << 20
+
+	// maxImagePixels rejects images that are small on disk but would take
+	// gigabytes once decoded
+	maxImagePixels = 40_000_000
+
+	// maxAnimationPixels does the same for animated GIFs, whose frames are
+	// decoded all at once: it caps the canvas times the number of frames
+	maxAnimationPixels = 100_000_000
+)
+
+var (
+	errBadUpload      = errors.New("invalid upload")
+	errUploadTooLarge = errors.New("upload too large")
+)
+
+// markupSignatures betray comments and metadata that are also HTML, SVG or
+// script, so that a browser sniffing the file might run it. Only the text an
+// image carries is searched: compressed pixel data, given enough of it,
+// contains any short string by chance.
+var markupSignatures = [][]byte{
+	[]byte("<html"), []byte("<!doctype"), []byte("<head"), []byte("<body"), []byte("<script"),
+	[]byte("<iframe"), []byte("<svg"), []byte("<?php"), []byte("javascript:"),
+}
+
+// readUpload reads an uploaded file and checks that it is of an allowed
+// type within that type's size limit, and nothing else besides. It returns
+// the content and the sniffed MIME type.
+func readUpload(file multipart.File) ([]byte, string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, "", fmt.Errorf("%w: empty file", errBadUpload)
+	}
+	head = head[:n]
+
+	mimeType := http.DetectContentType(head)
+	kind, ok := uploadTypes[mimeType]
+	if !ok {
+		return nil, "", fmt.Errorf("%w: only JPEG, PNG and GIF images and PDF documents are allowed", errBadUpload)
+	}
+
+	rest, err := io.ReadAll(io.LimitReader(file, kind.maxSize-int64(n)+1))
+	if err != nil {
+		return nil, "", err
+	}
+	data := append(head, rest...)
+	if int64(len(data)) > kind.maxSize {
+		return nil, "", fmt.Errorf("%w: %s files may be at most %d MB", errUploadTooLarge,
+			strings.ToUpper(strings.TrimPrefix(kind.ext, ".")), kind.maxSize>>20)
+	}
+
+	if err := kind.check(data, mimeType); err != nil {
+		return nil, "", err
+	}
+	return data, mimeType, nil
+}
+
+// checkImage rejects polyglots: the whole file has to decode as the sniffed
+// image type, nothing may follow the end of the image, and no markup may be
+// hidden in its comments or metadata.
+func checkImage(data []byte, mimeType string) error {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || "image/"+format != mimeType {
+		return fmt.Errorf("%w: the image is damaged", errBadUpload)
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return fmt.Errorf("%w: the image has too many pixels", errBadUpload)
+	}
+	layout, err := layoutImage(data, mimeType)
+	if err != nil {
+		return fmt.Errorf("%w: the image is damaged", errBadUpload)
+	}
+	if config.Width*config.Height*max(layout.frames, 1) > maxAnimationPixels {
+		return fmt.Errorf("%w: the animation has too many frames for its size", errBadUpload)
+	}
+	if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("%w: the image is damaged", errBadUpload)
+	}
+
+	if layout.end < len(data) {
+		return fmt.Errorf("%w: unexpected data after the image", errBadUpload)
+	}
+	for _, text := range layout.text {
+		lower := bytes.ToLower(text)
+		for _, signature := range markupSignatures {
+			if bytes.Contains(lower, signature) {
+				return fmt.Errorf("%w: the file contains markup", errBadUpload)
+			}
+		}
+	}
+	return nil
+}
+
+// checkPDF makes sure a PDF is complete. PDFs are never shown inline, so
+// whatever else they contain cannot run on this site.
+func checkPDF(data []byte, mimeType string) error {
+	tail := data[max(len(data)-1024, 0):]
+	if !bytes.HasPrefix(data, []byte("%PDF-")) || !bytes.Contains(tail, []byte("%%EOF")) {
+		return fmt.Errorf("%w: the document is damaged", errBadUpload)
+	}
+	return nil
+}
+
+// imageLayout is what walking the blocks of an image file finds
+type imageLayout struct {
+	end    int      // offset just past the image's end marker
+	text   [][]byte // comments and textual metadata
+	frames int      // of a GIF
+}
+
+var errImageLayout = errors.New("malformed image")
+
+// layoutImage walks the chunks, segments or blocks an image is made of,
+// the way a decoder does, up to the end marker
+func layoutImage(data []byte, mimeType string) (imageLayout, error) {
+	switch mimeType {
+	case "image/png":
+		return layoutPNG(data)
+	case "image/jpeg":
+		return layoutJPEG(data)
+	case "image/gif":
+		return layoutGIF(data)
+	}
+	return imageLayout{}, fmt.Errorf("%w: unknown type %s", errImageLayout, mimeType)
+}
+
+// maxImageText caps the inflated size of a compressed PNG text chunk
+const maxImageText = 1 << 20
+
+func layoutPNG(data []byte) (imageLayout, error) {
+	var layout imageLayout
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return layout, errImageLayout
+	}
+	// chunks: length, type, data, CRC
+	for i := 8; i+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		kind := string(data[i+4 : i+8])
+		if length > len(data)-i-12 {
+			return layout, errImageLayout
+		}
+		chunk := data[i+8 : i+8+length]
+		i += 12 + length
+
+		switch kind {
+		case "IEND":
+			layout.end = i
+			return layout, nil
+		case "tEXt", "zTXt", "iTXt":
+			text, err := pngText(kind, chunk)
+			if err != nil {
+				return layout, err
+			}
+			layout.text = append(layout.text, text)
+		}
+	}
+	return layout, errImageLayout
+}
+
+// pngText returns the content of a text chunk, inflated if it is compressed
+func pngText(kind string, chunk []byte) ([]byte, error) {
+	keyword, text, ok := bytes.Cut(chunk, []byte{0})
+	switch {
+	case kind == "tEXt":
+		return chunk, nil
+	case !ok:
+		return nil, errImageLayout
+	case kind == "zTXt":
+		// compression method, then the text
+		if len(text) == 0 {
+			return nil, errImageLayout
+		}
+		text = text[1:]
+	case kind == "iTXt":
+		// compression flag and method, language tag, translated keyword
+		if len(text) < 2 {
+			return nil, errImageLayout
+		}
+		compressed := text[0] == 1
+		parts := bytes.SplitN(text[2:], []byte{0}, 3)
+		if len(parts) < 3 {
+			return nil, errImageLayout
+		}
+		if !compressed {
+			return chunk, nil
+		}
+		text = parts[2]
+	}
+
+	r, err := zlib.NewReader(bytes.NewReader(text))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errImageLayout, err)
+	}
+	inflated, err := io.ReadAll(io.LimitReader(r, maxImageText+1))
+	if err != nil || len(inflated) > maxImageText {
+		return nil, errImageLayout
+	}
+	return slices.Concat(keyword, []byte{0}, inflated), nil
+}
+
+// xmpNamespace starts the APP1 segments that hold XMP metadata
+var xmpNamespace = []byte("http://ns.adobe.com/xap/1.0/\x00")
+
+func layoutJPEG(data []byte) (imageLayout, error) {
+	var layout imageLayout
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return layout, errImageLayout
+	}
+	for i := 2; ; {
+		// a marker, after any number of 0xFF fill bytes
+		if i >= len(data) || data[i] != 0xFF {
+			return layout, errImageLayout
+		}
+		for i < len(data) && data[i] == 0xFF {
+			i++
+		}
+		if i >= len(data) {
+			return layout, errImageLayout
+		}
+		marker := data[i]
+		i++
+		if marker == 0xD9 {
+			layout.end = i
+			return layout, nil
+		}
+		if marker == 0x01 || marker >= 0xD0 && marker <= 0xD7 {
+			continue
+		}
+
+		// a segment, its length counting the length itself
+		if i+2 > len(data) {
+			return layout, errImageLayout
+		}
+		length := int(binary.BigEndian.Uint16(data[i:]))
+		if length < 2 || i+length > len(data) {
+			return layout, errImageLayout
+		}
+		segment := data[i+2 : i+length]
+		i += length
+
+		switch {
+		case marker == 0xFE:
+			layout.text = append(layout.text, segment)
+		case marker == 0xE1 && bytes.HasPrefix(segment, xmpNamespace):
+			layout.text = append(layout.text, segment)
+		case marker == 0xDA:
+			// entropy-coded data runs up to the next marker; in it, 0xFF is
+			// only followed by a stuffed zero or a restart marker
+			for i+1 < len(data) && (data[i] != 0xFF || data[i+1] == 0 || data[i+1] >= 0xD0 && data[i+1] <= 0xD7) {
+				i++
+			}
+		}
+	}
+}
+
+func layoutGIF(data []byte) (imageLayout, error) {
+	var layout imageLayout
+	// header and logical screen descriptor, then the global color table
+	if len(data) < 13 {
+		return layout, errImageLayout
+	}
+	i := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		i += 3 << (flags&7 + 1)
+	}
+	for i < len(data) {
+		block := data[i]
+		i++
+		switch block {
+		case 0x3B: // trailer
+			layout.end = i
+			return layout, nil
+
+		case 0x21: // extension: label, then data sub-blocks
+			if i >= len(data) {
+				return layout, errImageLayout
+			}
+			label := data[i]
+			// comment and plain text extensions
+			keep := label == 0xFE || label == 0x01
+			text, next, err := gifSubBlocks(data, i+1, keep)
+			if err != nil {
+				return layout, err
+			}
+			if keep {
+				layout.text = append(layout.text, text)
+			}
+			i = next
+
+		case 0x2C: // image descriptor, local color table, LZW code size, data
+			if i+10 > len(data) {
+				return layout, errImageLayout
+			}
+			layout.frames++
+			if flags := data[i+8]; flags&0x80 != 0 {
+				i += 3 << (flags&7 + 1)
+			}
+			_, next, err := gifSubBlocks(data, i+10, false)
+			if err != nil {
+				return layout, err
+			}
+			i = next
+
+		default:
+			return layout, errImageLayout
+		}
+	}
+	return layout, errImageLayout
+}
+
+// gifSubBlocks skips the data sub-blocks starting at i, returning the
+// offset past their terminator and, if keep is set, their joined content
+func gifSubBlocks(data []byte, i int, keep bool) ([]byte, int, error) {
+	var content []byte
+	for i < len(data) {
+		size := int(data[i])
+		i++
+		if size == 0 {
+			return content, i, nil
+		}
+		if i+size > len(data) {
+			break
+		}
+		if keep {
+			content = append(content, data[i:i+size]...)
+		}
+		i += size
+	}
+	return nil, 0, errImageLayout
+}
+
+// uploadFailed answers a request whose upload could not be saved
+func uploadFailed(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUploadTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errBadUpload):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Println("Failed to save file:", err)
+		http.Error(w, "Failed to upload file", http.StatusInternalServerError)
+	}
+}
+
+// uploadContentType is the type an upload is served as, going by its
+// extension. Files of other types, uploaded before uploads were checked,
+// are only offered as downloads.
+func uploadContentType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ext == ".jpeg" {
+		ext = ".jpg"
+	}
+	for mimeType, kind := range uploadTypes {
+		if kind.ext == ext {
+			return mimeType
+		}
+	}
+	return "application/octet-stream"
+}
+
+func uploadDisposition(mimeType string) string {
+	if uploadTypes[mimeType].inline {
+		return "inline"
+	}
+	return "attachment"
+}
+
+// ServeUploads serves stored uploads with headers that keep browsers from
+// treating them as anything but what they were accepted as, answering
+// conditional and range requests. Files are only served to those who may
+// see them, see canViewUpload. While links expire, the signature stands in
+// for that check, and stores that sign their own links, like S3, are not
+// served from here at all.
+func ServeUploads() http.Handler {
+	return http.StripPrefix("/uploads/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		key := r.URL.Path
+		if strings.HasPrefix(key, stagingDir+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		if blobURLExpiry > 0 {
+			local, ok := blobs.(*LocalStore)
+			if !ok || !local.validSignature(key, r.URL.Query()) {
+				http.Error(w, "This link has expired", http.StatusForbidden)
+				return
+			}
+		} else {
+			// files that may not be seen look like files that do not exist
+			userID, err := currentUserID(r)
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			visible, err := canViewUpload(userID, key)
+			if err != nil {
+				log.Printf("Failed to check access to upload %s: %v", key, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			} else if !visible {
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		blob, err := blobs.Open(key)
+		if err == errBlobNotFound {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			log.Printf("Failed to open upload %s: %v", key, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer blob.Close()
+
+		header := w.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+		mimeType := uploadContentType(key)
+		header.Set("Content-Type", mimeType)
+		header.Set("Content-Disposition", uploadDisposition(mimeType))
+
+		// a file named after its content never changes, so browsers may keep
+		// it; other files are checked again every time they are used
+		if name, ok := contentKey(key); ok {
+			header.Set("ETag", `"`+name+`"`)
+			header.Set("Cache-Control", "private, max-age=31536000, immutable")
+		} else {
+			header.Set("ETag", fmt.Sprintf(`"%x-%x"`, blob.ModTime.UnixNano(), blob.Size))
+			header.Set("Cache-Control", "private, no-cache")
+		}
+		http.ServeContent(w, r, key, blob.ModTime, blob)
+	}))
+}
+
+// canViewUpload tells whether a signed in user may see a stored file.
+// Avatars in use and the files of posts, including images old revisions
+// kept, are shown to everyone signed in. The files of a scheduled draft are only
+// shown to its author until it is published; a file attached to a post as
+// well is visible through that post. Direct messages are text only, so no
+// upload belongs to one, and a file nothing above refers to is not shown.
+func canViewUpload(userID int, key string) (bool, error) {
+	var visible bool
+	if strings.HasPrefix(key, avatarDir+"/") {
+		err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE avatar = ?)", avatarOf(key)).Scan(&visible)
+		return visible, err
+	}
+	upload := uploadPath(key)
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM attachments
+			LEFT JOIN drafts ON drafts.id = attachments.draft_id
+			WHERE attachments.path = ? AND (attachments.post_id IS NOT NULL OR drafts.user_id = ?))`,
+		upload, userID).Scan(&visible)
+	if err != nil || visible {
+		return visible, err
+	}
+	err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM post_revisions WHERE image_path = ?)", upload).Scan(&visible)
+	return visible, err
+}
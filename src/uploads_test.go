@@ -0,0 +1,273 @@
+package myserver
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// memFile serves an in-memory upload as a multipart.File
+type memFile struct{ *bytes.Reader }
+
+func (memFile) Close() error { return nil }
+
+func testImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for x := range 16 {
+		img.Set(x, x/2, color.RGBA{255, uint8(x * 16), 0, 255})
+	}
+	return img
+}
+
+func encodeTestImage(t *testing.T, mimeType string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	switch mimeType {
+	case "image/png":
+		err = png.Encode(&buf, testImage())
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, testImage(), nil)
+	case "image/gif":
+		err = gif.Encode(&buf, testImage(), nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pngChunk encodes one PNG chunk with its length and CRC
+func pngChunk(kind string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// pngIHDR describes an 8-bit grayscale image
+func pngIHDR(width, height uint32) []byte {
+	header := binary.BigEndian.AppendUint32(nil, width)
+	header = binary.BigEndian.AppendUint32(header, height)
+	return pngChunk("IHDR", append(header, 8, 0, 0, 0, 0))
+}
+
+// rawPNG builds a grayscale PNG one row high whose pixel data is stored
+// uncompressed, so that the pixels appear in the file as they are
+func rawPNG(pixels string) []byte {
+	var idat bytes.Buffer
+	w, _ := zlib.NewWriterLevel(&idat, zlib.NoCompression)
+	w.Write(append([]byte{0}, pixels...))
+	w.Close()
+
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = append(data, pngIHDR(uint32(len(pixels)), 1)...)
+	data = append(data, pngChunk("IDAT", idat.Bytes())...)
+	return append(data, pngChunk("IEND", nil)...)
+}
+
+// insertPNGChunk adds a chunk right after IHDR
+func insertPNGChunk(data []byte, kind string, content []byte) []byte {
+	at := 8 + 25
+	return bytes.Join([][]byte{data[:at], pngChunk(kind, content), data[at:]}, nil)
+}
+
+// insertJPEGSegment adds a segment right after SOI
+func insertJPEGSegment(data []byte, marker byte, content []byte) []byte {
+	segment := binary.BigEndian.AppendUint16([]byte{0xFF, marker}, uint16(len(content)+2))
+	return bytes.Join([][]byte{data[:2], segment, content, data[2:]}, nil)
+}
+
+// insertGIFComment adds a comment extension before the trailer
+func insertGIFComment(data []byte, comment string) []byte {
+	extension := append([]byte{0x21, 0xFE, byte(len(comment))}, comment...)
+	extension = append(extension, 0)
+	return bytes.Join([][]byte{data[:len(data)-1], extension, {0x3B}}, nil)
+}
+
+// manyFrames builds an animation of tiny frames on a large canvas, small
+// on disk but too large to decode
+func manyFrames(t *testing.T) []byte {
+	frame := image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black, color.White})
+	animation := &gif.GIF{Config: image.Config{ColorModel: frame.Palette, Width: 2000, Height: 2000}}
+	for range maxAnimationPixels/(2000*2000) + 1 {
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, animation); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zlibBytes(s string) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write([]byte(s))
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestCheckImage(t *testing.T) {
+	pngData := encodeTestImage(t, "image/png")
+	jpegData := encodeTestImage(t, "image/jpeg")
+	gifData := encodeTestImage(t, "image/gif")
+	html := "<html><script>alert(1)</script></html>"
+
+	tests := []struct {
+		name, mimeType string
+		data           []byte
+		err            string // part of the error, "" if the image passes
+	}{
+		{"png", "image/png", pngData, ""},
+		{"jpeg", "image/jpeg", jpegData, ""},
+		{"gif", "image/gif", gifData, ""},
+		{"pixels that spell markup", "image/png", rawPNG("<svg<body<html"), ""},
+		{"harmless png text", "image/png", insertPNGChunk(pngData, "tEXt", []byte("Comment\x00a <3 b")), ""},
+		{"harmless jpeg comment", "image/jpeg", insertJPEGSegment(jpegData, 0xFE, []byte("made with love")), ""},
+
+		{"png text", "image/png", insertPNGChunk(pngData, "tEXt", []byte("Comment\x00"+html)), "markup"},
+		{"compressed png text", "image/png", insertPNGChunk(pngData, "zTXt", append([]byte("Comment\x00\x00"), zlibBytes(html)...)), "markup"},
+		{"international png text", "image/png", insertPNGChunk(pngData, "iTXt", []byte("Comment\x00\x00\x00en\x00\x00<SVG onload=alert(1)>")), "markup"},
+		{"jpeg comment", "image/jpeg", insertJPEGSegment(jpegData, 0xFE, []byte(html)), "markup"},
+		{"jpeg xmp", "image/jpeg", insertJPEGSegment(jpegData, 0xE1, append(xmpNamespace, html...)), "markup"},
+		{"gif comment", "image/gif", insertGIFComment(gifData, html), "markup"},
+
+		{"html after png", "image/png", append(bytes.Clone(pngData), html...), "after the image"},
+		{"html after png with IEND", "image/png", append(bytes.Clone(pngData), html+"IEND\xae\x42\x60\x82"...), "after the image"},
+		{"html after jpeg", "image/jpeg", append(bytes.Clone(jpegData), html...), "after the image"},
+		{"html after jpeg with EOI", "image/jpeg", append(bytes.Clone(jpegData), html+"\xFF\xD9"...), "after the image"},
+		{"html after gif", "image/gif", append(bytes.Clone(gifData), html+";"...), "after the image"},
+
+		{"too many pixels", "image/png", append(append([]byte("\x89PNG\r\n\x1a\n"), pngIHDR(10000, 10000)...), pngChunk("IEND", nil)...), "too many pixels"},
+		{"too many frames", "image/gif", manyFrames(t), "too many frames"},
+		{"wrong type", "image/png", jpegData, "damaged"},
+		{"truncated", "image/jpeg", jpegData[:len(jpegData)/2], "damaged"},
+	}
+	for _, test := range tests {
+		err := checkImage(test.data, test.mimeType)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: got %v, want an error about %q", test.name, err, test.err)
+		case err != nil && !errors.Is(err, errBadUpload):
+			t.Errorf("%s: %v is not errBadUpload", test.name, err)
+		}
+	}
+}
+
+func TestLayoutImage(t *testing.T) {
+	for _, mimeType := range []string{"image/png", "image/jpeg", "image/gif"} {
+		data := encodeTestImage(t, mimeType)
+		layout, err := layoutImage(data, mimeType)
+		if err != nil || layout.end != len(data) {
+			t.Errorf("%s: end %d, %v; want %d", mimeType, layout.end, err, len(data))
+		}
+
+		padded := append(bytes.Clone(data), "\x00\x00IEND\xFF\xD9;"...)
+		if layout, err := layoutImage(padded, mimeType); err != nil || layout.end != len(data) {
+			t.Errorf("%s with trailing data: end %d, %v; want %d", mimeType, layout.end, err, len(data))
+		}
+
+		for _, cut := range []int{0, 10, len(data) / 2, len(data) - 1} {
+			if layout, err := layoutImage(data[:cut], mimeType); err == nil {
+				t.Errorf("%s cut to %d bytes: end %d, want an error", mimeType, cut, layout.end)
+			}
+		}
+	}
+}
+
+func TestReadUpload(t *testing.T) {
+	pngData := encodeTestImage(t, "image/png")
+	pdf := []byte("%PDF-1.4\n1 0 obj\n<<>>\nendobj\ntrailer\n<<>>\n%%EOF\n")
+
+	tests := []struct {
+		name     string
+		data     []byte
+		mimeType string // the type accepted, or "" if rejected
+		err      error
+	}{
+		{"png", pngData, "image/png", nil},
+		{"pdf", pdf, "application/pdf", nil},
+		{"empty", nil, "", errBadUpload},
+		{"html", []byte("<!DOCTYPE html><html><body>hi</body></html>"), "", errBadUpload},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"/>`), "", errBadUpload},
+		{"polyglot", append(bytes.Clone(pngData), "<script>alert(1)</script>"...), "", errBadUpload},
+		{"pdf without end", pdf[:20], "", errBadUpload},
+		{"oversized png", append(bytes.Clone(pngData), make([]byte, 8<<20)...), "", errUploadTooLarge},
+		{"oversized gif", append(encodeTestImage(t, "image/gif"), make([]byte, 4<<20)...), "", errUploadTooLarge},
+	}
+	for _, test := range tests {
+		data, mimeType, err := readUpload(memFile{bytes.NewReader(test.data)})
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if mimeType != test.mimeType {
+			t.Errorf("%s: type %q, want %q", test.name, mimeType, test.mimeType)
+		}
+		if err == nil && !bytes.Equal(data, test.data) {
+			t.Errorf("%s: read %d bytes, want %d", test.name, len(data), len(test.data))
+		}
+	}
+}
+
+func TestCanViewUpload(t *testing.T) {
+	db = openTestDB(t)
+	setup := []string{
+		"INSERT INTO users (id, username, email, password, avatar) VALUES (1, 'alice', 'alice@example.com', 'x', 'avatars/1_0a1b2c3d')",
+		"INSERT INTO users (id, username, email, password) VALUES (2, 'bob', 'bob@example.com', 'x')",
+		"INSERT INTO posts (id, user_id, title, content) VALUES (1, 1, 'post', 'content')",
+		"INSERT INTO drafts (id, user_id) VALUES (1, 1)",
+		"INSERT INTO attachments (post_id, kind, path, mime_type) VALUES (1, 'image', 'images/posted.png', 'image/png')",
+		"INSERT INTO attachments (draft_id, kind, path, mime_type) VALUES (1, 'file', 'files/draft.pdf', 'application/pdf')",
+		"INSERT INTO attachments (draft_id, kind, path, mime_type) VALUES (1, 'image', 'images/both.png', 'image/png')",
+		"INSERT INTO attachments (post_id, kind, path, mime_type) VALUES (1, 'image', 'images/both.png', 'image/png')",
+		"INSERT INTO post_revisions (post_id, editor_id, content, image_path) VALUES (1, 1, 'old', '1_1700000000.png')",
+	}
+	for _, statement := range setup {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		key        string
+		alice, bob bool
+	}{
+		{"images/posted_thumb.png", true, true},
+		{"images/posted_full.png", true, true},
+		{"files/draft.pdf", true, false},
+		{"images/both_feed.png", true, true},
+		{"1_1700000000.png", true, true},
+		{"files/nothing.pdf", false, false},
+		{"images/nothing_full.png", false, false},
+		{"avatars/1_0a1b2c3d_64.png", true, true},
+		{"avatars/1_0a1b2c3d_256.png", true, true},
+		{"avatars/1_99999999_64.png", false, false},
+		{"avatars/1_0a1b2c3d", false, false},
+		{"avatars/1_0a1b2c3d_65.png", false, false},
+	}
+	for _, test := range tests {
+		for _, viewer := range []struct {
+			id   int
+			want bool
+		}{{1, test.alice}, {2, test.bob}} {
+			visible, err := canViewUpload(viewer.id, test.key)
+			if err != nil || visible != viewer.want {
+				t.Errorf("canViewUpload(%d, %s) = %v, %v; want %v", viewer.id, test.key, visible, err, viewer.want)
+			}
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package myserver
 
 import (
+	"database/sql"
 	"encoding/json"
 	"log"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -24,16 +27,16 @@ var manager = ClientManager{
 	unregister: make(chan *Client),
 }
 
-func (manager *ClientManager) getClientByUserID(userID int) *Client {
-	manager.mutex.Lock()
-	defer manager.mutex.Unlock()
-
-	for client := range manager.clients {
-		if client.id == userID {
-			return client
-		}
+// deliver queues a message for a client without waiting. A client too slow
+// to take it is dropped rather than holding up everyone else. The caller
+// holds the mutex, so a channel is never written to after it was closed.
+func (manager *ClientManager) deliver(client *Client, message []byte) {
+	select {
+	case client.send <- message:
+	default:
+		close(client.send)
+		delete(manager.clients, client)
 	}
-	return nil
 }
 
 func (manager *ClientManager) Start() {
@@ -53,14 +56,37 @@ func (manager *ClientManager) Start() {
 				log.Printf("Client disconnected: %d", client.id)
 			}
 			manager.mutex.Unlock()
+
+		case message := <-manager.broadcast:
+			manager.mutex.Lock()
+			for client := range manager.clients {
+				manager.deliver(client, message)
+			}
+			manager.mutex.Unlock()
 		}
 	}
 }
 
+// SendToClient sends a message to every connection of a user, one per open
+// page
 func (manager *ClientManager) SendToClient(userID int, message []byte) {
-	client := manager.getClientByUserID(userID)
-	if client != nil {
-		client.send <- message
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	for client := range manager.clients {
+		if client.id == userID {
+			manager.deliver(client, message)
+		}
+	}
+}
+
+// sendTo sends a message to a single connection, unless it was closed
+func (manager *ClientManager) sendTo(client *Client, message []byte) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	if manager.clients[client] {
+		manager.deliver(client, message)
 	}
 }
 
@@ -102,9 +128,24 @@ func (c *Client) Read() {
 
 		messageID, _ := result.LastInsertId()
 
+		// a DM is private, so of the people it mentions only the recipient
+		// is notified
+		mentioned, err := saveMentions(db, "message", messageID, senderID, content)
+		if err != nil {
+			log.Printf("Failed to save mentions: %v", err)
+		}
+		if slices.Contains(mentioned, recipientID) {
+			go notifyMentions([]int{recipientID}, senderID, "/chat", content)
+		}
+		_, names, err := mentionedUsers("message", messageID)
+		if err != nil {
+			log.Printf("Failed to load mentions: %v", err)
+		}
+
 		
 		var username string
-		err = db.QueryRow("SELECT username FROM users WHERE id = ?", senderID).Scan(&username)
+		var avatar sql.NullString
+		err = db.QueryRow("SELECT username, avatar FROM users WHERE id = ?", senderID).Scan(&username, &avatar)
 		if err != nil {
 			log.Printf("Failed to get username: %v", err)
 		}
@@ -114,14 +155,17 @@ func (c *Client) Read() {
 			SenderID:    senderID,
 			RecipientID: recipientID,
 			Username:    username,
+			Avatar:      avatarURL(avatar.String, 32),
+			Initials:    initials(username),
 			Content:     content,
+			HTML:        renderWithMentions(content, names),
 			CreatedAt:   time.Now(),
 			IsSent:      true,
 			Type:        "message",
 		}
 
 		responseMsgBytes, _ := json.Marshal(responseMsg)
-		c.send <- responseMsgBytes
+		manager.sendTo(c, responseMsgBytes)
 
 		responseMsg.IsSent = false
 		recipientMsgBytes, _ := json.Marshal(responseMsg)
@@ -181,17 +225,19 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		send:   make(chan []byte, 256),
 	}
 
-	manager.register <- client
-
-	go client.Read()
-	go client.Write()
-
+	// queued before the client is registered, while nothing else can
+	// write to or close its channel
 	initMsg := Message{
 		Type:    "connect",
 		Content: "Connected to chat server",
 	}
 	msgBytes, _ := json.Marshal(initMsg)
 	client.send <- msgBytes
+
+	manager.register <- client
+
+	go client.Read()
+	go client.Write()
 }
 
 func LoadChatHistory(w http.ResponseWriter, r *http.Request) {
@@ -221,7 +267,8 @@ func LoadChatHistory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	rows, err := db.Query(`
-		SELECT m.id, m.sender_id, m.recipient_id, m.content, m.created_at, u.username 
+		SELECT m.id, m.sender_id, m.recipient_id, m.content, m.created_at, u.username, u.avatar,
+		`+mentionNames("message", "m.id")+`
 		FROM messages m
 		JOIN users u ON m.sender_id = u.id
 		WHERE (m.sender_id = ? AND m.recipient_id = ?) 
@@ -239,10 +286,15 @@ func LoadChatHistory(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var msg Message
 		var createdAt string
-		if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.RecipientID, &msg.Content, &createdAt, &msg.Username); err != nil {
+		var avatar, mentions sql.NullString
+		if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.RecipientID, &msg.Content, &createdAt, &msg.Username, &avatar,
+			&mentions); err != nil {
 			log.Printf("Error scanning message: %v", err)
 			continue
 		}
+		msg.Avatar = avatarURL(avatar.String, 32)
+		msg.Initials = initials(msg.Username)
+		msg.HTML = renderWithMentions(msg.Content, strings.Fields(mentions.String))
 		parsedTime, err := time.Parse(time.RFC3339, createdAt)
 		if err != nil {
 			log.Println("Invalid timestamp format:", createdAt, "error:", err)
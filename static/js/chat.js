@@ -72,10 +72,29 @@ function appendMessage(msg) {
 
     const infoDiv = document.createElement('div');
     infoDiv.className = 'message-info';
-    infoDiv.textContent = `${msg.username} • ${formatTime(msg.created_at)}`;
 
+    const avatarSpan = document.createElement('span');
+    avatarSpan.className = 'comment-avatar';
+    if (msg.avatar) {
+        const img = document.createElement('img');
+        img.src = msg.avatar;
+        img.alt = msg.username;
+        avatarSpan.appendChild(img);
+    } else {
+        avatarSpan.textContent = msg.initials || '';
+    }
+    infoDiv.appendChild(avatarSpan);
+    infoDiv.appendChild(document.createTextNode(`${msg.username} • ${formatTime(msg.created_at)}`));
+
+    // html is rendered and sanitized by the server; fall back to plain text
+    // for system messages
     const contentDiv = document.createElement('div');
-    contentDiv.textContent = msg.content;
+    if (msg.html) {
+        contentDiv.className = 'markdown';
+        contentDiv.innerHTML = msg.html;
+    } else {
+        contentDiv.textContent = msg.content;
+    }
 
     messageDiv.appendChild(infoDiv);
     messageDiv.appendChild(contentDiv);
@@ -94,13 +113,12 @@ function handleContactClick(item) {
 
     const contactId = item.dataset.userid;
     const name = item.querySelector('.contact-name').textContent;
-    const initials = item.querySelector('.contact-avatar').textContent;
-    const bg = item.querySelector('.contact-avatar').style.background;
+    // copies the uploaded avatar image, or the initials fallback
+    const contactAvatar = item.querySelector('.contact-avatar');
 
     document.getElementById('current-chat-name').textContent = name;
     const avatar = document.getElementById('current-chat-avatar');
-    avatar.textContent = initials;
-    avatar.style.background = bg;
+    avatar.innerHTML = contactAvatar.innerHTML;
     document.getElementById('recipient-id').value = contactId;
     document.getElementById('message-text').disabled = false;
     document.querySelector('#message-form button').disabled = false;
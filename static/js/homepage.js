@@ -1,19 +1,6 @@
 document.addEventListener("DOMContentLoaded", () => {
     // ========== Helper Functions ==========
 
-    async function sendLike(endpoint, id, spanSelector) {
-        const response = await fetch(endpoint, {
-            method: "POST",
-            headers: { "Content-Type": "application/x-www-form-urlencoded" },
-            body: `${endpoint.includes("comment") ? 'comment_id' : 'post_id'}=${id}`,
-        });
-
-        if (response.ok) {
-            const updatedLikes = await response.text();
-            spanSelector.textContent = updatedLikes;
-        }
-    }
-
     function toggleVisibility(element) {
         element.classList.toggle('visible');
     }
@@ -24,52 +11,273 @@ document.addEventListener("DOMContentLoaded", () => {
 
     function validatePostForm() {
         const tagCheckboxes = postForm.querySelectorAll('input[name="tags"]:checked');
+        const titleField = postForm.querySelector('input[name="title"]');
         const contentField = postForm.querySelector('textarea[name="content"]');
         const hasTags = tagCheckboxes.length > 0;
+        const hasTitle = titleField.value.trim().length > 0;
         const hasContent = contentField.value.trim().length > 0;
 
-        postButton.disabled = !(hasTags && hasContent);
+        postButton.disabled = !(hasTags && hasTitle && hasContent);
         postButton.style.cursor = postButton.disabled ? 'not-allowed' : 'pointer';
     }
 
-    function previewImage(fileInput, previewContainer) {
-        if (fileInput.files && fileInput.files[0]) {
-            const reader = new FileReader();
-            reader.onload = function (e) {
-                previewContainer.innerHTML = `<img src="${e.target.result}" alt="Preview" class="image-preview">`;
-            };
-            reader.readAsDataURL(fileInput.files[0]);
+    // Handlers are delegated from the document so posts appended by the
+    // infinite scroll behave like the server rendered ones.
+
+    // ========== Reactions ==========
+
+    // renderReactions redraws the reaction buttons of a post or comment.
+    // Broadcast counts do not say what this user reacted with, so unless
+    // the answer is our own the current highlighting is kept.
+    function renderReactions(bar, reactions, own) {
+        const reacted = new Set([...bar.querySelectorAll(':scope > .reaction.reacted')].map(b => b.dataset.emoji));
+        bar.querySelectorAll(':scope > .reaction').forEach(b => b.remove());
+
+        const picker = bar.querySelector(':scope > .reaction-picker');
+        for (const reaction of reactions) {
+            const button = document.createElement('button');
+            button.className = 'reaction';
+            button.classList.toggle('reacted', own ? reaction.reacted : reacted.has(reaction.emoji));
+            button.dataset.emoji = reaction.emoji;
+            button.append(`${reaction.emoji} `);
+            const count = document.createElement('span');
+            count.className = 'reaction-count';
+            count.textContent = reaction.count;
+            button.append(count);
+            bar.insertBefore(button, picker);
+        }
+    }
+
+    async function react(bar, emoji, add) {
+        const params = new URLSearchParams({ emoji });
+        if (bar.dataset.commentId) {
+            params.set('comment_id', bar.dataset.commentId);
+        } else {
+            params.set('post_id', bar.dataset.postId);
         }
+        const response = await fetch(`/api/reactions?${params}`, { method: add ? 'PUT' : 'DELETE' });
+        if (!response.ok) throw new Error(await response.text());
+        const summary = await response.json();
+        renderReactions(bar, summary.reactions, true);
     }
 
-    // ========== Like Buttons ==========
+    document.addEventListener("click", async (e) => {
+        const button = e.target.closest(".reaction, .reaction-choice");
+        if (!button) return;
+        e.preventDefault();
+        const bar = button.closest(".reactions");
+        const add = !button.classList.contains('reacted');
 
-    document.querySelectorAll(".like-btn").forEach(button => {
-        button.addEventListener("click", async () => {
-            const postID = button.dataset.postId;
-            const likeCount = button.querySelector(".like-count");
-            await sendLike("/like", postID, likeCount);
-        });
+        const picker = button.closest(".reaction-picker");
+        if (picker) picker.open = false;
+        try {
+            await react(bar, button.dataset.emoji, add);
+        } catch (err) {
+            console.error("Error reacting:", err);
+        }
+    });
+
+    function updateReactions(summary) {
+        const selector = summary.comment_id
+            ? `.reactions[data-comment-id="${summary.comment_id}"]`
+            : `.reactions[data-post-id="${summary.post_id}"]`;
+        document.querySelectorAll(selector).forEach(bar => renderReactions(bar, summary.reactions, false));
+    }
+
+    // ========== Comment Threads ==========
+
+    document.addEventListener("click", e => {
+        const button = e.target.closest(".reply-btn");
+        if (!button) return;
+        const form = button.closest('.comment').querySelector(':scope > .reply-form');
+        form.hidden = !form.hidden;
+        if (!form.hidden) form.querySelector('textarea').focus();
+    });
+
+    document.addEventListener("click", e => {
+        const button = e.target.closest(".edit-comment-btn");
+        if (!button) return;
+        const form = button.closest('.comment').querySelector(':scope > .edit-comment-form');
+        form.hidden = !form.hidden;
+        if (!form.hidden) form.querySelector('textarea').focus();
     });
 
-    document.querySelectorAll(".comment-like-btn").forEach(button => {
-        button.addEventListener("click", async (e) => {
+    // authors confirm, moderators removing someone else's comment give a reason
+    document.addEventListener('submit', e => {
+        const form = e.target;
+        if (!form.matches('.delete-comment-form')) return;
+        if (!form.hasAttribute('data-reason-required')) {
+            if (!confirm('Delete this comment?')) e.preventDefault();
+            return;
+        }
+        const reason = prompt('Why is this comment being removed?');
+        if (!reason || !reason.trim()) {
             e.preventDefault();
-            const commentID = button.dataset.commentId;
-            const likeCount = button.querySelector(".comment-like-count");
-            await sendLike("/like-comment", commentID, likeCount);
+            return;
+        }
+        form.elements.reason.value = reason.trim();
+    });
+
+    document.addEventListener("click", e => {
+        const button = e.target.closest(".toggle-replies-btn");
+        if (!button) return;
+        const comment = button.closest('.comment');
+        const collapsed = comment.classList.toggle('collapsed');
+        const count = Number(button.dataset.count);
+        const noun = count === 1 ? 'reply' : 'replies';
+        button.textContent = collapsed ? `Show ${count} ${noun}` : `Hide ${count} ${noun}`;
+    });
+
+    // ========== Comment Pages ==========
+
+    // Feeds show a preview of the top comments; "View all" and the sort links
+    // swap it for the full threads, "Load more" appends the next page.
+    async function loadComments(section, sort, cursor) {
+        const params = new URLSearchParams({ post_id: section.dataset.postId, sort });
+        if (cursor) params.set('cursor', cursor);
+        const response = await fetch(`/api/comments?${params}`);
+        if (!response.ok) throw new Error(response.statusText);
+        const page = await response.json();
+
+        const list = section.querySelector('.comment-list');
+        if (cursor) {
+            list.insertAdjacentHTML('beforeend', page.html);
+        } else {
+            list.innerHTML = page.html;
+        }
+        section.dataset.sort = page.sort;
+        delete section.dataset.preview;
+        section.querySelectorAll('.comment-sorts a').forEach(link => {
+            link.classList.toggle('active', new URL(link.href).searchParams.get('comments') === page.sort);
         });
+
+        let button = section.querySelector(':scope > .load-comments-btn');
+        if (!page.next_cursor) {
+            button?.remove();
+            return;
+        }
+        if (!button) {
+            button = document.createElement('button');
+            button.className = 'load-comments-btn';
+            list.after(button);
+        }
+        button.textContent = 'Load more comments';
+        button.dataset.cursor = page.next_cursor;
+    }
+
+    document.addEventListener('click', async e => {
+        const button = e.target.closest('.load-comments-btn');
+        if (!button) return;
+        const section = button.closest('.comments');
+        button.disabled = true;
+        try {
+            await loadComments(section, section.dataset.sort, button.dataset.cursor);
+        } catch (err) {
+            console.error('Error loading comments:', err);
+        }
+        button.disabled = false;
+    });
+
+    document.addEventListener('click', async e => {
+        const link = e.target.closest('.comment-sorts a');
+        if (!link) return;
+        e.preventDefault();
+        const section = link.closest('.comments');
+        try {
+            await loadComments(section, new URL(link.href).searchParams.get('comments'));
+        } catch (err) {
+            console.error('Error loading comments:', err);
+        }
+    });
+
+    // ========== Bookmarks ==========
+
+    async function putBookmark(postID, collectionID) {
+        const params = new URLSearchParams({ post_id: postID });
+        if (collectionID) params.set('collection_id', collectionID);
+        const response = await fetch(`/api/bookmarks?${params}`, { method: 'PUT' });
+        if (!response.ok) throw new Error(await response.text());
+        return response.json();
+    }
+
+    document.addEventListener("click", async (e) => {
+        const button = e.target.closest(".bookmark-btn");
+        if (!button) return;
+        const postID = button.dataset.postId;
+
+        try {
+            let bookmark;
+            if (button.classList.contains('saved')) {
+                const response = await fetch(`/api/bookmarks?post_id=${postID}`, { method: 'DELETE' });
+                if (!response.ok) throw new Error(await response.text());
+                bookmark = await response.json();
+            } else {
+                bookmark = await putBookmark(postID);
+            }
+            button.classList.toggle('saved', bookmark.saved);
+            button.querySelector('.bookmark-label').textContent = bookmark.saved ? 'Saved' : 'Save';
+            button.title = bookmark.saved ? 'Remove from saved' : 'Save for later';
+        } catch (err) {
+            console.error("Error saving post:", err);
+        }
+    });
+
+    document.addEventListener("change", async (e) => {
+        if (!e.target.matches(".bookmark-collection")) return;
+        try {
+            await putBookmark(e.target.dataset.postId, e.target.value);
+        } catch (err) {
+            alert(err.message);
+        }
+    });
+
+    async function sendCollection(method, params) {
+        const response = await fetch(`/api/collections?${new URLSearchParams(params)}`, { method });
+        if (!response.ok) throw new Error(await response.text());
+        return response.status === 204 ? null : response.json();
+    }
+
+    document.getElementById('new-collection')?.addEventListener('submit', async e => {
+        e.preventDefault();
+        try {
+            const collection = await sendCollection('POST', { name: e.target.name.value });
+            window.location.href = `/saved?collection=${collection.id}`;
+        } catch (err) {
+            alert(err.message);
+        }
+    });
+
+    const renameCollection = document.getElementById('rename-collection');
+
+    renameCollection?.addEventListener('submit', async e => {
+        e.preventDefault();
+        try {
+            await sendCollection('PUT', { id: renameCollection.dataset.collectionId, name: e.target.name.value });
+            window.location.reload();
+        } catch (err) {
+            alert(err.message);
+        }
+    });
+
+    document.getElementById('delete-collection')?.addEventListener('click', async () => {
+        if (!confirm('Delete this collection? Its posts stay saved.')) return;
+        try {
+            await sendCollection('DELETE', { id: renameCollection.dataset.collectionId });
+            window.location.href = '/saved';
+        } catch (err) {
+            alert(err.message);
+        }
     });
 
     // ========== Comment Toggle ==========
 
-    document.querySelectorAll(".toggle-comments-btn").forEach(button => {
-        button.addEventListener("click", function (e) {
-            e.preventDefault();
-            const comments = this.closest('.post').querySelector('.comments');
-            toggleVisibility(comments);
-            toggleClass(this, 'active');
-        });
+    document.addEventListener("click", (e) => {
+        const button = e.target.closest(".toggle-comments-btn");
+        if (!button) return;
+        e.preventDefault();
+        const comments = button.closest('.post').querySelector('.comments');
+        toggleVisibility(comments);
+        toggleClass(button, 'active');
     });
 
     // ========== Post Form Validation ==========
@@ -84,17 +292,363 @@ document.addEventListener("DOMContentLoaded", () => {
             cb.addEventListener('change', validatePostForm);
         });
 
+        postForm.querySelector('input[name="title"]').addEventListener('input', validatePostForm);
         postForm.querySelector('textarea[name="content"]').addEventListener('input', validatePostForm);
     }
 
-    // ========== Image Preview ==========
+    // ========== Drafts ==========
+
+    // The form is saved as a draft a moment after the user stops typing. The
+    // returned id goes into draft_id so later saves update the same draft.
+
+    const draftStatus = document.getElementById('draft-status');
+    const publishLocal = document.getElementById('publish-at-local');
+    const publishAt = postForm?.querySelector('input[name="publish_at"]');
+    let draftTimer = null;
+
+    function toLocalInput(iso) {
+        const date = new Date(iso);
+        const offset = date.getTimezoneOffset() * 60000;
+        return new Date(date - offset).toISOString().slice(0, 16);
+    }
+
+    function updateSubmitLabel() {
+        postButton.textContent = publishAt.value ? 'Schedule Post' : 'Create Post';
+    }
+
+    async function saveDraft() {
+        const data = new FormData(postForm);
+        ['attachments', 'alt', 'caption'].forEach(name => data.delete(name));
+        if (!data.get('title').trim() && !data.get('content').trim()) return;
+
+        try {
+            const response = await fetch('/api/drafts', { method: 'POST', body: data });
+            if (!response.ok) throw new Error(await response.text());
+            const draft = await response.json();
+            postForm.querySelector('input[name="draft_id"]').value = draft.id;
+            draftStatus.textContent = 'Draft saved';
+        } catch (err) {
+            draftStatus.textContent = 'Draft not saved';
+            console.error("Error saving draft:", err);
+        }
+    }
+
+    function scheduleDraftSave() {
+        clearTimeout(draftTimer);
+        draftStatus.textContent = '';
+        draftTimer = setTimeout(saveDraft, 1500);
+    }
+
+    if (postForm && publishAt) {
+        if (publishAt.value) publishLocal.value = toLocalInput(publishAt.value);
+        updateSubmitLabel();
+
+        publishLocal.addEventListener('change', () => {
+            publishAt.value = publishLocal.value ? new Date(publishLocal.value).toISOString() : '';
+            updateSubmitLabel();
+            scheduleDraftSave();
+        });
+        postForm.addEventListener('input', e => {
+            if (e.target.closest('.attachment-upload') || e.target === publishLocal || e.target === pollClosesLocal) return;
+            scheduleDraftSave();
+        });
+        postForm.addEventListener('submit', () => clearTimeout(draftTimer));
+    }
+
+    // ========== Poll Builder ==========
+
+    const pollOptionInputs = document.getElementById('poll-option-inputs');
+    const addPollOption = document.getElementById('add-poll-option');
+    const pollClosesLocal = document.getElementById('poll-closes-local');
+    const pollClosesAt = postForm?.querySelector('input[name="poll_closes_at"]');
+
+    if (pollOptionInputs && addPollOption) {
+        addPollOption.addEventListener('click', () => {
+            const inputs = pollOptionInputs.querySelectorAll('input');
+            if (inputs.length >= 10) return;
+            const input = inputs[0].cloneNode();
+            input.value = '';
+            pollOptionInputs.appendChild(input);
+            input.focus();
+            addPollOption.disabled = inputs.length + 1 >= 10;
+        });
+    }
+
+    if (pollClosesLocal && pollClosesAt) {
+        if (pollClosesAt.value) pollClosesLocal.value = toLocalInput(pollClosesAt.value);
+        pollClosesLocal.addEventListener('change', () => {
+            pollClosesAt.value = pollClosesLocal.value ? new Date(pollClosesLocal.value).toISOString() : '';
+            scheduleDraftSave();
+        });
+    }
+
+    document.querySelectorAll('time.local-time').forEach(el => {
+        el.textContent = new Date(el.getAttribute('datetime')).toLocaleString([], {
+            month: 'short', day: 'numeric', hour: '2-digit', minute: '2-digit',
+        });
+    });
+
+    document.addEventListener('click', async e => {
+        const button = e.target.closest('.delete-draft-btn');
+        if (!button) return;
+        const item = button.closest('.draft-item');
+        if (!confirm('Delete this draft?')) return;
+
+        const response = await fetch(`/api/drafts?id=${item.dataset.draftId}`, { method: 'DELETE' });
+        if (response.ok) {
+            if (postForm.querySelector('input[name="draft_id"]').value === item.dataset.draftId) {
+                window.location.href = '/homepage';
+                return;
+            }
+            item.remove();
+        }
+    });
+
+    // ========== Polls ==========
+
+    document.addEventListener('submit', async e => {
+        if (!e.target.matches('.poll-form')) return;
+        e.preventDefault();
+        const form = e.target;
+        if (!form.querySelector('input[name="option_id"]:checked')) return;
+
+        const response = await fetch('/poll/vote', {
+            method: 'POST',
+            headers: { 'Accept': 'application/json' },
+            body: new URLSearchParams(new FormData(form)),
+        });
+        if (!response.ok) {
+            alert(await response.text());
+            return;
+        }
+        const poll = await response.json();
+        form.closest('.poll').outerHTML = poll.html;
+    });
+
+    // Tallies only reach users who voted, and only results are updated
+    function updatePoll(tally) {
+        const poll = document.querySelector(`.poll[data-poll-id="${tally.poll_id}"]`);
+        if (!poll || !poll.querySelector('.poll-options')) return;
+
+        poll.querySelector('.poll-voters').textContent = tally.voters;
+        tally.options.forEach(option => {
+            const item = poll.querySelector(`.poll-option[data-option-id="${option.id}"]`);
+            if (!item) return;
+            item.querySelector('.poll-votes').textContent = option.votes;
+            item.querySelector('.poll-bar-fill').style.width = `${option.percent}%`;
+        });
+    }
+
+    // ========== Live Posts ==========
+
+    // Newly published posts, scheduled ones included, are announced over the
+    // websocket; a banner links to them instead of shifting the feed. Poll
+    // tallies come over the same socket.
+
+    const newPosts = document.getElementById('new-posts');
+
+    // ========== Notifications ==========
+
+    const notificationCount = document.getElementById('notification-count');
+
+    function showNotification(notification) {
+        if (notificationCount) {
+            notificationCount.textContent = Number(notificationCount.textContent) + 1;
+            notificationCount.hidden = false;
+        }
+
+        const toast = document.createElement('a');
+        toast.className = 'notification-toast';
+        toast.href = notification.link;
+        const action = notification.kind === 'reply' ? 'replied to your comment' : 'mentioned you';
+        toast.textContent = `${notification.actor} ${action}: ${notification.excerpt}`;
+        document.body.append(toast);
+        setTimeout(() => toast.remove(), 6000);
+    }
+
+    function connectFeedSocket() {
+        const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
+        const socket = new WebSocket(`${protocol}//${location.host}/ws`);
+
+        socket.onmessage = event => {
+            const message = JSON.parse(event.data);
+            if (message.type === 'poll') {
+                updatePoll(message);
+                return;
+            }
+            if (message.type === 'reactions') {
+                updateReactions(message);
+                return;
+            }
+            if (message.type === 'notification') {
+                showNotification(message);
+                return;
+            }
+            if (message.type !== 'new_post' || !newPosts) return;
+
+            const link = document.createElement('a');
+            link.href = `/post?id=${message.post_id}`;
+            link.textContent = `${message.username} posted "${message.title}"`;
+            newPosts.prepend(link);
+            newPosts.classList.add('visible');
+        };
+        socket.onclose = () => setTimeout(connectFeedSocket, 3000);
+    }
+
+    if (newPosts || notificationCount || document.querySelector('.poll, .reactions')) connectFeedSocket();
+
+    // ========== Post Deletion ==========
+
+    document.addEventListener('submit', e => {
+        if (!e.target.matches('.delete-post-form')) return;
+        if (!confirm('Delete this post and all of its comments?')) {
+            e.preventDefault();
+        }
+    });
+
+    document.addEventListener('submit', e => {
+        if (!e.target.matches('.merge-tag-form')) return;
+        if (!confirm('Move every post to the selected tag and delete this one?')) {
+            e.preventDefault();
+        }
+    });
+
+    // ========== Infinite Scroll ==========
+
+    const loadMore = document.getElementById('load-more');
+    const postsContainer = document.querySelector('.posts');
+
+    async function loadNextPage() {
+        if (loadMore.classList.contains('loading')) return;
+        loadMore.classList.add('loading');
+        loadMore.textContent = 'Loading...';
+
+        const params = new URLSearchParams(loadMore.dataset.params);
+        params.set('cursor', loadMore.dataset.cursor);
+
+        try {
+            const response = await fetch(`/api/posts?${params}`);
+            if (!response.ok) throw new Error(response.statusText);
+            const page = await response.json();
+
+            postsContainer.insertAdjacentHTML('beforeend', page.html);
+            if (page.next_cursor) {
+                loadMore.dataset.cursor = page.next_cursor;
+                params.set('cursor', page.next_cursor);
+                loadMore.href = `/homepage?${params}`;
+            } else {
+                observer.disconnect();
+                loadMore.remove();
+                return;
+            }
+        } catch (err) {
+            console.error("Error loading posts:", err);
+        }
+        loadMore.classList.remove('loading');
+        loadMore.textContent = 'Load more';
+    }
+
+    const observer = new IntersectionObserver(entries => {
+        if (entries.some(entry => entry.isIntersecting)) loadNextPage();
+    }, { rootMargin: '400px' });
+
+    if (loadMore && postsContainer) {
+        observer.observe(loadMore);
+        loadMore.addEventListener('click', e => {
+            e.preventDefault();
+            loadNextPage();
+        });
+    }
+
+    // ========== Tag Filter ==========
+
+    const tagFilter = document.getElementById('tag-filter');
+
+    document.addEventListener('click', e => {
+        const button = e.target.closest('.tag-op');
+        if (!button || !tagFilter) return;
+
+        // names that would not survive the tokenizer are quoted
+        let name = button.dataset.tag;
+        if (/[\s()"]/.test(name) || /^(and|or|not)$/i.test(name)) name = `"${name}"`;
+
+        const current = tagFilter.value.trim();
+        if (!current) {
+            tagFilter.value = button.dataset.op === 'NOT' ? `NOT ${name}` : name;
+        } else {
+            tagFilter.value = `${current} ${button.dataset.op} ${name}`;
+        }
+        tagFilter.form.submit();
+    });
+
+    // ========== Avatar Upload ==========
+
+    const avatarInput = document.getElementById('avatar-input');
+
+    if (avatarInput) {
+        avatarInput.addEventListener('change', function () {
+            if (this.files && this.files[0]) {
+                this.form.submit();
+            }
+        });
+    }
+
+    // ========== Attachments ==========
+
+    // Every chosen file gets an alt text and a caption field. The server
+    // pairs them with the files by order, so both fields are sent for each
+    // file, documents included.
+    const attachmentInput = document.getElementById('post-attachments');
+    const attachmentDetails = document.getElementById('attachment-details');
+
+    if (attachmentInput && attachmentDetails) {
+        attachmentInput.addEventListener('change', () => {
+            attachmentDetails.innerHTML = '';
+            const files = [...attachmentInput.files];
+            const existing = document.querySelectorAll('.attachment-item').length;
+            if (files.length + existing > Number(attachmentInput.dataset.max)) {
+                attachmentInput.setCustomValidity(`A post can have at most ${attachmentInput.dataset.max} attachments`);
+                attachmentInput.reportValidity();
+                return;
+            }
+            attachmentInput.setCustomValidity('');
+
+            files.forEach(file => {
+                const isImage = file.type.startsWith('image/');
+                const item = document.createElement('div');
+                item.className = 'attachment-item';
+
+                const preview = document.createElement(isImage ? 'img' : 'span');
+                preview.className = 'attachment-thumb';
+                if (isImage) {
+                    preview.src = URL.createObjectURL(file);
+                    preview.alt = '';
+                    preview.onload = () => URL.revokeObjectURL(preview.src);
+                } else {
+                    preview.textContent = `📄 ${file.name}`;
+                }
 
-    const imageInput = document.getElementById('post-image');
-    const imagePreview = document.getElementById('image-preview');
+                const fields = document.createElement('div');
+                fields.className = 'attachment-fields';
+                const alt = document.createElement('input');
+                alt.name = 'alt';
+                alt.maxLength = 300;
+                if (isImage) {
+                    alt.type = 'text';
+                    alt.placeholder = `Alt text for ${file.name}: describe the image`;
+                } else {
+                    alt.type = 'hidden';
+                }
+                const caption = document.createElement('input');
+                caption.type = 'text';
+                caption.name = 'caption';
+                caption.maxLength = 300;
+                caption.placeholder = 'Caption';
+                fields.append(alt, caption);
 
-    if (imageInput && imagePreview) {
-        imageInput.addEventListener('change', function () {
-            previewImage(this, imagePreview);
+                item.append(preview, fields);
+                attachmentDetails.append(item);
+            });
         });
     }
 });